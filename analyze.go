@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Command analysis for /prod start. Each analyzer recognises one kind of shell
+// and guesses whether the command writes or reads from a primary. When the
+// guess disagrees with the flags the user gave, the confirmation shows a
+// warning and the user has to explicitly acknowledge it before starting.
+//
+// New shells can be supported by adding to command_analyzers.
+
+type CommandAnalysis struct {
+	likely_writes		bool
+	likely_primary_read	bool
+	reasons			[]string
+}
+
+type CommandAnalyzer interface {
+	Name() string
+	Matches(command string) bool
+	Analyze(command string) CommandAnalysis
+}
+
+// patternAnalyzer covers shells where a handful of regexes are good enough.
+type patternAnalyzer struct {
+	name		string
+	match		*regexp.Regexp
+	writes		*regexp.Regexp
+	primary_reads	*regexp.Regexp
+}
+
+func (a patternAnalyzer) Name() string {
+	return a.name
+}
+
+func (a patternAnalyzer) Matches(command string) bool {
+	return a.match.MatchString(command)
+}
+
+func (a patternAnalyzer) Analyze(command string) CommandAnalysis {
+	analysis := CommandAnalysis{}
+	if a.writes != nil {
+		if m := a.writes.FindString(command); m != "" {
+			analysis.likely_writes = true
+			analysis.reasons = append(analysis.reasons, fmt.Sprintf("%v command contains `%v`, which looks like a write", a.name, strings.TrimSpace(m)))
+		}
+	}
+	if a.primary_reads != nil {
+		if m := a.primary_reads.FindString(command); m != "" {
+			analysis.likely_primary_read = true
+			analysis.reasons = append(analysis.reasons, fmt.Sprintf("%v command contains `%v`, which looks like a primary read", a.name, strings.TrimSpace(m)))
+		}
+	}
+	return analysis
+}
+
+var (
+	command_analyzers	[]CommandAnalyzer	= []CommandAnalyzer{
+		patternAnalyzer{
+			name:		"mongo",
+			match:		regexp.MustCompile(`\b(mongo|mongosh|dbshell)\b`),
+			writes:		regexp.MustCompile(`\.(insert|insertOne|insertMany|update|updateOne|updateMany|replaceOne|remove|deleteOne|deleteMany|save|drop|dropDatabase|dropIndex|createIndex|renameCollection|bulkWrite|findAndModify|findOneAndUpdate|findOneAndReplace|findOneAndDelete)\s*\(`),
+			primary_reads:	regexp.MustCompile(`readPref\(\s*['"]primary['"]|readPreference[=: ]+['"]?primary\b`),
+		},
+		patternAnalyzer{
+			name:		"psql",
+			match:		regexp.MustCompile(`\bpsql\b`),
+			writes:		regexp.MustCompile(`(?i)\b(insert\s+into|update\s+\S+\s+set|delete\s+from|drop|truncate|alter|create|grant|revoke|vacuum|reindex)\b`),
+		},
+		patternAnalyzer{
+			name:		"mysql",
+			match:		regexp.MustCompile(`\bmysql\b`),
+			writes:		regexp.MustCompile(`(?i)\b(insert\s+into|replace\s+into|update\s+\S+\s+set|delete\s+from|drop|truncate|alter|create|grant|revoke|optimize\s+table)\b`),
+		},
+		patternAnalyzer{
+			name:		"redis-cli",
+			match:		regexp.MustCompile(`\bredis-cli\b`),
+			writes:		regexp.MustCompile(`(?i)\b(set|setex|setnx|mset|del|unlink|expire|persist|rename|incr|incrby|decr|decrby|append|hset|hmset|hdel|hincrby|lpush|rpush|lpop|rpop|lset|lrem|ltrim|sadd|srem|spop|zadd|zrem|zincrby|flushdb|flushall|eval|evalsha|restore)(\s|$)`),
+		},
+		patternAnalyzer{
+			name:		"kubectl",
+			match:		regexp.MustCompile(`\bkubectl\b`),
+			writes:		regexp.MustCompile(`\bkubectl\s+((-n|--namespace|--context|--cluster)[= ]\S+\s+|-\S+\s+)*(apply|create|delete|edit|patch|replace|scale|rollout|set|label|annotate|drain|cordon|uncordon|taint|exec|cp)\b`),
+		},
+	}
+	// hosts that are named after the primary are a giveaway regardless of shell
+	primary_host_pattern	*regexp.Regexp		= regexp.MustCompile(`(?i)(^|[-_.])(primary|master)($|[-_.])`)
+)
+
+func analyzeExecution(exec JobExecution) CommandAnalysis {
+	analysis := CommandAnalysis{}
+	for _, analyzer := range command_analyzers {
+		if !analyzer.Matches(exec.command) {
+			continue
+		}
+		a := analyzer.Analyze(exec.command)
+		analysis.likely_writes = analysis.likely_writes || a.likely_writes
+		analysis.likely_primary_read = analysis.likely_primary_read || a.likely_primary_read
+		analysis.reasons = append(analysis.reasons, a.reasons...)
+	}
+	if primary_host_pattern.MatchString(exec.host) {
+		analysis.likely_primary_read = true
+		analysis.reasons = append(analysis.reasons, fmt.Sprintf("host `%v` looks like a primary", exec.host))
+	}
+	return analysis
+}
+
+// flagMismatches explains where the analysis disagrees with the execution's
+// writes/primary read flags. Empty means nothing to warn about.
+func flagMismatches(exec JobExecution) string {
+	// the reasons quote the command, so make sure they don't quote secrets
+	exec.command = redactCommand(exec.command)
+	analysis := analyzeExecution(exec)
+	msg := ""
+	if analysis.likely_writes && !exec.writes {
+		msg += "• This looks like it writes, but *writes* is set to no\n"
+	}
+	if analysis.likely_primary_read && !exec.primary_read {
+		msg += "• This looks like it reads from a primary, but *primary read* is set to no\n"
+	}
+	if msg == "" {
+		return ""
+	}
+	for _, reason := range analysis.reasons {
+		msg += fmt.Sprintf("  - %v\n", reason)
+	}
+	return msg
+}
@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+func TestAnalyzeExecution(t *testing.T) {
+	tests := []struct {
+		host		string
+		command		string
+		writes		bool
+		primary_read	bool
+	}{
+		{"mongo-secondary", `mongo merch --eval 'db.orders.find({})'`, false, false},
+		{"mongo-secondary", `mongo merch --eval 'db.orders.updateMany({}, {$set: {x: 1}})'`, true, false},
+		{"mongo-secondary", `mongosh merch --eval 'db.orders.insertOne({})'`, true, false},
+		{"mongo-secondary", `mongo merch --eval 'db.orders.find().readPref("primary")'`, false, true},
+		{"mongo-secondary", `mongo "mongodb://db1/merch?readPreference=primary" --eval 'db.orders.count()'`, false, true},
+		{"pg-replica", `psql -c "SELECT * FROM orders"`, false, false},
+		{"pg-replica", `psql -c "update orders set state = 'done'"`, true, false},
+		{"pg-replica", `psql -c "DELETE FROM orders WHERE id = 1"`, true, false},
+		// created_at isn't CREATE
+		{"pg-replica", `psql -c "SELECT created_at FROM orders"`, false, false},
+		{"mysql-replica", `mysql -e "REPLACE INTO orders VALUES (1)"`, true, false},
+		{"mysql-replica", `mysql -e "SELECT 1"`, false, false},
+		{"cache1", `redis-cli GET orders:1`, false, false},
+		{"cache1", `redis-cli DEL orders:1`, true, false},
+		{"cache1", `redis-cli hset orders:1 state done`, true, false},
+		// the most destructive ones usually end the command
+		{"cache1", `redis-cli -h prod FLUSHALL`, true, false},
+		{"cache1", `redis-cli -n 2 flushdb`, true, false},
+		{"cache1", `redis-cli DBSIZE`, false, false},
+		{"k8s", `kubectl get pods`, false, false},
+		{"k8s", `kubectl -n merch delete pod web-1`, true, false},
+		{"k8s", `kubectl --context prod scale deploy/web --replicas=3`, true, false},
+		// a write keyword outside a recognised shell isn't a write
+		{"app1", `./backfill --delete-from-cache`, false, false},
+		{"merchant-backend-primary", `./report`, false, true},
+		{"db-master.internal", `./report`, false, true},
+		{"db-mastery", `./report`, false, false},
+	}
+	for _, test := range tests {
+		a := analyzeExecution(JobExecution{host: test.host, command: test.command})
+		if a.likely_writes != test.writes || a.likely_primary_read != test.primary_read {
+			t.Errorf("%v on %v: writes %v, primary read %v; want %v, %v (%q)", test.command, test.host, a.likely_writes, a.likely_primary_read, test.writes, test.primary_read, a.reasons)
+		}
+	}
+}
+
+func TestFlagMismatches(t *testing.T) {
+	tests := []struct {
+		exec	JobExecution
+		warn	bool
+	}{
+		{JobExecution{host: "pg-replica", command: `psql -c "DROP TABLE orders"`, writes: true}, false},
+		{JobExecution{host: "pg-replica", command: `psql -c "DROP TABLE orders"`, writes: false}, true},
+		{JobExecution{host: "db-primary", command: `./report`, primary_read: false}, true},
+		{JobExecution{host: "db-primary", command: `./report`, primary_read: true}, false},
+		// flags that say more than the analysis can see are fine
+		{JobExecution{host: "app1", command: `./backfill`, writes: true, primary_read: true}, false},
+	}
+	for _, test := range tests {
+		if got := flagMismatches(test.exec); (got != "") != test.warn {
+			t.Errorf("flagMismatches(%+v) = %q, want a warning %v", test.exec, got, test.warn)
+		}
+	}
+}
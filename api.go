@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Read-only JSON API over the same data the slash commands use. Every request
+// needs "Authorization: Bearer <token>" where the token is one of the comma
+// separated values in PHARBOT_API_TOKENS. With no tokens configured the API
+// refuses everything.
+
+const (
+	api_default_limit	= 50
+	api_max_limit		= 500
+)
+
+var (
+	api_tokens	[]string	= parseAPITokens(os.Getenv("PHARBOT_API_TOKENS"))
+)
+
+type apiPage struct {
+	Items	interface{}	`json:"items"`
+	Total	int		`json:"total"`
+	Limit	int		`json:"limit"`
+	Offset	int		`json:"offset"`
+}
+
+type apiError struct {
+	Error	string	`json:"error"`
+}
+
+func parseAPITokens(raw string) []string {
+	tokens := []string{}
+	for _, t := range strings.Split(raw, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJSON(w, status, apiError{Error: fmt.Sprintf(format, args...)})
+}
+
+func validAPIToken(token string) bool {
+	if token == "" {
+		return false
+	}
+	valid := false
+	for _, t := range api_tokens {
+		// keep going after a match so timing doesn't leak which token it was
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// withAPIAuth wraps a handler with the bearer token check and GET-only method check.
+func withAPIAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeAPIError(w, http.StatusMethodNotAllowed, "%v not allowed", r.Method)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !validAPIToken(token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAPIError(w, http.StatusUnauthorized, "missing or invalid API token")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// parsePagination reads limit/offset from the query string and clamps them.
+func parsePagination(r *http.Request) (int, int, error) {
+	limit := api_default_limit
+	offset := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return 0, 0, fmt.Errorf("limit must be a positive integer, got '%v'", v)
+		}
+		limit = n
+	}
+	if limit > api_max_limit {
+		limit = api_max_limit
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("offset must be a non-negative integer, got '%v'", v)
+		}
+		offset = n
+	}
+	return limit, offset, nil
+}
+
+func paginate(total, limit, offset int) (int, int) {
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return offset, end
+}
+
+func handleAPIJobs(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	state_mutex.Lock()
+	jobs := append([]ProdJob{}, prod_jobs...)
+	state_mutex.Unlock()
+	start, end := paginate(len(jobs), limit, offset)
+	writeJSON(w, http.StatusOK, apiPage{Items: jobs[start:end], Total: len(jobs), Limit: limit, Offset: offset})
+}
+
+func handleAPIJob(w http.ResponseWriter, r *http.Request) {
+	raw := strings.TrimPrefix(r.URL.Path, "/api/jobs/")
+	job_id, err := strconv.Atoi(raw)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "couldn't parse '%v' as a job ID", raw)
+		return
+	}
+	state_mutex.Lock()
+	job := getProdJob(job_id)
+	state_mutex.Unlock()
+	if (job == ProdJob{}) {
+		writeAPIError(w, http.StatusNotFound, "no prod job with ID %v", job_id)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// allExecutions returns pending executions (no start time yet) followed by the
+// execution log, newest first.
+func allExecutions() []JobExecution {
+	execs := []JobExecution{}
+	for _, exec := range floating_execs {
+		if exec.start_time.IsZero() {
+			execs = append(execs, exec)
+		}
+	}
+	for i := len(execution_log) - 1; i >= 0; i-- {
+		execs = append(execs, execution_log[i])
+	}
+	return execs
+}
+
+func isActiveExecution(exec JobExecution) bool {
+	_, ok := floating_execs[exec.exec_id]
+	return ok
+}
+
+func handleAPIExecutions(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	query := r.URL.Query()
+	job_id := -1
+	if v := query.Get("job_id"); v != "" {
+		if job_id, err = strconv.Atoi(v); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "couldn't parse '%v' as a job ID", v)
+			return
+		}
+	}
+	user := strings.TrimPrefix(query.Get("user"), "@")
+	active := query.Get("active")
+	if active != "" && active != "true" && active != "false" {
+		writeAPIError(w, http.StatusBadRequest, "active must be true or false, got '%v'", active)
+		return
+	}
+
+	execs := []JobExecution{}
+	state_mutex.Lock()
+	for _, exec := range allExecutions() {
+		if job_id >= 0 && exec.job_id != job_id {
+			continue
+		}
+		if user != "" && exec.run_user != user {
+			continue
+		}
+		if active != "" && isActiveExecution(exec) != (active == "true") {
+			continue
+		}
+		execs = append(execs, exec)
+	}
+	state_mutex.Unlock()
+	start, end := paginate(len(execs), limit, offset)
+	writeJSON(w, http.StatusOK, apiPage{Items: execs[start:end], Total: len(execs), Limit: limit, Offset: offset})
+}
+
+func registerAPIHandlers() {
+	http.HandleFunc("/api/jobs", withAPIAuth(handleAPIJobs))
+	http.HandleFunc("/api/jobs/", withAPIAuth(handleAPIJob))
+	http.HandleFunc("/api/executions", withAPIAuth(handleAPIExecutions))
+	http.HandleFunc("/api/export/executions", withAPIAuth(handleAPIExport))
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// Execution artifacts: logs, CSVs, screenshots and links attached to a
+// JobExecution. Files come in through the Slack Events API (/events): anything
+// uploaded into a job's #prod thread is attached to it, as is the next upload
+// from someone who just ran `/prod attach <exec id>`. Files are copied into an
+// artifact store and linked from the audit log row and the #prod thread.
+//
+//	PHARBOT_ARTIFACT_STORE  "local" (default) or "http"
+//	PHARBOT_ARTIFACT_DIR    directory for the local store (default "artifacts")
+//	PHARBOT_ARTIFACT_URL    absolute base URL artifacts are served from, since the
+//	                        links are posted to Slack and the sheet. For the local
+//	                        store that's pharbot's own /artifacts/ (e.g.
+//	                        https://pharbot.example.com/artifacts); for the http
+//	                        store files are PUT under it (e.g. a bucket URL)
+//	PHARBOT_ARTIFACT_AUTH   Authorization header sent with http store PUTs
+//	SLACK_SIGNING_SECRET    used to verify requests to /events
+
+const (
+	pending_attach_window	= 10 * time.Minute
+	artifact_max_size	= 50 << 20
+)
+
+type Artifact struct {
+	name		string
+	url		string
+	user		string
+	added_time	time.Time
+}
+
+type ArtifactStore interface {
+	// Put stores the contents of r under key and returns a URL for it.
+	Put(key string, r io.Reader) (string, error)
+}
+
+type localArtifactStore struct {
+	dir		string
+	base_url	string
+}
+
+type httpArtifactStore struct {
+	base_url	string
+	auth		string
+	client		*http.Client
+}
+
+type pendingAttach struct {
+	exec_id	int
+	expires	time.Time
+}
+
+var (
+	artifact_store		ArtifactStore
+	execution_artifacts	map[int][]Artifact	= make(map[int][]Artifact)
+	// keyed by Slack user ID
+	pending_attaches	map[string]pendingAttach	= make(map[string]pendingAttach)
+	slack_signing_secret	string			= os.Getenv("SLACK_SIGNING_SECRET")
+	unsafe_filename_chars	*regexp.Regexp		= regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+)
+
+// artifactBaseURL checks PHARBOT_ARTIFACT_URL. Links relative to pharbot
+// wouldn't go anywhere from Slack or the spreadsheet.
+func artifactBaseURL() (string, error) {
+	base_url := strings.TrimRight(os.Getenv("PHARBOT_ARTIFACT_URL"), "/")
+	if base_url == "" {
+		return "", fmt.Errorf("PHARBOT_ARTIFACT_URL isn't set")
+	}
+	if u, err := url.Parse(base_url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("PHARBOT_ARTIFACT_URL '%v' isn't an absolute http(s) URL", base_url)
+	}
+	return base_url, nil
+}
+
+func LoadArtifactStore() {
+	base_url, err := artifactBaseURL()
+	switch os.Getenv("PHARBOT_ARTIFACT_STORE") {
+	case "http":
+		if err != nil {
+			fmt.Printf("[ERROR] %v; artifacts disabled\n", err)
+			return
+		}
+		artifact_store = &httpArtifactStore{base_url: base_url, auth: os.Getenv("PHARBOT_ARTIFACT_AUTH"), client: &http.Client{Timeout: 5 * time.Minute}}
+	case "", "local":
+		if err != nil {
+			fmt.Printf("[WARN] %v; artifacts disabled\n", err)
+			return
+		}
+		dir := os.Getenv("PHARBOT_ARTIFACT_DIR")
+		if dir == "" {
+			dir = "artifacts"
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			fmt.Printf("[ERROR] Unable to create artifact directory %v: %v; artifacts disabled\n", dir, err)
+			return
+		}
+		artifact_store = &localArtifactStore{dir: dir, base_url: base_url}
+		// local artifacts are served by us, behind the same login as the dashboard
+		http.Handle("/artifacts/", withDashboardAuth(http.StripPrefix("/artifacts/", http.FileServer(http.Dir(dir))).ServeHTTP))
+	default:
+		fmt.Printf("[ERROR] Unknown PHARBOT_ARTIFACT_STORE '%v'; artifacts disabled\n", os.Getenv("PHARBOT_ARTIFACT_STORE"))
+	}
+}
+
+func (store *localArtifactStore) Put(key string, r io.Reader) (string, error) {
+	dest := filepath.Join(store.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		os.Remove(dest)
+		return "", err
+	}
+	return store.base_url + "/" + key, nil
+}
+
+func (store *httpArtifactStore) Put(key string, r io.Reader) (string, error) {
+	url := store.base_url + "/" + key
+	req, err := http.NewRequest("PUT", url, r)
+	if err != nil {
+		return "", err
+	}
+	if store.auth != "" {
+		req.Header.Set("Authorization", store.auth)
+	}
+	resp, err := store.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("object store returned %v", resp.Status)
+	}
+	return url, nil
+}
+
+func artifactKey(exec_id int, name string) string {
+	name = unsafe_filename_chars.ReplaceAllString(path.Base(name), "_")
+	return fmt.Sprintf("%v/%v-%v", exec_id, time.Now().Format("20060102-150405"), name)
+}
+
+// addArtifact records an artifact against an execution and links it from the
+// audit log and the #prod thread.
+func addArtifact(exec JobExecution, artifact Artifact) {
+	execution_artifacts[exec.exec_id] = append(execution_artifacts[exec.exec_id], artifact)
+	UpdateExecutionArtifacts(exec, execution_artifacts[exec.exec_id])
+	journalAppend(artifact.user, "execution.artifact_added", fmt.Sprintf("execution %v of job %v", exec.exec_id, exec.job_id), artifact.url, "")
+	if ts, ok := msg_timestamp[exec.exec_id]; ok {
+		params := slack.PostMessageParameters{ThreadTimestamp: ts}
+		api.PostMessage(prod_channel_id, fmt.Sprintf("@%v attached <%v|%v>", artifact.user, artifact.url, artifact.name), params)
+	}
+	emitEvent("execution.artifact_added", struct {
+		ExecID	int	`json:"exec_id"`
+		Name	string	`json:"name"`
+		URL	string	`json:"url"`
+		User	string	`json:"user"`
+	}{exec.exec_id, artifact.name, artifact.url, artifact.user})
+}
+
+func findExecution(exec_id int) (JobExecution, bool) {
+	if exec, ok := floating_execs[exec_id]; ok {
+		return exec, true
+	}
+	for _, exec := range execution_log {
+		if exec.exec_id == exec_id {
+			return exec, true
+		}
+	}
+	return JobExecution{}, false
+}
+
+func serializeArtifacts(exec_id int) string {
+	msg := ""
+	for _, a := range execution_artifacts[exec_id] {
+		msg += fmt.Sprintf("• <%v|%v> from @%v, %v\n", a.url, a.name, a.user, a.added_time.Format("2006-01-02 15:04"))
+	}
+	if msg == "" {
+		msg = fmt.Sprintf("Execution %v has no artifacts", exec_id)
+	}
+	return msg
+}
+
+func handleProdAttach(s slack.SlashCommand, words []string) {
+	exec_id, err := strconv.Atoi(words[1])
+	if err != nil {
+		rejectSlash(s, "invalid", fmt.Sprintf("Couldn't parse '%v' as an execution ID", words[1]))
+		return
+	}
+	exec, ok := findExecution(exec_id)
+	if !ok || exec.start_time.IsZero() {
+		rejectSlash(s, "invalid", fmt.Sprintf("Could not find a started execution with ID %v", exec_id))
+		return
+	}
+	if len(words) > 2 {
+		// /prod attach <exec id> <url> [description]
+		// Slack sends links as <url> or <url|label>
+		url := strings.Trim(words[2], "<>")
+		if i := strings.Index(url, "|"); i >= 0 {
+			url = url[:i]
+		}
+		name := strings.Join(words[3:], " ")
+		if name == "" {
+			name = url
+		}
+		addArtifact(exec, Artifact{name: name, url: url, user: s.UserName, added_time: time.Now()})
+		replyToSlash(s, fmt.Sprintf("Attached %v to execution %v", url, exec_id))
+		return
+	}
+	if artifact_store == nil {
+		replyToSlash(s, "File uploads aren't set up, but you can still attach a link with `/prod attach <exec id> <url> [description]`")
+		return
+	}
+	pending_attaches[s.UserID] = pendingAttach{exec_id: exec_id, expires: time.Now().Add(pending_attach_window)}
+	replyToSlash(s, fmt.Sprintf("OK! Upload files in a DM with me in the next %v minutes and I'll attach them to execution %v. Files uploaded to the job's #prod thread are attached automatically.", int(pending_attach_window.Minutes()), exec_id))
+}
+
+func verifySlackRequest(r *http.Request, body []byte) bool {
+	if slack_signing_secret == "" {
+		fmt.Println("[ERROR] SLACK_SIGNING_SECRET isn't set, rejecting Slack event")
+		return false
+	}
+	timestamp := r.Header.Get("X-Slack-Request-Timestamp")
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || math.Abs(float64(time.Now().Unix()-ts)) > 5*60 {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(slack_signing_secret))
+	mac.Write([]byte("v0:" + timestamp + ":"))
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Slack-Signature")))
+}
+
+type slackEventFile struct {
+	ID			string	`json:"id"`
+	Name			string	`json:"name"`
+	Title			string	`json:"title"`
+	Size			int	`json:"size"`
+	URLPrivateDownload	string	`json:"url_private_download"`
+}
+
+type slackEvent struct {
+	Type		string			`json:"type"`
+	Subtype		string			`json:"subtype"`
+	User		string			`json:"user"`
+	Channel		string			`json:"channel"`
+	ThreadTS	string			`json:"thread_ts"`
+	Files		[]slackEventFile	`json:"files"`
+}
+
+func HandleSlackEvent(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil || !verifySlackRequest(r, body) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	payload := struct {
+		Type		string		`json:"type"`
+		Challenge	string		`json:"challenge"`
+		Event		slackEvent	`json:"event"`
+	}{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if payload.Type == "url_verification" {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(payload.Challenge))
+		return
+	}
+	// Slack retries if we take more than 3 seconds, so ack first and download after
+	w.WriteHeader(http.StatusOK)
+	if payload.Type == "event_callback" && payload.Event.Type == "message" && payload.Event.Subtype == "file_share" {
+		go handleFileShare(payload.Event)
+	}
+}
+
+func executionForUpload(event slackEvent) (JobExecution, bool) {
+	if event.Channel == prod_channel_id && event.ThreadTS != "" {
+		for exec_id, ts := range msg_timestamp {
+			if ts == event.ThreadTS {
+				return findExecution(exec_id)
+			}
+		}
+	}
+	if pending, ok := pending_attaches[event.User]; ok {
+		if time.Now().Before(pending.expires) {
+			return findExecution(pending.exec_id)
+		}
+		delete(pending_attaches, event.User)
+	}
+	return JobExecution{}, false
+}
+
+func handleFileShare(event slackEvent) {
+	if artifact_store == nil {
+		return
+	}
+	state_mutex.Lock()
+	exec, ok := executionForUpload(event)
+	state_mutex.Unlock()
+	if !ok {
+		return
+	}
+	user, err := api.GetUserInfo(event.User)
+	if err != nil {
+		fmt.Printf("[ERROR] Unable to look up uploader %v: %v\n", event.User, err)
+		return
+	}
+	for _, file := range event.Files {
+		if file.Size > artifact_max_size {
+			fmt.Printf("[WARN] Not attaching %v to execution %v: %v bytes is too big\n", file.Name, exec.exec_id, file.Size)
+			continue
+		}
+		url, err := storeSlackFile(exec.exec_id, file)
+		if err != nil {
+			fmt.Printf("[ERROR] Unable to store %v for execution %v: %v\n", file.Name, exec.exec_id, err)
+			continue
+		}
+		state_mutex.Lock()
+		addArtifact(exec, Artifact{name: file.Name, url: url, user: user.Name, added_time: time.Now()})
+		state_mutex.Unlock()
+	}
+}
+
+func storeSlackFile(exec_id int, file slackEventFile) (string, error) {
+	req, err := http.NewRequest("GET", file.URLPrivateDownload, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("SLACK_TOKEN"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("downloading from Slack returned %v", resp.Status)
+	}
+	return artifact_store.Put(artifactKey(exec_id, file.Name), io.LimitReader(resp.Body, artifact_max_size))
+}
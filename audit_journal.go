@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pharbot's own audit trail. The Execution Audit Log sheet can be edited by
+// anyone with access, so every command, approval, start, stop and edit is
+// also appended to audit_journal.jsonl, one JSON entry per line. Each entry
+// includes the hash of the one before it, so changing or removing an entry
+// breaks the chain from there on. The chain can't show entries cut off the
+// end, or the whole file going, so the last entry's seq and hash (the head)
+// are also kept in audit_journal.head and posted to #prod every day.
+// `/prod admin verify-audit` checks the chain and the head, and compares the
+// sheet with what the journal says pharbot wrote to it.
+
+const (
+	audit_journal_file	= "audit_journal.jsonl"
+	audit_journal_head_file	= "audit_journal.head"
+	journal_anchor_interval	= 24 * time.Hour
+)
+
+type JournalEntry struct {
+	seq		int
+	time		time.Time
+	user		string
+	action		string
+	subject		string
+	detail		string
+	// for executions, the execRowKey used to find its row in the sheet
+	key		string
+	prev_hash	string
+	hash		string
+}
+
+type journalEntryJSON struct {
+	Seq		int		`json:"seq"`
+	Time		time.Time	`json:"time"`
+	User		string		`json:"user"`
+	Action		string		`json:"action"`
+	Subject		string		`json:"subject"`
+	Detail		string		`json:"detail,omitempty"`
+	Key		string		`json:"key,omitempty"`
+	PrevHash	string		`json:"prev_hash"`
+	Hash		string		`json:"hash"`
+}
+
+type journalHead struct {
+	Seq	int	`json:"seq"`
+	Hash	string	`json:"hash"`
+}
+
+var (
+	journal_mutex		sync.Mutex
+	journal_last_seq	int
+	journal_last_hash	string
+)
+
+func (e JournalEntry) computeHash() string {
+	b, _ := json.Marshal([]interface{}{e.seq, e.time.UTC().Format(time.RFC3339Nano), e.user, e.action, e.subject, e.detail, e.key, e.prev_hash})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// readJournal returns the journal's entries. Lines that can't be parsed are
+// returned as errors along with everything that could.
+func readJournal() ([]JournalEntry, []string, error) {
+	f, err := os.Open(audit_journal_file)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	entries, problems := []JournalEntry{}, []string{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		v := journalEntryJSON{}
+		if err := json.Unmarshal(scanner.Bytes(), &v); err != nil {
+			problems = append(problems, fmt.Sprintf("line %v can't be parsed: %v", line, err))
+			continue
+		}
+		entries = append(entries, JournalEntry{v.Seq, v.Time, v.User, v.Action, v.Subject, v.Detail, v.Key, v.PrevHash, v.Hash})
+	}
+	return entries, problems, scanner.Err()
+}
+
+// verifyJournal checks every entry's hash and its link to the previous entry,
+// returning a description of each break.
+func verifyJournal(entries []JournalEntry) []string {
+	problems := []string{}
+	if len(entries) > 0 && entries[0].seq != 1 {
+		problems = append(problems, fmt.Sprintf("the journal starts at entry %v rather than 1; the entries before it have been removed", entries[0].seq))
+	} else if len(entries) > 0 && entries[0].prev_hash != "" {
+		problems = append(problems, "the journal's first entry links to an earlier one; the entries before it have been removed")
+	}
+	prev := JournalEntry{}
+	for i, e := range entries {
+		if i > 0 && e.seq != prev.seq+1 {
+			problems = append(problems, fmt.Sprintf("entry %v follows entry %v; entries are missing or out of order", e.seq, prev.seq))
+		}
+		if i > 0 && e.prev_hash != prev.hash {
+			problems = append(problems, fmt.Sprintf("entry %v doesn't link to entry %v", e.seq, prev.seq))
+		}
+		if e.computeHash() != e.hash {
+			problems = append(problems, fmt.Sprintf("entry %v (%v by @%v at %v) has been modified", e.seq, e.action, e.user, e.time.Format(time.RFC3339)))
+		}
+		prev = e
+	}
+	return problems
+}
+
+func readJournalHead() (journalHead, error) {
+	head := journalHead{}
+	b, err := ioutil.ReadFile(audit_journal_head_file)
+	if os.IsNotExist(err) {
+		return head, nil
+	}
+	if err != nil {
+		return head, err
+	}
+	return head, json.Unmarshal(b, &head)
+}
+
+// writeJournalHead replaces the head file, so it's never half written.
+func writeJournalHead(head journalHead) error {
+	b, _ := json.Marshal(head)
+	tmp := audit_journal_head_file + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, audit_journal_head_file)
+}
+
+// verifyJournalHead checks that the journal still reaches the head recorded
+// when the last entry was written.
+func verifyJournalHead(entries []JournalEntry, head journalHead) []string {
+	if head.Seq == 0 {
+		return nil
+	}
+	if len(entries) == 0 {
+		return []string{fmt.Sprintf("the journal is missing or empty, but %v entries had been written", head.Seq)}
+	}
+	for _, e := range entries {
+		if e.seq == head.Seq {
+			if e.hash != head.Hash {
+				return []string{fmt.Sprintf("entry %v isn't the one recorded in %v", e.seq, audit_journal_head_file)}
+			}
+			return nil
+		}
+	}
+	if last := entries[len(entries)-1]; last.seq < head.Seq {
+		return []string{fmt.Sprintf("the journal ends at entry %v, but %v entries had been written; it has been cut short", last.seq, head.Seq)}
+	}
+	return []string{fmt.Sprintf("entry %v, the last one recorded in %v, is missing", head.Seq, audit_journal_head_file)}
+}
+
+// checkJournal reads the journal and checks both its chain and its head.
+func checkJournal() ([]JournalEntry, journalHead, []string, error) {
+	journal_mutex.Lock()
+	defer journal_mutex.Unlock()
+	entries, problems, err := readJournal()
+	if err != nil {
+		return nil, journalHead{}, nil, err
+	}
+	problems = append(problems, verifyJournal(entries)...)
+	head, err := readJournalHead()
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("%v can't be read: %v", audit_journal_head_file, err))
+	}
+	problems = append(problems, verifyJournalHead(entries, head)...)
+	return entries, head, problems, nil
+}
+
+func LoadAuditJournal() {
+	entries, head, problems, err := checkJournal()
+	if err != nil {
+		fmt.Printf("[ERROR] Unable to read %v: %v\n", audit_journal_file, err)
+		return
+	}
+	for _, p := range problems {
+		fmt.Printf("[ERROR] Audit journal: %v\n", p)
+	}
+	if len(problems) > 0 {
+		sendProdMessage(fmt.Sprintf(":rotating_light: pharbot's audit journal has been tampered with:\n%v", strings.Join(problems, "\n")))
+	}
+	// carry on from the last entry regardless, or from the head if entries
+	// have gone missing off the end, so the break stays visible
+	if len(entries) > 0 {
+		last := entries[len(entries)-1]
+		journal_last_seq, journal_last_hash = last.seq, last.hash
+	}
+	if head.Seq > journal_last_seq {
+		journal_last_seq, journal_last_hash = head.Seq, head.Hash
+	}
+	fmt.Printf("[INFO] Loaded audit journal with %v entries\n", len(entries))
+}
+
+// RunJournalAnchor posts the journal's head to #prod every day, so there's a
+// copy of it nobody with access to pharbot's files can change.
+func RunJournalAnchor() {
+	posted := 0
+	for {
+		time.Sleep(journal_anchor_interval)
+		journal_mutex.Lock()
+		seq, hash := journal_last_seq, journal_last_hash
+		journal_mutex.Unlock()
+		if seq == posted {
+			continue
+		}
+		sendProdMessage(fmt.Sprintf(":lock: Audit journal head: entry %v, hash `%v`. If the journal ever ends before this entry, or has a different hash for it, it's been tampered with.", seq, hash))
+		posted = seq
+	}
+}
+
+// journalAppend adds an entry to the journal. The file is synced before it
+// returns, so an entry that was appended survives a crash.
+func journalAppend(user, action, subject, detail, key string) {
+	journal_mutex.Lock()
+	defer journal_mutex.Unlock()
+	e := JournalEntry{seq: journal_last_seq + 1, time: time.Now(), user: user, action: action, subject: subject, detail: detail, key: key, prev_hash: journal_last_hash}
+	e.hash = e.computeHash()
+	b, _ := json.Marshal(journalEntryJSON{e.seq, e.time, e.user, e.action, e.subject, e.detail, e.key, e.prev_hash, e.hash})
+	f, err := os.OpenFile(audit_journal_file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err == nil {
+		if _, err = f.Write(append(b, '\n')); err == nil {
+			err = f.Sync()
+		}
+		f.Close()
+	}
+	if err != nil {
+		fmt.Printf("[ERROR] Unable to append to %v: %v\n%s\n", audit_journal_file, err, b)
+		return
+	}
+	journal_last_seq, journal_last_hash = e.seq, e.hash
+	if err := writeJournalHead(journalHead{e.seq, e.hash}); err != nil {
+		fmt.Printf("[ERROR] Unable to write %v: %v\n", audit_journal_head_file, err)
+	}
+}
+
+func journalExecution(user, action string, exec JobExecution) {
+	journalAppend(user, action, fmt.Sprintf("execution %v of job %v", exec.exec_id, exec.job_id), execSheetView(exec), execRowKey(exec))
+}
+
+func journalJobEdit(edit JobEdit) {
+	journalAppend(edit.user, "job.edited", fmt.Sprintf("job %v", edit.job_id), fmt.Sprintf("%v: %v -> %v", edit.field, edit.old_value, edit.new_value), "")
+}
+
+// diffJournalWithSheet compares each execution's row in the Execution Audit
+// Log with the last thing the journal has for it, to find edits made by hand.
+// Rows are paired with executions by execRowKey. Where executions share a
+// key, rows that match one of them exactly are paired off first, so only
+// what's left over is reported. Rows for executions from before the journal
+// existed aren't checked.
+func diffJournalWithSheet(entries []JournalEntry) ([]string, error) {
+	if sheets_service == nil {
+		return nil, fmt.Errorf("the spreadsheet isn't loaded")
+	}
+	FlushSheets()
+	sheetsThrottle()
+	resp, err := sheets_service.Spreadsheets.Values.Get(spreadsheet_id, audit_log_tab.dataRange()).Do()
+	if err != nil {
+		return nil, fmt.Errorf("reading %v: %v", audit_log_tab.name, err)
+	}
+	type sheetRow struct {
+		row	int
+		view	string
+		start	time.Time
+	}
+	rows := make(map[string][]sheetRow)
+	for i, row := range resp.Values {
+		if exec, ok := parseExecutionRow(row, -1); ok {
+			rows[execRowKey(exec)] = append(rows[execRowKey(exec)], sheetRow{audit_log_tab.dataRow(i), execSheetView(exec), exec.start_time})
+		}
+	}
+
+	// the last view the journal has for each execution, in journal order;
+	// edits taken from the sheet count, since the journal knows about them
+	written := make(map[string]JournalEntry)
+	order := []string{}
+	for _, e := range entries {
+		switch e.action {
+		case "execution.started", "execution.stopped", "execution.added_in_sheet", "execution.edited_in_sheet":
+		default:
+			continue
+		}
+		if _, ok := written[e.subject]; !ok {
+			order = append(order, e.subject)
+		}
+		written[e.subject] = e
+	}
+	by_key := make(map[string][]JournalEntry)
+	keys := []string{}
+	for _, subject := range order {
+		e := written[subject]
+		if _, ok := by_key[e.key]; !ok {
+			keys = append(keys, e.key)
+		}
+		by_key[e.key] = append(by_key[e.key], e)
+	}
+
+	diffs := []string{}
+	for _, key := range keys {
+		matches := rows[key]
+		unmatched := []JournalEntry{}
+		for _, e := range by_key[key] {
+			found := -1
+			for i, r := range matches {
+				if r.view == e.detail {
+					found = i
+					break
+				}
+			}
+			if found < 0 {
+				unmatched = append(unmatched, e)
+				continue
+			}
+			matches = append(matches[:found], matches[found+1:]...)
+		}
+		switch {
+		case len(unmatched) == 0:
+		case len(matches) == 0:
+			for _, e := range unmatched {
+				diffs = append(diffs, fmt.Sprintf("%v is missing from the sheet (or its start, user, job or host was changed)", e.subject))
+			}
+		case len(unmatched) == 1 && len(matches) == 1:
+			diffs = append(diffs, fmt.Sprintf("%v (row %v) was edited:\n  sheet: %v\n  journal: %v", unmatched[0].subject, matches[0].row, matches[0].view, unmatched[0].detail))
+			matches = nil
+		default:
+			candidates := []string{}
+			for _, r := range matches {
+				candidates = append(candidates, strconv.Itoa(r.row))
+			}
+			for _, e := range unmatched {
+				diffs = append(diffs, fmt.Sprintf("%v doesn't match any of rows %v, which share its job, user, host and start time; one of them was edited:\n  journal: %v", e.subject, strings.Join(candidates, ", "), e.detail))
+			}
+			matches = nil
+		}
+		rows[key] = matches
+	}
+	if len(entries) > 0 {
+		added := []sheetRow{}
+		for _, left := range rows {
+			for _, r := range left {
+				if r.start.After(entries[0].time) {
+					added = append(added, r)
+				}
+			}
+		}
+		sort.Slice(added, func(i, j int) bool { return added[i].row < added[j].row })
+		for _, r := range added {
+			diffs = append(diffs, fmt.Sprintf("row %v isn't in the journal; it was probably added by hand: %v", r.row, r.view))
+		}
+	}
+	return diffs, nil
+}
+
+func handleVerifyAudit(user string) string {
+	fmt.Printf("[AUDIT] @%v verified the audit journal\n", user)
+	entries, head, problems, err := checkJournal()
+	if err != nil {
+		return fmt.Sprintf("Couldn't read the audit journal: %v", err)
+	}
+	msg := ""
+	if len(problems) == 0 {
+		msg = fmt.Sprintf(":white_check_mark: The audit journal's %v entries are intact. Its head is entry %v, hash `%v`; it should match or follow the last one posted in #prod.\n", len(entries), head.Seq, head.Hash)
+	} else {
+		msg = fmt.Sprintf(":rotating_light: The audit journal has been tampered with (%v entries):\n%v\n", len(entries), strings.Join(problems, "\n"))
+	}
+	diffs, err := diffJournalWithSheet(entries)
+	switch {
+	case err != nil:
+		msg += fmt.Sprintf("Couldn't compare it with the spreadsheet: %v", err)
+	case len(diffs) == 0:
+		msg += "The Execution Audit Log matches it."
+	default:
+		msg += fmt.Sprintf(":warning: %v differences with the Execution Audit Log:\n%v", len(diffs), strings.Join(diffs, "\n"))
+	}
+	return msg
+}
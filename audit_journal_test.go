@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// testJournal builds an intact chain of n entries.
+func testJournal(n int) []JournalEntry {
+	entries := []JournalEntry{}
+	prev_hash := ""
+	start := time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC)
+	for i := 1; i <= n; i++ {
+		e := JournalEntry{seq: i, time: start.Add(time.Duration(i) * time.Minute), user: "jsmith", action: "command", subject: "/prod list", prev_hash: prev_hash}
+		e.hash = e.computeHash()
+		entries = append(entries, e)
+		prev_hash = e.hash
+	}
+	return entries
+}
+
+func TestVerifyJournal(t *testing.T) {
+	tests := []struct {
+		name	string
+		change	func([]JournalEntry) []JournalEntry
+		want	[]string
+	}{
+		{"intact", func(e []JournalEntry) []JournalEntry { return e }, nil},
+		{"empty", func(e []JournalEntry) []JournalEntry { return nil }, nil},
+		{"modified", func(e []JournalEntry) []JournalEntry {
+			e[2].user = "jdoe"
+			return e
+		}, []string{"entry 3 (command by @jdoe at 2024-03-04T09:03:00Z) has been modified"}},
+		{"modified and rehashed", func(e []JournalEntry) []JournalEntry {
+			e[2].user = "jdoe"
+			e[2].hash = e[2].computeHash()
+			return e
+		}, []string{"entry 4 doesn't link to entry 3"}},
+		{"middle removed", func(e []JournalEntry) []JournalEntry {
+			return append(e[:2], e[3:]...)
+		}, []string{"entry 4 follows entry 2; entries are missing or out of order", "entry 4 doesn't link to entry 2"}},
+		{"start removed", func(e []JournalEntry) []JournalEntry {
+			return e[2:]
+		}, []string{"the journal starts at entry 3 rather than 1; the entries before it have been removed"}},
+		{"start removed and renumbered", func(e []JournalEntry) []JournalEntry {
+			// a forged first entry still has to link to nothing
+			e = e[2:]
+			e[0].seq = 1
+			e[0].hash = e[0].computeHash()
+			return e
+		}, []string{"the journal's first entry links to an earlier one; the entries before it have been removed", "entry 4 follows entry 1; entries are missing or out of order", "entry 4 doesn't link to entry 1"}},
+	}
+	for _, test := range tests {
+		got := verifyJournal(test.change(testJournal(5)))
+		if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("%v: got problems %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestVerifyJournalHead(t *testing.T) {
+	entries := testJournal(5)
+	tests := []struct {
+		name	string
+		entries	[]JournalEntry
+		head	journalHead
+		want	string
+	}{
+		{"no head yet", entries, journalHead{}, ""},
+		{"at the head", entries, journalHead{5, entries[4].hash}, ""},
+		// the head file is written just after the entry, so a crash can leave it behind
+		{"past the head", entries, journalHead{4, entries[3].hash}, ""},
+		{"missing", nil, journalHead{5, entries[4].hash}, "the journal is missing or empty, but 5 entries had been written"},
+		{"cut short", entries[:3], journalHead{5, entries[4].hash}, "the journal ends at entry 3, but 5 entries had been written; it has been cut short"},
+		{"different head", entries, journalHead{5, entries[3].hash}, "entry 5 isn't the one recorded in audit_journal.head"},
+		{"head removed", append(append([]JournalEntry{}, entries[:4]...), JournalEntry{seq: 7}), journalHead{5, entries[4].hash}, "entry 5, the last one recorded in audit_journal.head, is missing"},
+	}
+	for _, test := range tests {
+		if got := strings.Join(verifyJournalHead(test.entries, test.head), "\n"); got != test.want {
+			t.Errorf("%v: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
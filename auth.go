@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Role-based access control. Roles come from roles.json:
+//
+//	{"default": "viewer", "users": {"jsmith": "admin"}, "groups": {"S0123ABCD": "runner"}}
+//
+// users are keyed by Slack username, groups by Slack user group ID. A user gets
+// the highest role any of those give them. Without a roles.json everyone is a
+// runner. Either way, the prod admins listed by Slack username in
+// PHARBOT_PROD_ADMINS and the members of the Slack user group with the ID in
+// PHARBOT_PROD_ADMIN_GROUP are admins.
+
+const (
+	role_viewer	= iota
+	role_runner
+	role_approver
+	role_admin
+)
+
+const (
+	roles_config_file	= "roles.json"
+	group_cache_ttl		= 5 * time.Minute
+	permission_log_size	= 500
+)
+
+var (
+	role_names	[]string	= []string{"viewer", "runner", "approver", "admin"}
+	prod_admins	[]string	= splitList(os.Getenv("PHARBOT_PROD_ADMINS"))
+	prod_admin_group	string	= os.Getenv("PHARBOT_PROD_ADMIN_GROUP")
+	role_config	*RoleConfig
+	role_mutex	sync.Mutex
+	group_members	map[string][]string	= make(map[string][]string)
+	group_fetched	map[string]time.Time	= make(map[string]time.Time)
+	permission_log	[]PermissionDecision	= []PermissionDecision{}
+)
+
+type RoleConfig struct {
+	Default	string			`json:"default"`
+	Users	map[string]string	`json:"users"`
+	Groups	map[string]string	`json:"groups"`
+}
+
+type PermissionDecision struct {
+	time		time.Time
+	user		string
+	action		string
+	role		int
+	required	int
+	allowed		bool
+}
+
+func splitList(raw string) []string {
+	items := []string{}
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func parseRole(name string) (int, bool) {
+	for i, v := range role_names {
+		if v == strings.ToLower(name) {
+			return i, true
+		}
+	}
+	return role_viewer, false
+}
+
+func LoadRoles() {
+	b, err := ioutil.ReadFile(roles_config_file)
+	if err != nil {
+		fmt.Printf("[WARN] No %v found, every user is treated as a runner\n", roles_config_file)
+		return
+	}
+	config := &RoleConfig{}
+	if err := json.Unmarshal(b, config); err != nil {
+		// refuse to start with broken roles rather than silently opening everything up
+		fmt.Printf("[ERROR] Unable to parse %v: %v\n", roles_config_file, err)
+		os.Exit(1)
+	}
+	if config.Users == nil {
+		config.Users = make(map[string]string)
+	}
+	if config.Groups == nil {
+		config.Groups = make(map[string]string)
+	}
+	role_config = config
+	fmt.Printf("[INFO] Loaded roles for %v users and %v groups\n", len(config.Users), len(config.Groups))
+}
+
+func saveRoles() error {
+	b, err := json.MarshalIndent(role_config, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write then rename so a crash can't leave a half written roles file
+	tmp := roles_config_file + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, roles_config_file)
+}
+
+// isGroupMember checks the cached members of a user group, refreshing them
+// from Slack when they're stale. Slack isn't called with role_mutex held.
+func isGroupMember(group_id, user_id string) bool {
+	role_mutex.Lock()
+	members, fetched := group_members[group_id], group_fetched[group_id]
+	role_mutex.Unlock()
+	if time.Since(fetched) > group_cache_ttl {
+		fresh, err := api.GetUserGroupMembers(group_id)
+		if err != nil {
+			fmt.Printf("[ERROR] Unable to fetch members of user group %v: %v\n", group_id, err)
+		} else {
+			members = fresh
+			role_mutex.Lock()
+			group_members[group_id] = fresh
+			group_fetched[group_id] = time.Now()
+			role_mutex.Unlock()
+		}
+	}
+	for _, member := range members {
+		if member == user_id {
+			return true
+		}
+	}
+	return false
+}
+
+// roleFor returns the user's role and where it came from.
+func roleFor(user_id, user string) (int, string) {
+	for _, admin := range prod_admins {
+		if strings.TrimPrefix(admin, "@") == user {
+			return role_admin, "PHARBOT_PROD_ADMINS"
+		}
+	}
+	if prod_admin_group != "" && isGroupMember(prod_admin_group, user_id) {
+		return role_admin, "group " + prod_admin_group
+	}
+
+	role_mutex.Lock()
+	if role_config == nil {
+		role_mutex.Unlock()
+		return role_runner, "no roles configured"
+	}
+	role, _ := parseRole(role_config.Default)
+	source := "default"
+	if name, ok := role_config.Users[user]; ok {
+		if r, _ := parseRole(name); r > role {
+			role, source = r, "user"
+		}
+	}
+	groups := make(map[string]string)
+	for group_id, name := range role_config.Groups {
+		groups[group_id] = name
+	}
+	role_mutex.Unlock()
+
+	for group_id, name := range groups {
+		if r, _ := parseRole(name); r > role && isGroupMember(group_id, user_id) {
+			role, source = r, "group "+group_id
+		}
+	}
+	return role, source
+}
+
+func recordPermission(d PermissionDecision) {
+	verdict := "allowed"
+	if !d.allowed {
+		verdict = "denied"
+	}
+	fmt.Printf("[AUDIT] %v @%v %v (role %v, needs %v)\n", verdict, d.user, d.action, role_names[d.role], role_names[d.required])
+	role_mutex.Lock()
+	defer role_mutex.Unlock()
+	permission_log = append(permission_log, d)
+	if len(permission_log) > permission_log_size {
+		permission_log = permission_log[len(permission_log)-permission_log_size:]
+	}
+}
+
+// authorize checks that the user holds at least the required role for action,
+// recording the decision either way.
+func authorize(user_id, user, action string, required int) bool {
+	role, _ := roleFor(user_id, user)
+	allowed := role >= required
+	recordPermission(PermissionDecision{time: time.Now(), user: user, action: action, role: role, required: required, allowed: allowed})
+	return allowed
+}
+
+func permissionDenied(action string, required int) string {
+	return fmt.Sprintf("Sorry, `%v` needs the *%v* role. Run `/prod whoami` to see yours, or ask a prod admin.", action, role_names[required])
+}
+
+func isProdAdmin(user_id, user string) bool {
+	role, _ := roleFor(user_id, user)
+	return role >= role_admin
+}
+
+// canStopExecution reports whether user may stop exec, and if so whether it
+// counts as a forced stop (i.e. someone other than the run user is doing it).
+// The run user, the job's owner and backup owner can always stop it; otherwise
+// it takes an admin.
+func canStopExecution(exec JobExecution, user_id, user string) (allowed bool, forced bool) {
+	if exec.run_user == user {
+		return true, false
+	}
+	job := getProdJob(exec.job_id)
+	if job.owner == user || job.backup_owner == user {
+		return true, true
+	}
+	return isProdAdmin(user_id, user), true
+}
+
+// canChangeJob reports whether user may edit or transfer job: its owner and
+// backup owner can, anyone else needs to be an admin.
+func canChangeJob(job ProdJob, user_id, user string) bool {
+	if job.owner == user || job.backup_owner == user {
+		return true
+	}
+	return isProdAdmin(user_id, user)
+}
+
+func whoami(user_id, user string) string {
+	role, source := roleFor(user_id, user)
+	return fmt.Sprintf("You are @%v with the *%v* role (from %v).", user, role_names[role], source)
+}
+
+func grantRole(user, name string) string {
+	role, ok := parseRole(name)
+	if !ok {
+		return fmt.Sprintf("`%v` isn't a role. Roles are %v", name, strings.Join(role_names, ", "))
+	}
+	if role_config == nil {
+		return fmt.Sprintf("Roles aren't configured; create `%v` first", roles_config_file)
+	}
+	user = strings.TrimPrefix(user, "@")
+	role_mutex.Lock()
+	role_config.Users[user] = role_names[role]
+	err := saveRoles()
+	role_mutex.Unlock()
+	if err != nil {
+		fmt.Printf("[ERROR] Unable to save %v: %v\n", roles_config_file, err)
+		return fmt.Sprintf("Granted @%v the %v role, but couldn't save it; it'll be lost on restart", user, role_names[role])
+	}
+	return fmt.Sprintf("Granted @%v the %v role", user, role_names[role])
+}
+
+func revokeRole(user string) string {
+	if role_config == nil {
+		return fmt.Sprintf("Roles aren't configured; create `%v` first", roles_config_file)
+	}
+	user = strings.TrimPrefix(user, "@")
+	role_mutex.Lock()
+	_, ok := role_config.Users[user]
+	delete(role_config.Users, user)
+	err := saveRoles()
+	role_mutex.Unlock()
+	if !ok {
+		return fmt.Sprintf("@%v has no role of their own to revoke (they may still get one from a group or the default)", user)
+	}
+	if err != nil {
+		fmt.Printf("[ERROR] Unable to save %v: %v\n", roles_config_file, err)
+		return fmt.Sprintf("Revoked @%v's role, but couldn't save it; it'll come back on restart", user)
+	}
+	return fmt.Sprintf("Revoked @%v's role", user)
+}
+
+// listPermissionDecisions returns the last n decisions, newest first.
+func listPermissionDecisions(n int) string {
+	role_mutex.Lock()
+	defer role_mutex.Unlock()
+	msg := ""
+	for i := len(permission_log) - 1; i >= 0 && n > 0; i, n = i-1, n-1 {
+		d := permission_log[i]
+		verdict := "allowed"
+		if !d.allowed {
+			verdict = "*denied*"
+		}
+		msg += fmt.Sprintf("%v %v @%v `%v` (%v, needs %v)\n", d.time.Format(time.RFC822), verdict, d.user, d.action, role_names[d.role], role_names[d.required])
+	}
+	if msg == "" {
+		msg = "No permission decisions recorded yet"
+	}
+	return msg
+}
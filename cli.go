@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Subcommands for operators, so jobs and executions can be looked at without
+// going through Slack. Running pharbot with no arguments starts the bot, same
+// as `pharbot serve`. jobs and exec read the spreadsheet unless given --db, in
+// which case they read a database made by `pharbot migrate`.
+
+const cli_usage = `Usage: pharbot [command]
+
+Commands:
+  serve                                   run the bot (the default)
+  jobs list [--all] [--json] [--db file]  list prod jobs; --all includes archived ones
+  exec show <exec id> [--json] [--db file]
+                                          show an execution and the job it ran
+  migrate [--dry-run] [--db file]         import the spreadsheet into the local database
+  check-config                            check config files, credentials and connections
+`
+
+func runCLI(args []string) int {
+	command := args[0]
+	if len(args) > 1 {
+		command += " " + args[1]
+	}
+	switch {
+	case args[0] == "serve" && len(args) == 1:
+		serve()
+		return 0
+	case command == "jobs list":
+		return runJobsList(args[2:])
+	case command == "exec show":
+		return runExecShow(args[2:])
+	case args[0] == "migrate":
+		return runMigrate(args[1:])
+	case args[0] == "check-config" && len(args) == 1:
+		return runCheckConfig()
+	case args[0] == "help" || args[0] == "-h" || args[0] == "--help":
+		fmt.Print(cli_usage)
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command '%v'\n\n%v", strings.Join(args, " "), cli_usage)
+	return 2
+}
+
+// loadCLIState fills prod_jobs, execution_log and execution_artifacts from
+// the spreadsheet, or from the database at db.
+func loadCLIState(db string) error {
+	LoadRedaction()
+	if db == "" {
+		LoadSheets()
+		return nil
+	}
+	store, err := openStore(db, true)
+	if err != nil {
+		return fmt.Errorf("unable to open %v: %v", db, err)
+	}
+	defer store.Close()
+	if prod_jobs, err = store.Jobs(); err != nil {
+		return err
+	}
+	execution_log, execution_artifacts, err = store.Executions()
+	return err
+}
+
+func runJobsList(args []string) int {
+	flags := flag.NewFlagSet("jobs list", flag.ContinueOnError)
+	all := flags.Bool("all", false, "include archived jobs")
+	as_json := flags.Bool("json", false, "print JSON")
+	db := flags.String("db", "", "read this database instead of the spreadsheet")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		return 2
+	}
+	if err := loadCLIState(*db); err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+		return 1
+	}
+
+	last_run := make(map[int]time.Time)
+	for _, exec := range execution_log {
+		if exec.start_time.After(last_run[exec.job_id]) {
+			last_run[exec.job_id] = exec.start_time
+		}
+	}
+	jobs := []ProdJob{}
+	for _, job := range prod_jobs {
+		if *all || !job.archived {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].job_id < jobs[j].job_id })
+
+	if *as_json {
+		b, _ := json.MarshalIndent(jobs, "", "  ")
+		fmt.Println(string(b))
+		return 0
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tOWNER\tBACKUP\tLAST RUN\tARCHIVED\tSUMMARY")
+	for _, job := range jobs {
+		last := "never"
+		if t, ok := last_run[job.job_id]; ok && !t.IsZero() {
+			last = t.Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", job.job_id, job.owner, job.backup_owner, last, formatBool(job.archived), job.summary)
+	}
+	w.Flush()
+	return 0
+}
+
+func runExecShow(args []string) int {
+	flags := flag.NewFlagSet("exec show", flag.ContinueOnError)
+	as_json := flags.Bool("json", false, "print JSON")
+	db := flags.String("db", "", "read this database instead of the spreadsheet")
+	// the exec ID can come before or after the flags
+	id_arg := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		id_arg, args = args[0], args[1:]
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if id_arg == "" && flags.NArg() == 1 {
+		id_arg = flags.Arg(0)
+	} else if id_arg == "" || flags.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Usage: pharbot exec show <exec id> [--json] [--db file]\n")
+		return 2
+	}
+	exec_id, err := strconv.Atoi(id_arg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't parse '%v' as an execution ID\n", id_arg)
+		return 2
+	}
+	if err := loadCLIState(*db); err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+		return 1
+	}
+	exec, ok := findExecution(exec_id)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "There's no execution %v\n", exec_id)
+		return 1
+	}
+
+	if *as_json {
+		writeExport(os.Stdout, []JobExecution{exec}, "json")
+		return 0
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for i, v := range exportRecord(exec) {
+		fmt.Fprintf(w, "%v:\t%v\n", export_columns[i], v)
+	}
+	w.Flush()
+	return 0
+}
+
+type configCheck struct {
+	name	string
+	// "ok", "warn" or "FAIL"
+	status	string
+	detail	string
+}
+
+// checkConfigFile parses an optional JSON config file with validate.
+func checkConfigFile(file, missing string, validate func(b []byte) error) configCheck {
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return configCheck{file, "ok", "not present; " + missing}
+	}
+	if err == nil {
+		err = validate(b)
+	}
+	if err != nil {
+		return configCheck{file, "FAIL", err.Error()}
+	}
+	return configCheck{file, "ok", ""}
+}
+
+func validateRoles(b []byte) error {
+	config := RoleConfig{}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return err
+	}
+	if _, ok := parseRole(config.Default); config.Default != "" && !ok {
+		return fmt.Errorf("unknown default role '%v'", config.Default)
+	}
+	for _, assigned := range []map[string]string{config.Users, config.Groups} {
+		for who, role := range assigned {
+			if _, ok := parseRole(role); !ok {
+				return fmt.Errorf("unknown role '%v' for %v", role, who)
+			}
+		}
+	}
+	return nil
+}
+
+func validatePolicies(b []byte) error {
+	config := struct {
+		Default	*JobPolicy		`json:"default"`
+		Jobs	map[string]JobPolicy	`json:"jobs"`
+	}{}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return err
+	}
+	policies := []JobPolicy{}
+	if config.Default != nil {
+		policies = append(policies, *config.Default)
+	}
+	for k, policy := range config.Jobs {
+		if _, err := strconv.Atoi(k); err != nil {
+			return fmt.Errorf("'%v' isn't a job ID", k)
+		}
+		policies = append(policies, policy)
+	}
+	for _, policy := range policies {
+		for _, pattern := range policy.Hosts {
+			var err error
+			if strings.HasPrefix(pattern, "re:") {
+				_, err = regexp.Compile(pattern[len("re:"):])
+			} else {
+				_, err = path.Match(pattern, "")
+			}
+			if err != nil {
+				return fmt.Errorf("bad host pattern '%v': %v", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+func validateRedaction(b []byte) error {
+	config := struct {
+		Patterns []string `json:"patterns"`
+	}{}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return err
+	}
+	for _, pattern := range config.Patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("bad pattern '%v': %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+func validateWebhooks(b []byte) error {
+	config := struct {
+		Endpoints []WebhookEndpoint `json:"endpoints"`
+	}{}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return err
+	}
+	for _, e := range config.Endpoints {
+		if !strings.HasPrefix(e.URL, "http://") && !strings.HasPrefix(e.URL, "https://") {
+			return fmt.Errorf("'%v' isn't an http(s) URL", e.URL)
+		}
+	}
+	return nil
+}
+
+func validateSchedules(b []byte) error {
+	saved := []scheduleJSON{}
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return err
+	}
+	for _, v := range saved {
+		if _, err := parseCron(v.Cron); err != nil {
+			return fmt.Errorf("schedule %v: %v", v.ID, err)
+		}
+	}
+	return nil
+}
+
+func checkEnvironment() []configCheck {
+	checks := []configCheck{}
+	if os.Getenv("SLACK_TOKEN") == "" {
+		checks = append(checks, configCheck{"Slack", "FAIL", "SLACK_TOKEN isn't set"})
+	} else if resp, err := api.AuthTest(); err != nil {
+		checks = append(checks, configCheck{"Slack", "FAIL", err.Error()})
+	} else {
+		checks = append(checks, configCheck{"Slack", "ok", fmt.Sprintf("signed in as %v to %v", resp.User, resp.Team)})
+	}
+	if slack_signing_secret == "" {
+		checks = append(checks, configCheck{"SLACK_SIGNING_SECRET", "warn", "not set; file uploads to threads and DMs won't be picked up"})
+	}
+	if len(api_tokens) == 0 {
+		checks = append(checks, configCheck{"PHARBOT_API_TOKENS", "warn", "not set; the API refuses every request"})
+	}
+
+	if _, err := openSheets(); err != nil {
+		checks = append(checks, configCheck{"Google Sheets", "FAIL", err.Error()})
+	} else {
+		checks = append(checks, configCheck{"Google Sheets", "ok", ""})
+	}
+
+	if os.Getenv("PHARBOT_RUNNER") == "ssh" {
+		if _, err := newSSHRunner(os.Getenv("PHARBOT_SSH_USER"), os.Getenv("PHARBOT_SSH_KEY"), os.Getenv("PHARBOT_SSH_KNOWN_HOSTS"), os.Getenv("PHARBOT_SSH_PORT")); err != nil {
+			checks = append(checks, configCheck{"SSH runner", "FAIL", err.Error()})
+		} else {
+			checks = append(checks, configCheck{"SSH runner", "ok", ""})
+		}
+	}
+	switch store := os.Getenv("PHARBOT_ARTIFACT_STORE"); store {
+	case "", "local":
+		// the default store; without a URL it's simply off
+		if _, err := artifactBaseURL(); err != nil {
+			checks = append(checks, configCheck{"Artifact store", "warn", err.Error() + "; artifacts disabled"})
+		}
+	case "http":
+		if _, err := artifactBaseURL(); err != nil {
+			checks = append(checks, configCheck{"Artifact store", "FAIL", err.Error()})
+		}
+	default:
+		checks = append(checks, configCheck{"Artifact store", "FAIL", fmt.Sprintf("unknown PHARBOT_ARTIFACT_STORE '%v'", store)})
+	}
+
+	entries, _, problems, err := checkJournal()
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	if len(problems) > 0 {
+		checks = append(checks, configCheck{audit_journal_file, "FAIL", strings.Join(problems, "; ")})
+	} else {
+		checks = append(checks, configCheck{audit_journal_file, "ok", fmt.Sprintf("%v entries", len(entries))})
+	}
+	if _, err := os.Stat(storePath()); err == nil {
+		if store, err := openStore(storePath(), true); err != nil {
+			checks = append(checks, configCheck{storePath(), "FAIL", err.Error()})
+		} else {
+			store.Close()
+			checks = append(checks, configCheck{storePath(), "ok", ""})
+		}
+	}
+	return checks
+}
+
+// runCheckConfig checks everything the bot needs to start, without starting
+// it. It exits non-zero if anything would stop the bot working.
+func runCheckConfig() int {
+	checks := []configCheck{
+		checkConfigFile(roles_config_file, "every user is a runner, and only PHARBOT_PROD_ADMINS and PHARBOT_PROD_ADMIN_GROUP are admins", validateRoles),
+		checkConfigFile(policy_config_file, "executions aren't policy checked", validatePolicies),
+		checkConfigFile(redaction_config_file, "only the built in redaction patterns are used", validateRedaction),
+		checkConfigFile(webhook_config_file, "webhooks are disabled", validateWebhooks),
+		checkConfigFile(schedules_file, "nothing is scheduled", validateSchedules),
+	}
+	checks = append(checks, checkEnvironment()...)
+
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, c := range checks {
+		fmt.Fprintf(w, "%v\t%v\t%v\n", c.status, c.name, c.detail)
+		if c.status == "FAIL" {
+			failed++
+		}
+	}
+	w.Flush()
+	if failed > 0 {
+		fmt.Printf("\n%v checks failed\n", failed)
+		return 1
+	}
+	return 0
+}
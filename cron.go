@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A minimal five field cron expression: minute hour day-of-month month
+// day-of-week. Each field takes *, numbers, ranges (1-5), lists (1,3,5) and
+// steps (*/15, 0-30/10). Like classic cron, when both day fields are
+// restricted a time matches if either of them does; a field starting with *
+// (including */2) doesn't count as restricted, so it has to match as well.
+
+type CronSchedule struct {
+	minutes		[]bool
+	hours		[]bool
+	days		[]bool
+	months		[]bool
+	weekdays	[]bool
+	any_day		bool
+	any_weekday	bool
+}
+
+func parseCronField(field string, min, max int) ([]bool, bool, error) {
+	allowed := make([]bool, max+1)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return nil, false, fmt.Errorf("bad step in '%v'", part)
+			}
+			step = n
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			n, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, false, fmt.Errorf("bad value '%v'", part)
+			}
+			lo, hi = n, n
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, false, fmt.Errorf("bad range '%v'", part)
+				}
+			} else if step > 1 {
+				// 5/15 means 5, 20, 35, ...
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, false, fmt.Errorf("'%v' is outside %v-%v", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			allowed[v] = true
+		}
+	}
+	return allowed, strings.HasPrefix(field, "*"), nil
+}
+
+func parseCron(expr string) (*CronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields (minute hour day month weekday), got %v", len(fields))
+	}
+	c := &CronSchedule{}
+	var err error
+	if c.minutes, _, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("minute: %v", err)
+	}
+	if c.hours, _, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("hour: %v", err)
+	}
+	if c.days, c.any_day, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("day of month: %v", err)
+	}
+	if c.months, _, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("month: %v", err)
+	}
+	// 0 and 7 are both Sunday
+	if c.weekdays, c.any_weekday, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("day of week: %v", err)
+	}
+	if c.weekdays[7] {
+		c.weekdays[0] = true
+	}
+	return c, nil
+}
+
+func (c *CronSchedule) Matches(t time.Time) bool {
+	if !c.minutes[t.Minute()] || !c.hours[t.Hour()] || !c.months[int(t.Month())] {
+		return false
+	}
+	day := c.days[t.Day()]
+	weekday := c.weekdays[int(t.Weekday())]
+	if c.any_day || c.any_weekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+// Next returns the first matching minute after t, or the zero time if there
+// isn't one within a few years (e.g. Feb 30).
+func (c *CronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if !c.months[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.Matches(time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, t.Location())) {
+			if !c.hours[t.Hour()] {
+				// the top of the next hour in t's zone; t.Truncate(time.Hour)
+				// rounds in UTC, which is half past in some zones
+				t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			} else {
+				t = t.Add(time.Minute)
+			}
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr	string
+		ok	bool
+	}{
+		{"* * * * *", true},
+		{"0 9 * * 1", true},
+		{"*/15 0-6 1,15 * 1-5", true},
+		{"5/20 * * * *", true},
+		{"0 0 * * 7", true},
+		{"0 9 * *", false},
+		{"0 9 * * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * * 13 *", false},
+		{"* * * * 8", false},
+		{"*/0 * * * *", false},
+		{"5-1 * * * *", false},
+		{"a * * * *", false},
+	}
+	for _, test := range tests {
+		_, err := parseCron(test.expr)
+		if (err == nil) != test.ok {
+			t.Errorf("parseCron(%q) error = %v, want ok %v", test.expr, err, test.ok)
+		}
+	}
+}
+
+func TestCronMatches(t *testing.T) {
+	// 2024-03-04 is a Monday
+	monday_9am := time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		expr	string
+		t	time.Time
+		want	bool
+	}{
+		{"0 9 * * 1", monday_9am, true},
+		{"0 9 * * 2", monday_9am, false},
+		{"0 9 * * 1", monday_9am.Add(time.Minute), false},
+		{"*/15 * * * *", monday_9am.Add(45 * time.Minute), true},
+		{"*/15 * * * *", monday_9am.Add(46 * time.Minute), false},
+		{"5/20 * * * *", monday_9am.Add(25 * time.Minute), true},
+		// Sunday as 7
+		{"0 9 * * 7", monday_9am.AddDate(0, 0, 6), true},
+		// both day fields restricted: either matches
+		{"0 9 15 * 1", monday_9am, true},
+		{"0 9 4 * 5", monday_9am, true},
+		{"0 9 15 * 5", monday_9am, false},
+		// only one restricted: it has to match
+		{"0 9 15 * *", monday_9am, false},
+		{"0 9 * 3 *", monday_9am, true},
+		{"0 9 * 4 *", monday_9am, false},
+		// a step from * isn't a restriction, so both fields have to match
+		{"0 0 */2 * 1", time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC), false},
+		{"0 0 */2 * 1", time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC), false},
+		{"0 0 */2 * 1", time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC), true},
+		{"0 0 */2 * *", time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC), false},
+		{"0 0 */2 * *", time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC), true},
+		{"0 0 1 * */2", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), false},
+		{"0 0 1 * */2", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), true},
+	}
+	for _, test := range tests {
+		c, err := parseCron(test.expr)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", test.expr, err)
+		}
+		if got := c.Matches(test.t); got != test.want {
+			t.Errorf("%q Matches(%v) = %v, want %v", test.expr, test.t, got, test.want)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	india := time.FixedZone("IST", 5*60*60+30*60)
+	nepal := time.FixedZone("NPT", 5*60*60+45*60)
+	tests := []struct {
+		expr	string
+		after	time.Time
+		want	time.Time
+	}{
+		{"0 9 * * 1", time.Date(2024, 3, 4, 8, 59, 30, 0, time.UTC), time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC)},
+		// strictly after
+		{"0 9 * * 1", time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC), time.Date(2024, 3, 11, 9, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 3, 4, 9, 1, 0, 0, time.UTC), time.Date(2024, 3, 4, 9, 15, 0, 0, time.UTC)},
+		{"30 2 1 * *", time.Date(2024, 1, 31, 23, 0, 0, 0, time.UTC), time.Date(2024, 2, 1, 2, 30, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Mondays on odd days
+		{"0 0 */2 * 1", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC)},
+		// the hour jumps have to land on the zone's own hours
+		{"0 9 * * *", time.Date(2024, 3, 4, 7, 10, 0, 0, india), time.Date(2024, 3, 4, 9, 0, 0, 0, india)},
+		{"5 * * * *", time.Date(2024, 3, 4, 7, 10, 0, 0, india), time.Date(2024, 3, 4, 8, 5, 0, 0, india)},
+		{"0 9 * * *", time.Date(2024, 3, 4, 7, 10, 0, 0, nepal), time.Date(2024, 3, 4, 9, 0, 0, 0, nepal)},
+		// never
+		{"0 0 30 2 *", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Time{}},
+	}
+	for _, test := range tests {
+		c, err := parseCron(test.expr)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", test.expr, err)
+		}
+		if got := c.Next(test.after); !got.Equal(test.want) {
+			t.Errorf("%q Next(%v) = %v, want %v", test.expr, test.after, got, test.want)
+		}
+	}
+}
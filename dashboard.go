@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Server-rendered dashboard. Uses the same tokens as the JSON API; visit
+// /dashboard?token=<token> once and it's remembered in a cookie, which also
+// lets artifact links open.
+
+const (
+	dashboard_cookie	= "pharbot_token"
+	dashboard_history_size	= 50
+)
+
+type dashboardExecution struct {
+	Exec	JobExecution
+	Job	ProdJob
+}
+
+func (d dashboardExecution) ExecID() int	{ return d.Exec.exec_id }
+func (d dashboardExecution) JobID() int		{ return d.Exec.job_id }
+func (d dashboardExecution) RunUser() string	{ return d.Exec.run_user }
+func (d dashboardExecution) Host() string	{ return d.Exec.host }
+func (d dashboardExecution) Command() string	{ return redactCommand(d.Exec.command) }
+func (d dashboardExecution) Writes() bool	{ return d.Exec.writes }
+func (d dashboardExecution) PrimaryRead() bool	{ return d.Exec.primary_read }
+func (d dashboardExecution) Summary() string	{ return d.Job.summary }
+
+func (d dashboardExecution) Started() string {
+	if d.Exec.start_time.IsZero() {
+		return "pending"
+	}
+	return d.Exec.start_time.Format("2006-01-02 15:04")
+}
+
+func (d dashboardExecution) Elapsed() string {
+	if d.Exec.start_time.IsZero() {
+		return "-"
+	}
+	end := d.Exec.end_time
+	if end.IsZero() {
+		end = time.Now()
+	}
+	return formatElapsed(end.Sub(d.Exec.start_time))
+}
+
+type dashboardJob struct {
+	Job	ProdJob
+}
+
+func (d dashboardJob) ID() int			{ return d.Job.job_id }
+func (d dashboardJob) Summary() string		{ return d.Job.summary }
+func (d dashboardJob) Owner() string		{ return d.Job.owner }
+func (d dashboardJob) BackupOwner() string	{ return d.Job.backup_owner }
+func (d dashboardJob) LeadApprover() string	{ return d.Job.lead_approver }
+func (d dashboardJob) PhabTask() string		{ return d.Job.phab_task }
+func (d dashboardJob) DiffURI() string		{ return d.Job.diff_uri }
+
+var dashboard_template = template.Must(template.New("dashboard").Parse(`
+{{define "execs"}}
+<table>
+<tr><th>Exec</th><th>Job</th><th>User</th><th>Host</th><th>Command</th><th>Writes</th><th>Primary Read</th><th>Started</th><th>Elapsed</th></tr>
+{{range .}}
+<tr>
+<td>{{.ExecID}}</td>
+<td><a href="/dashboard/jobs/{{.JobID}}">{{.JobID}}</a> {{.Summary}}</td>
+<td><a href="/dashboard/users/{{.RunUser}}">@{{.RunUser}}</a></td>
+<td><code>{{.Host}}</code></td>
+<td><code>{{.Command}}</code></td>
+<td>{{.Writes}}</td>
+<td>{{.PrimaryRead}}</td>
+<td>{{.Started}}</td>
+<td>{{.Elapsed}}</td>
+</tr>
+{{else}}
+<tr><td colspan="9">Nothing here</td></tr>
+{{end}}
+</table>
+{{end}}
+
+{{define "jobs"}}
+<table>
+<tr><th>ID</th><th>Summary</th><th>Owner</th><th>Backup Owner</th><th>Lead Approver</th></tr>
+{{range .}}
+<tr>
+<td><a href="/dashboard/jobs/{{.ID}}">{{.ID}}</a></td>
+<td>{{.Summary}}</td>
+<td><a href="/dashboard/users/{{.Owner}}">@{{.Owner}}</a></td>
+<td><a href="/dashboard/users/{{.BackupOwner}}">@{{.BackupOwner}}</a></td>
+<td><a href="/dashboard/users/{{.LeadApprover}}">@{{.LeadApprover}}</a></td>
+</tr>
+{{else}}
+<tr><td colspan="5">Nothing here</td></tr>
+{{end}}
+</table>
+{{end}}
+
+<!DOCTYPE html>
+<html>
+<head>
+<title>pharbot - {{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+th { background: #eee; }
+</style>
+</head>
+<body>
+<p><a href="/dashboard">pharbot</a></p>
+<h1>{{.Title}}</h1>
+{{if .Job}}
+<table>
+<tr><th>Summary</th><td>{{.Job.Summary}}</td></tr>
+<tr><th>Owner</th><td><a href="/dashboard/users/{{.Job.Owner}}">@{{.Job.Owner}}</a></td></tr>
+<tr><th>Backup Owner</th><td><a href="/dashboard/users/{{.Job.BackupOwner}}">@{{.Job.BackupOwner}}</a></td></tr>
+<tr><th>Lead Approver</th><td><a href="/dashboard/users/{{.Job.LeadApprover}}">@{{.Job.LeadApprover}}</a></td></tr>
+<tr><th>Phab Task</th><td><a href="{{.Job.PhabTask}}">{{.Job.PhabTask}}</a></td></tr>
+<tr><th>Diff</th><td><a href="{{.Job.DiffURI}}">{{.Job.DiffURI}}</a></td></tr>
+</table>
+{{end}}
+{{if .Jobs}}
+<h2>Jobs</h2>
+{{template "jobs" .Jobs}}
+{{end}}
+<h2>Active executions</h2>
+{{template "execs" .Active}}
+<h2>History</h2>
+{{template "execs" .History}}
+</body>
+</html>
+`))
+
+type dashboardPage struct {
+	Title	string
+	Job	*dashboardJob
+	Jobs	[]dashboardJob
+	Active	[]dashboardExecution
+	History	[]dashboardExecution
+}
+
+func formatElapsed(d time.Duration) string {
+	d = d.Round(time.Second)
+	if d >= time.Hour {
+		return fmt.Sprintf("%vh%02vm", int(d.Hours()), int(d.Minutes())%60)
+	}
+	if d >= time.Minute {
+		return fmt.Sprintf("%vm%02vs", int(d.Minutes()), int(d.Seconds())%60)
+	}
+	return fmt.Sprintf("%vs", int(d.Seconds()))
+}
+
+// dashboardExecutions splits the executions matching keep into active and
+// (up to dashboard_history_size) finished ones, newest first. It must be called
+// with state_mutex held.
+func dashboardExecutions(keep func(JobExecution) bool) ([]dashboardExecution, []dashboardExecution) {
+	active := []dashboardExecution{}
+	history := []dashboardExecution{}
+	for _, exec := range allExecutions() {
+		if !keep(exec) {
+			continue
+		}
+		d := dashboardExecution{Exec: exec, Job: getProdJob(exec.job_id)}
+		if isActiveExecution(exec) {
+			active = append(active, d)
+		} else if len(history) < dashboard_history_size {
+			history = append(history, d)
+		}
+	}
+	return active, history
+}
+
+func withDashboardAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token := r.URL.Query().Get("token"); token != "" && validAPIToken(token) {
+			http.SetCookie(w, &http.Cookie{Name: dashboard_cookie, Value: token, Path: "/", HttpOnly: true})
+			handler(w, r)
+			return
+		}
+		if cookie, err := r.Cookie(dashboard_cookie); err == nil && validAPIToken(cookie.Value) {
+			handler(w, r)
+			return
+		}
+		http.Error(w, "Unauthorized. Visit /dashboard?token=<api token> to log in.", http.StatusUnauthorized)
+	}
+}
+
+func renderDashboard(w http.ResponseWriter, page dashboardPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboard_template.Execute(w, page); err != nil {
+		fmt.Printf("[ERROR] Unable to render dashboard: %v\n", err)
+	}
+}
+
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/dashboard" && r.URL.Path != "/dashboard/" {
+		http.NotFound(w, r)
+		return
+	}
+	state_mutex.Lock()
+	active, history := dashboardExecutions(func(JobExecution) bool { return true })
+	state_mutex.Unlock()
+	renderDashboard(w, dashboardPage{Title: "Prod executions", Active: active, History: history})
+}
+
+func handleDashboardJob(w http.ResponseWriter, r *http.Request) {
+	job_id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/dashboard/jobs/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	state_mutex.Lock()
+	job := getProdJob(job_id)
+	active, history := dashboardExecutions(func(exec JobExecution) bool { return exec.job_id == job_id })
+	state_mutex.Unlock()
+	if (job == ProdJob{}) {
+		http.NotFound(w, r)
+		return
+	}
+	renderDashboard(w, dashboardPage{Title: fmt.Sprintf("Job %v", job_id), Job: &dashboardJob{Job: job}, Active: active, History: history})
+}
+
+func handleDashboardUser(w http.ResponseWriter, r *http.Request) {
+	user := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/dashboard/users/"), "@")
+	if user == "" {
+		http.NotFound(w, r)
+		return
+	}
+	jobs := []dashboardJob{}
+	state_mutex.Lock()
+	for _, job := range prod_jobs {
+		if job.owner == user || job.backup_owner == user || job.lead_approver == user {
+			jobs = append(jobs, dashboardJob{Job: job})
+		}
+	}
+	active, history := dashboardExecutions(func(exec JobExecution) bool { return exec.run_user == user })
+	state_mutex.Unlock()
+	renderDashboard(w, dashboardPage{Title: "@" + user, Jobs: jobs, Active: active, History: history})
+}
+
+func registerDashboardHandlers() {
+	http.HandleFunc("/dashboard", withDashboardAuth(handleDashboard))
+	http.HandleFunc("/dashboard/", withDashboardAuth(handleDashboard))
+	http.HandleFunc("/dashboard/jobs/", withDashboardAuth(handleDashboardJob))
+	http.HandleFunc("/dashboard/users/", withDashboardAuth(handleDashboardUser))
+}
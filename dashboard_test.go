@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDashboardLoginCoversArtifacts(t *testing.T) {
+	defer func(tokens []string) { api_tokens = tokens }(api_tokens)
+	api_tokens = []string{"s3cret"}
+	ok := withDashboardAuth(func(w http.ResponseWriter, r *http.Request) {})
+
+	w := httptest.NewRecorder()
+	ok(w, httptest.NewRequest("GET", "/dashboard?token=s3cret", nil))
+	cookies := w.Result().Cookies()
+	if w.Code != http.StatusOK || len(cookies) != 1 {
+		t.Fatalf("logging in: %v, cookies %v", w.Code, cookies)
+	}
+
+	// the browser sends the cookie wherever its path says
+	for _, path := range []string{"/dashboard/jobs/1", "/artifacts/7/output.txt"} {
+		r := httptest.NewRequest("GET", path, nil)
+		for _, c := range cookies {
+			if strings.HasPrefix(path, c.Path) {
+				r.AddCookie(c)
+			}
+		}
+		w := httptest.NewRecorder()
+		ok(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("%v after logging in: %v", path, w.Code)
+		}
+	}
+	w = httptest.NewRecorder()
+	ok(w, httptest.NewRequest("GET", "/artifacts/7/output.txt", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("artifact without logging in: %v", w.Code)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// Audit exports of executions and the jobs they ran, for compliance. Available
+// as `/prod export executions`, which DMs the requester a file, and as
+// GET /api/export/executions?since=&until=&format= with an API token.
+// Dates are YYYY-MM-DD (until is inclusive) or RFC 3339 times.
+
+var export_columns = []string{"exec_id", "job_id", "job_summary", "job_owner", "job_backup_owner", "job_lead_approver", "job_phab_task", "job_diff_uri",
+	"start_time", "end_time", "run_user", "one_off", "writes", "primary_read", "host", "command", "params", "stopped_by", "stop_reason",
+	"policy_override", "runner_state", "exit_code", "duration_seconds", "artifacts"}
+
+type exportOptions struct {
+	since	time.Time
+	until	time.Time
+	format	string
+}
+
+func parseExportTime(s string, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return t, fmt.Errorf("couldn't parse '%v' as a date; use YYYY-MM-DD", s)
+	}
+	if end {
+		// a date as the end of the range means the whole of that day
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+func parseExportOptions(since, until, format string) (exportOptions, error) {
+	opts := exportOptions{format: strings.ToLower(format)}
+	if opts.format == "" {
+		opts.format = "csv"
+	}
+	if opts.format != "csv" && opts.format != "json" {
+		return opts, fmt.Errorf("format must be csv or json, not '%v'", format)
+	}
+	var err error
+	if since != "" {
+		if opts.since, err = parseExportTime(since, false); err != nil {
+			return opts, err
+		}
+	}
+	if until != "" {
+		if opts.until, err = parseExportTime(until, true); err != nil {
+			return opts, err
+		}
+	}
+	if !opts.since.IsZero() && !opts.until.IsZero() && !opts.until.After(opts.since) {
+		return opts, fmt.Errorf("--until has to be after --since")
+	}
+	return opts, nil
+}
+
+// exportedExecutions returns started executions within the range, oldest first.
+func exportedExecutions(opts exportOptions) []JobExecution {
+	execs := []JobExecution{}
+	for _, exec := range execution_log {
+		if exec.start_time.IsZero() && (!opts.since.IsZero() || !opts.until.IsZero()) {
+			continue
+		}
+		if !opts.since.IsZero() && exec.start_time.Before(opts.since) {
+			continue
+		}
+		if !opts.until.IsZero() && !exec.start_time.Before(opts.until) {
+			continue
+		}
+		execs = append(execs, exec)
+	}
+	return execs
+}
+
+func exportRecord(exec JobExecution) []string {
+	job := getProdJob(exec.job_id)
+	format_time := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+	exit_code, duration := "", ""
+	if exec.runner_state != "" {
+		exit_code, duration = strconv.Itoa(exec.exit_code), strconv.FormatFloat(exec.duration.Seconds(), 'f', 0, 64)
+	}
+	artifacts := []string{}
+	for _, a := range execution_artifacts[exec.exec_id] {
+		artifacts = append(artifacts, a.url)
+	}
+	return []string{strconv.Itoa(exec.exec_id), strconv.Itoa(exec.job_id), job.summary, job.owner, job.backup_owner, job.lead_approver, job.phab_task, job.diff_uri,
+		format_time(exec.start_time), format_time(exec.end_time), exec.run_user, formatBool(exec.one_off), formatBool(exec.writes), formatBool(exec.primary_read),
+		exec.host, redactCommand(exec.command), redactCommand(exec.params), exec.stopped_by, exec.stop_reason, exec.policy_override, exec.runner_state,
+		exit_code, duration, strings.Join(artifacts, " ")}
+}
+
+func writeExport(w io.Writer, execs []JobExecution, format string) error {
+	if format == "json" {
+		records := []map[string]string{}
+		for _, exec := range execs {
+			record := make(map[string]string)
+			for i, v := range exportRecord(exec) {
+				record[export_columns[i]] = v
+			}
+			records = append(records, record)
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(records)
+	}
+	cw := csv.NewWriter(w)
+	cw.Write(export_columns)
+	for _, exec := range execs {
+		cw.Write(exportRecord(exec))
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func exportFilename(opts exportOptions) string {
+	name := "executions"
+	if !opts.since.IsZero() {
+		name += "-from-" + opts.since.Format("2006-01-02")
+	}
+	if !opts.until.IsZero() {
+		// until is exclusive
+		name += "-until-" + opts.until.Add(-time.Nanosecond).Format("2006-01-02")
+	}
+	return name + "." + opts.format
+}
+
+// /prod export executions [--since <date>] [--until <date>] [--format csv|json]
+func handleProdExport(s slack.SlashCommand, words []string) {
+	if len(words) < 2 || words[1] != "executions" {
+		rejectSlash(s, "invalid", helptexts["export"])
+		return
+	}
+	flags := map[string]string{}
+	for i := 2; i < len(words); i += 2 {
+		if i+1 >= len(words) || (words[i] != "--since" && words[i] != "--until" && words[i] != "--format") {
+			rejectSlash(s, "invalid", helptexts["export"])
+			return
+		}
+		flags[words[i]] = words[i+1]
+	}
+	opts, err := parseExportOptions(flags["--since"], flags["--until"], flags["--format"])
+	if err != nil {
+		rejectSlash(s, "invalid", fmt.Sprintf("Can't export that: %v", err))
+		return
+	}
+	execs := exportedExecutions(opts)
+	var buf bytes.Buffer
+	if err := writeExport(&buf, execs, opts.format); err != nil {
+		rejectSlash(s, "failed", fmt.Sprintf("Couldn't generate the export: %v", err))
+		return
+	}
+	_, _, channel, err := api.OpenIMChannel(s.UserID)
+	if err == nil {
+		_, err = api.UploadFile(slack.FileUploadParameters{Content: buf.String(), Filetype: opts.format, Filename: exportFilename(opts), Title: fmt.Sprintf("Execution audit export (%v executions)", len(execs)), Channels: []string{channel}})
+	}
+	if err != nil {
+		fmt.Printf("[ERROR] Unable to upload export for @%v: %v\n", s.UserName, err)
+		rejectSlash(s, "failed", fmt.Sprintf("Couldn't send you the export: %v", err))
+		return
+	}
+	fmt.Printf("[AUDIT] @%v exported %v executions (%v)\n", s.UserName, len(execs), exportFilename(opts))
+	replyToSlash(s, fmt.Sprintf("Exported %v executions; I've sent you the file in a DM.", len(execs)))
+}
+
+func handleAPIExport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	opts, err := parseExportOptions(q.Get("since"), q.Get("until"), q.Get("format"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	// write it out under the lock, then send it, so a slow client doesn't hold it
+	var buf bytes.Buffer
+	state_mutex.Lock()
+	execs := exportedExecutions(opts)
+	err = writeExport(&buf, execs, opts.format)
+	state_mutex.Unlock()
+	if err != nil {
+		fmt.Printf("[ERROR] Unable to write export: %v\n", err)
+		writeAPIError(w, http.StatusInternalServerError, "couldn't generate the export")
+		return
+	}
+	if opts.format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "text/csv")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFilename(opts)))
+	fmt.Printf("[AUDIT] API export of %v executions (%v)\n", len(execs), exportFilename(opts))
+	w.Write(buf.Bytes())
+}
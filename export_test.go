@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseExportOptions(t *testing.T) {
+	day := func(year int, month time.Month, d int) time.Time {
+		return time.Date(year, month, d, 0, 0, 0, 0, time.Local)
+	}
+	tests := []struct {
+		since, until, format	string
+		want			exportOptions
+		ok			bool
+	}{
+		{"", "", "", exportOptions{format: "csv"}, true},
+		{"", "", "JSON", exportOptions{format: "json"}, true},
+		{"", "", "xml", exportOptions{}, false},
+		// until is inclusive, so it runs to the start of the next day
+		{"2024-03-01", "2024-03-31", "", exportOptions{since: day(2024, 3, 1), until: day(2024, 4, 1), format: "csv"}, true},
+		{"2024-03-04", "2024-03-04", "", exportOptions{since: day(2024, 3, 4), until: day(2024, 3, 5), format: "csv"}, true},
+		{"2024-03-04T09:00:00Z", "2024-03-04T10:00:00Z", "csv", exportOptions{since: time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC), until: time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC), format: "csv"}, true},
+		{"", "2024-02-29", "", exportOptions{until: day(2024, 3, 1), format: "csv"}, true},
+		{"2024-03-05", "2024-03-04", "", exportOptions{}, false},
+		{"2024-03-04T10:00:00Z", "2024-03-04T10:00:00Z", "", exportOptions{}, false},
+		{"03/04/2024", "", "", exportOptions{}, false},
+		{"", "last week", "", exportOptions{}, false},
+	}
+	for _, test := range tests {
+		got, err := parseExportOptions(test.since, test.until, test.format)
+		if (err == nil) != test.ok {
+			t.Errorf("parseExportOptions(%q, %q, %q) error = %v, want ok %v", test.since, test.until, test.format, err, test.ok)
+			continue
+		}
+		if err == nil && (!got.since.Equal(test.want.since) || !got.until.Equal(test.want.until) || got.format != test.want.format) {
+			t.Errorf("parseExportOptions(%q, %q, %q) = %+v, want %+v", test.since, test.until, test.format, got, test.want)
+		}
+	}
+}
+
+func TestExportedExecutions(t *testing.T) {
+	defer func(log []JobExecution) { execution_log = log }(execution_log)
+	at := func(hour int) time.Time {
+		return time.Date(2024, 3, 4, hour, 0, 0, 0, time.UTC)
+	}
+	execution_log = []JobExecution{{exec_id: 1, start_time: at(8)}, {exec_id: 2, start_time: at(9)}, {exec_id: 3, start_time: at(10)}, {exec_id: 4}}
+	tests := []struct {
+		opts	exportOptions
+		want	[]int
+	}{
+		{exportOptions{}, []int{1, 2, 3, 4}},
+		// since is inclusive, until exclusive
+		{exportOptions{since: at(9)}, []int{2, 3}},
+		{exportOptions{until: at(10)}, []int{1, 2}},
+		{exportOptions{since: at(9), until: at(10)}, []int{2}},
+	}
+	for _, test := range tests {
+		got := []int{}
+		for _, exec := range exportedExecutions(test.opts) {
+			got = append(got, exec.exec_id)
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("exportedExecutions(%+v) = %v, want %v", test.opts, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("exportedExecutions(%+v) = %v, want %v", test.opts, got, test.want)
+				break
+			}
+		}
+	}
+}
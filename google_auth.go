@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// Google credentials for the Sheets API, tried in this order:
+//
+//	PHARBOT_GOOGLE_CREDENTIALS=<file>  a service account key (or any other credentials JSON)
+//	PHARBOT_GOOGLE_AUTH=default        application default credentials, i.e.
+//	                                   GOOGLE_APPLICATION_CREDENTIALS or workload identity
+//	client_secret.json + token.json    the original OAuth flow on someone's account
+//
+// pharbot never prompts on startup. If token.json is missing, run it once by
+// hand with PHARBOT_GOOGLE_AUTHORIZE=1 to go through the OAuth flow. Refreshed
+// OAuth tokens are written back to token.json.
+
+const (
+	sheets_scope		= "https://www.googleapis.com/auth/spreadsheets"
+	client_secret_file	= "client_secret.json"
+	token_file		= "token.json"
+)
+
+func newSheetsHTTPClient() (*http.Client, error) {
+	ctx := context.Background()
+	var src oauth2.TokenSource
+	if path := os.Getenv("PHARBOT_GOOGLE_CREDENTIALS"); path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading PHARBOT_GOOGLE_CREDENTIALS: %v", err)
+		}
+		creds, err := google.CredentialsFromJSON(ctx, b, sheets_scope)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %v: %v", path, err)
+		}
+		fmt.Printf("[INFO] Using Google credentials from %v\n", path)
+		src = creds.TokenSource
+	} else if os.Getenv("PHARBOT_GOOGLE_AUTH") == "default" {
+		creds, err := google.FindDefaultCredentials(ctx, sheets_scope)
+		if err != nil {
+			return nil, fmt.Errorf("finding default credentials: %v", err)
+		}
+		fmt.Println("[INFO] Using Google application default credentials")
+		src = creds.TokenSource
+	} else {
+		var err error
+		if src, err = oauthTokenSource(ctx); err != nil {
+			return nil, err
+		}
+	}
+	// make sure the credentials actually work before we start serving
+	if _, err := src.Token(); err != nil {
+		return nil, fmt.Errorf("getting a token: %v", err)
+	}
+	client := oauth2.NewClient(ctx, src)
+	client.Transport = instrumentTransport("sheets", client.Transport)
+	return client, nil
+}
+
+func oauthTokenSource(ctx context.Context) (oauth2.TokenSource, error) {
+	b, err := ioutil.ReadFile(client_secret_file)
+	if err != nil {
+		return nil, fmt.Errorf("no Google credentials configured: set PHARBOT_GOOGLE_CREDENTIALS to a service account key, set PHARBOT_GOOGLE_AUTH=default, or provide %v (%v)", client_secret_file, err)
+	}
+	config, err := google.ConfigFromJSON(b, sheets_scope)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %v: %v", client_secret_file, err)
+	}
+	tok, err := tokenFromFile(token_file)
+	if err != nil {
+		if os.Getenv("PHARBOT_GOOGLE_AUTHORIZE") != "1" {
+			return nil, fmt.Errorf("can't read %v (%v). Run pharbot by hand once with PHARBOT_GOOGLE_AUTHORIZE=1 to create it, or use a service account", token_file, err)
+		}
+		if tok, err = getTokenFromWeb(config); err != nil {
+			return nil, err
+		}
+		if err := saveToken(token_file, tok); err != nil {
+			return nil, fmt.Errorf("saving %v: %v", token_file, err)
+		}
+	}
+	return &persistingTokenSource{src: config.TokenSource(ctx, tok), path: token_file, last: tok.AccessToken}, nil
+}
+
+// persistingTokenSource saves tokens to disk whenever they're refreshed, so a
+// restart doesn't start from a long expired access token.
+type persistingTokenSource struct {
+	src	oauth2.TokenSource
+	path	string
+	mutex	sync.Mutex
+	last	string
+}
+
+func (p *persistingTokenSource) Token() (*oauth2.Token, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	tok, err := p.src.Token()
+	if err != nil {
+		return nil, err
+	}
+	if tok.AccessToken != p.last {
+		if err := saveToken(p.path, tok); err != nil {
+			fmt.Printf("[ERROR] Unable to save refreshed token to %v: %v\n", p.path, err)
+		} else {
+			p.last = tok.AccessToken
+		}
+	}
+	return tok, nil
+}
+
+// Request a token from the web, then returns the retrieved token.
+func getTokenFromWeb(config *oauth2.Config) (*oauth2.Token, error) {
+	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
+	fmt.Printf("Go to the following link in your browser then type the "+
+		"authorization code: \n%v\n", authURL)
+
+	var authCode string
+	if _, err := fmt.Scan(&authCode); err != nil {
+		return nil, fmt.Errorf("reading authorization code: %v", err)
+	}
+	tok, err := config.Exchange(context.Background(), authCode)
+	if err != nil {
+		return nil, fmt.Errorf("exchanging authorization code: %v", err)
+	}
+	return tok, nil
+}
+
+// Retrieves a token from a local file.
+func tokenFromFile(file string) (*oauth2.Token, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tok := &oauth2.Token{}
+	err = json.NewDecoder(f).Decode(tok)
+	return tok, err
+}
+
+// Saves a token to a file path. Written to a temporary file and renamed into
+// place so a crash mid-write can't leave a truncated token behind.
+func saveToken(path string, token *oauth2.Token) error {
+	fmt.Printf("Saving credential file to: %s\n", path)
+	b, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// Editing, archiving and transferring existing prod jobs. Every change is
+// written back over the job's row in the Run Job List and recorded in the
+// Job Edit History tab.
+
+type JobEdit struct {
+	edit_time	time.Time
+	job_id		int
+	user		string
+	field		string
+	old_value	string
+	new_value	string
+}
+
+var (
+	job_edits	[]JobEdit	= []JobEdit{}
+	// accepted names for each editable field, mapped to the canonical one
+	job_fields	map[string]string	= map[string]string{
+		"summary":	"summary",
+		"phab_task":	"phab_task",
+		"task":		"phab_task",
+		"diff_uri":	"diff_uri",
+		"diff":		"diff_uri",
+		"owner":	"owner",
+		"backup_owner":	"backup_owner",
+		"backup":	"backup_owner",
+		"lead_approver": "lead_approver",
+		"approver":	"lead_approver",
+		"template":	"template",
+	}
+)
+
+func getJobField(job ProdJob, field string) string {
+	switch field {
+	case "summary":
+		return job.summary
+	case "phab_task":
+		return job.phab_task
+	case "diff_uri":
+		return job.diff_uri
+	case "owner":
+		return job.owner
+	case "backup_owner":
+		return job.backup_owner
+	case "lead_approver":
+		return job.lead_approver
+	case "template":
+		return job.template
+	case "archived":
+		return formatBool(job.archived)
+	}
+	return ""
+}
+
+func setJobField(job *ProdJob, field, value string) {
+	switch field {
+	case "summary":
+		job.summary = value
+	case "phab_task":
+		job.phab_task = value
+	case "diff_uri":
+		job.diff_uri = value
+	case "owner":
+		job.owner = value
+	case "backup_owner":
+		job.backup_owner = value
+	case "lead_approver":
+		job.lead_approver = value
+	case "template":
+		job.template = value
+	case "archived":
+		job.archived = value == "yes"
+	}
+}
+
+// parseJobEdits turns "summary=Fix the thing owner=jdoe" into field/value
+// pairs. Values run until the next word that looks like field=..., so they
+// can contain spaces.
+func parseJobEdits(words []string) (map[string]string, []string, error) {
+	edits := make(map[string]string)
+	order := []string{}
+	field := ""
+	for _, word := range words {
+		if i := strings.Index(word, "="); i > 0 {
+			if canonical, ok := job_fields[strings.ToLower(word[:i])]; ok {
+				field = canonical
+				if _, seen := edits[field]; !seen {
+					order = append(order, field)
+				}
+				edits[field] = word[i+1:]
+				continue
+			}
+		}
+		if field == "" {
+			return nil, nil, fmt.Errorf("expected field=value, got '%v'", word)
+		}
+		edits[field] += " " + word
+	}
+	if len(edits) == 0 {
+		return nil, nil, fmt.Errorf("no fields to edit")
+	}
+	for f, v := range edits {
+		v = strings.TrimSpace(v)
+		if f == "owner" || f == "backup_owner" || f == "lead_approver" {
+			v = strings.TrimPrefix(v, "@")
+		}
+		if v == "" {
+			return nil, nil, fmt.Errorf("%v can't be empty", f)
+		}
+		edits[f] = v
+	}
+	return edits, order, nil
+}
+
+func setProdJob(job ProdJob) {
+	for i := range prod_jobs {
+		if prod_jobs[i].job_id == job.job_id {
+			prod_jobs[i] = job
+			return
+		}
+	}
+}
+
+// applyJobEdits updates the job in memory and in the spreadsheet, recording
+// one history entry per changed field. Returns the updated job.
+func applyJobEdits(job ProdJob, user string, edits map[string]string, order []string) ProdJob {
+	now := time.Now()
+	changed := []JobEdit{}
+	for _, field := range order {
+		old_value := getJobField(job, field)
+		if old_value == edits[field] {
+			continue
+		}
+		setJobField(&job, field, edits[field])
+		changed = append(changed, JobEdit{edit_time: now, job_id: job.job_id, user: user, field: field, old_value: old_value, new_value: edits[field]})
+	}
+	if len(changed) == 0 {
+		return job
+	}
+	setProdJob(job)
+	UpdateProdJob(job)
+	for _, edit := range changed {
+		job_edits = append(job_edits, edit)
+		WriteJobEdit(edit)
+		journalJobEdit(edit)
+	}
+	return job
+}
+
+func parseJobID(s slack.SlashCommand, raw string) (ProdJob, bool) {
+	job_id, err := strconv.Atoi(raw)
+	if err != nil {
+		rejectSlash(s, "invalid", fmt.Sprintf("Couldn't parse '%v' as a job ID", raw))
+		return ProdJob{}, false
+	}
+	job := getProdJob(job_id)
+	if (job == ProdJob{}) {
+		rejectSlash(s, "invalid", fmt.Sprintf("Could not find a prod job with ID %v", job_id))
+		return ProdJob{}, false
+	}
+	return job, true
+}
+
+func handleProdEdit(s slack.SlashCommand, words []string) {
+	if len(words) < 3 {
+		rejectSlash(s, "invalid", helptexts["edit"])
+		return
+	}
+	job, ok := parseJobID(s, words[1])
+	if !ok {
+		return
+	}
+	if !canChangeJob(job, s.UserID, s.UserName) {
+		fmt.Printf("[WARN] @%v tried to edit job %v owned by @%v\n", s.UserName, job.job_id, job.owner)
+		rejectSlash(s, "denied", fmt.Sprintf("Sorry, only @%v, the job's owner, @%v, its backup owner, or a prod admin can edit job %v.", job.owner, job.backup_owner, job.job_id))
+		return
+	}
+	edits, order, err := parseJobEdits(words[2:])
+	if err != nil {
+		rejectSlash(s, "invalid", fmt.Sprintf("I can't parse that: %v. Please use `/prod edit <job id> field=value ...`; fields are summary, phab_task, diff_uri, owner, backup_owner, lead_approver and template", err))
+		return
+	}
+	if template, ok := edits["template"]; ok {
+		if _, err := parseTemplate(template); err != nil {
+			rejectSlash(s, "invalid", fmt.Sprintf("That template won't work: %v", err))
+			return
+		}
+	}
+	job = applyJobEdits(job, s.UserName, edits, order)
+	emitEvent("job.updated", job)
+	replyToSlash(s, fmt.Sprintf("Updated prod job:\n%v", serializeProdJob(job)))
+}
+
+func handleProdArchive(s slack.SlashCommand, words []string, archive bool) {
+	if len(words) != 2 {
+		rejectSlash(s, "invalid", helptexts[words[0]])
+		return
+	}
+	job, ok := parseJobID(s, words[1])
+	if !ok {
+		return
+	}
+	if job.archived == archive {
+		rejectSlash(s, "invalid", fmt.Sprintf("Job %v is already %vd", job.job_id, words[0]))
+		return
+	}
+	if !canChangeJob(job, s.UserID, s.UserName) {
+		fmt.Printf("[WARN] @%v tried to %v job %v owned by @%v\n", s.UserName, words[0], job.job_id, job.owner)
+		rejectSlash(s, "denied", fmt.Sprintf("Sorry, only @%v, the job's owner, @%v, its backup owner, or a prod admin can %v job %v.", job.owner, job.backup_owner, words[0], job.job_id))
+		return
+	}
+	job = applyJobEdits(job, s.UserName, map[string]string{"archived": formatBool(archive)}, []string{"archived"})
+	if archive {
+		emitEvent("job.archived", job)
+		replyToSlash(s, fmt.Sprintf("Archived job %v. It can no longer be started; `/prod unarchive %v` to undo.", job.job_id, job.job_id))
+	} else {
+		emitEvent("job.updated", job)
+		replyToSlash(s, fmt.Sprintf("Unarchived job %v", job.job_id))
+	}
+}
+
+func handleProdTransfer(s slack.SlashCommand, words []string) {
+	if len(words) != 3 {
+		rejectSlash(s, "invalid", helptexts["transfer"])
+		return
+	}
+	job, ok := parseJobID(s, words[1])
+	if !ok {
+		return
+	}
+	if !canChangeJob(job, s.UserID, s.UserName) {
+		fmt.Printf("[WARN] @%v tried to transfer job %v owned by @%v\n", s.UserName, job.job_id, job.owner)
+		rejectSlash(s, "denied", fmt.Sprintf("Sorry, only @%v, the job's owner, @%v, its backup owner, or a prod admin can transfer job %v.", job.owner, job.backup_owner, job.job_id))
+		return
+	}
+	old_owner := job.owner
+	job = applyJobEdits(job, s.UserName, map[string]string{"owner": strings.TrimPrefix(words[2], "@")}, []string{"owner"})
+	emitEvent("job.updated", job)
+	params := slack.PostMessageParameters{LinkNames: 1, Markdown: true}
+	api.PostMessage(prod_channel_id, fmt.Sprintf("@%v transferred [job id %v] %v from @%v to @%v", s.UserName, job.job_id, job.summary, old_owner, job.owner), params)
+	replyToSlash(s, fmt.Sprintf("Transferred job %v to @%v", job.job_id, job.owner))
+}
+
+func handleProdHistory(s slack.SlashCommand, words []string) {
+	job, ok := parseJobID(s, words[1])
+	if !ok {
+		return
+	}
+	edits := []JobEdit{}
+	for _, edit := range job_edits {
+		if edit.job_id == job.job_id {
+			edits = append(edits, edit)
+		}
+	}
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].edit_time.After(edits[j].edit_time) })
+	msg := ""
+	for _, edit := range edits {
+		msg += fmt.Sprintf("%v @%v changed *%v*: `%v` → `%v`\n", edit.edit_time.Format("2006-01-02 15:04"), edit.user, edit.field, edit.old_value, edit.new_value)
+	}
+	if msg == "" {
+		msg = fmt.Sprintf("Job %v has never been edited", job.job_id)
+	}
+	replyToSlash(s, msg)
+}
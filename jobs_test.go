@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nlopes/slack"
+)
+
+type slackStub struct{}
+
+func (slackStub) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: 200, Header: http.Header{"Content-Type": []string{"application/json"}},
+		Body: ioutil.NopCloser(strings.NewReader(`{"ok": true}`)), Request: req}, nil
+}
+
+// stubSlack answers every Slack API call with ok for the rest of the test.
+func stubSlack(t *testing.T) {
+	old := api
+	api = slack.New("", slack.OptionHTTPClient(&http.Client{Transport: slackStub{}}))
+	t.Cleanup(func() { api = old })
+}
+
+func TestArchiveNeedsOwner(t *testing.T) {
+	inTempDir(t)
+	resetSyncState(t)
+	stubSlack(t)
+	defer func(admins []string) { prod_admins = admins }(prod_admins)
+	prod_admins = []string{"boss"}
+	prod_jobs = []ProdJob{{job_id: 1, summary: "one", owner: "jsmith", backup_owner: "jdoe"}}
+
+	tests := []struct {
+		user		string
+		words		[]string
+		outcome		string
+		archived	bool
+	}{
+		{"mallory", []string{"archive", "1"}, "denied", false},
+		{"jsmith", []string{"archive", "1"}, "ok", true},
+		{"mallory", []string{"unarchive", "1"}, "denied", true},
+		{"jdoe", []string{"unarchive", "1"}, "ok", false},
+		{"boss", []string{"archive", "1"}, "ok", true},
+	}
+	for _, test := range tests {
+		slash_outcome = "ok"
+		handleProdArchive(slack.SlashCommand{UserName: test.user}, test.words, test.words[0] == "archive")
+		if slash_outcome != test.outcome || getProdJob(1).archived != test.archived {
+			t.Errorf("@%v %v: outcome %v, archived %v; want %v, %v", test.user, test.words[0], slash_outcome, getProdJob(1).archived, test.outcome, test.archived)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
 	"strings"
 	"github.com/nlopes/slack"
 )
@@ -29,7 +30,26 @@ func formatRequest(r *http.Request) string {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCLI(os.Args[1:]))
+	}
+	serve()
+}
+
+func serve() {
+	LoadRedaction()
+	LoadAuditJournal()
+	go RunJournalAnchor()
 	LoadSheets()
+	goBackground(RunSheetsFlusher)
+	go RunSheetsSync()
+	LoadWebhooks()
+	LoadRoles()
+	LoadPolicies()
+	LoadRunner()
+	LoadArtifactStore()
+	LoadSchedules()
+	goBackground(RunScheduler)
 	http.HandleFunc("/slash", func(w http.ResponseWriter, r *http.Request) {
 		s, err := slack.SlashCommandParse(r)
 		if err != nil {
@@ -66,6 +86,10 @@ func main() {
 		}
 	})
 
-	fmt.Println("[INFO] Server listening")
-	http.ListenAndServe(":3000", nil)
+	http.HandleFunc("/events", HandleSlackEvent)
+
+	registerAPIHandlers()
+	registerDashboardHandlers()
+
+	runServer()
 }
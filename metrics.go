@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics, served on /metrics. Calls to Slack and the Sheets API
+// are measured by wrapping their HTTP clients, so every call is covered
+// without touching the call sites; SMTP is timed where mail is sent.
+
+var (
+	slash_commands_total	= promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:	"pharbot_slash_commands_total",
+		Help:	"/prod commands by subcommand and how they turned out (ok, invalid, denied or failed).",
+	}, []string{"command", "outcome"})
+	interactions_total	= promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:	"pharbot_interactions_total",
+		Help:	"Button and menu callbacks by action and outcome (ok or denied).",
+	}, []string{"action", "outcome"})
+	executions_started_total	= promauto.NewCounter(prometheus.CounterOpts{
+		Name:	"pharbot_executions_started_total",
+		Help:	"Executions started.",
+	})
+	executions_completed_total	= promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:	"pharbot_executions_completed_total",
+		Help:	"Executions completed, by outcome: finished, failed (non-zero exit) or stopped (by someone other than the run user).",
+	}, []string{"outcome"})
+	executions_expired_total	= promauto.NewCounter(prometheus.CounterOpts{
+		Name:	"pharbot_executions_expired_total",
+		Help:	"Scheduled executions that weren't started within their window and were escalated to the backup owner.",
+	})
+	execution_duration_seconds	= promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:		"pharbot_execution_duration_seconds",
+		Help:		"How long executions ran, from start to completion.",
+		Buckets:	prometheus.ExponentialBuckets(10, 3, 10),
+	}, []string{"outcome"})
+	backend_request_seconds	= promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:		"pharbot_backend_request_duration_seconds",
+		Help:		"Latency of calls to Slack, the Sheets API and SMTP.",
+		Buckets:	prometheus.DefBuckets,
+	}, []string{"backend", "operation"})
+	backend_errors_total	= promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:	"pharbot_backend_errors_total",
+		Help:	"Failed calls to Slack, the Sheets API and SMTP.",
+	}, []string{"backend", "operation"})
+	sheet_write_failures_total	= promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:	"pharbot_sheet_write_failures_total",
+		Help:	"Spreadsheet writes that failed, by whether they'll be retried or were dropped.",
+	}, []string{"result"})
+	_	= promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:	"pharbot_active_executions",
+		Help:	"Executions that have been started and not yet completed.",
+	}, func() float64 {
+		state_mutex.Lock()
+		defer state_mutex.Unlock()
+		active := 0
+		for _, exec := range floating_execs {
+			if !exec.start_time.IsZero() {
+				active++
+			}
+		}
+		return float64(active)
+	})
+	_	= promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:	"pharbot_sheet_writes_pending",
+		Help:	"Spreadsheet writes queued and not yet made.",
+	}, func() float64 {
+		return float64(pendingSheetWrites())
+	})
+
+	// buttons and menus we send; anything else is counted as "other"
+	known_actions	map[string]bool	= map[string]bool{"start": true, "start_ack": true, "pick": true, "cancel": true, "done": true, "abort": true}
+)
+
+func registerMetricsHandler() {
+	http.Handle("/metrics", promhttp.Handler())
+}
+
+// commandLabel keeps the command label to commands that exist.
+func commandLabel(command string) string {
+	if _, ok := helptexts[command]; ok || command == "help" {
+		return command
+	}
+	return "unknown"
+}
+
+func recordSlashCommand(command, outcome string) {
+	if commandLabel(command) == "unknown" && outcome == "ok" {
+		outcome = "invalid"
+	}
+	slash_commands_total.WithLabelValues(commandLabel(command), outcome).Inc()
+}
+
+func recordInteraction(action, outcome string) {
+	if !known_actions[action] {
+		action = "other"
+	}
+	interactions_total.WithLabelValues(action, outcome).Inc()
+}
+
+func recordExecutionCompleted(exec JobExecution, forced bool) {
+	outcome := "finished"
+	if forced {
+		outcome = "stopped"
+	} else if exec.runner_state != "" && exec.exit_code != 0 {
+		outcome = "failed"
+	}
+	executions_completed_total.WithLabelValues(outcome).Inc()
+	if !exec.start_time.IsZero() {
+		execution_duration_seconds.WithLabelValues(outcome).Observe(exec.end_time.Sub(exec.start_time).Seconds())
+	}
+}
+
+// observeBackend times a call that isn't made over one of the instrumented
+// HTTP clients.
+func observeBackend(backend, operation string, call func() error) error {
+	start := time.Now()
+	err := call()
+	backend_request_seconds.WithLabelValues(backend, operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		backend_errors_total.WithLabelValues(backend, operation).Inc()
+	}
+	return err
+}
+
+// instrumentedTransport records the latency and failures of a backend's HTTP
+// requests. Slack reports most errors in a 200 response with "ok": false,
+// so for Slack the response is looked at too.
+type instrumentedTransport struct {
+	backend	string
+	base	http.RoundTripper
+}
+
+func instrumentTransport(backend string, base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &instrumentedTransport{backend: backend, base: base}
+}
+
+func (t *instrumentedTransport) operation(r *http.Request) string {
+	if t.backend == "slack" {
+		// the API method, e.g. chat.postMessage
+		return path.Base(r.URL.Path)
+	}
+	return r.Method
+}
+
+func (t *instrumentedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	operation := t.operation(r)
+	start := time.Now()
+	resp, err := t.base.RoundTrip(r)
+	backend_request_seconds.WithLabelValues(t.backend, operation).Observe(time.Since(start).Seconds())
+	if err != nil || resp.StatusCode >= 400 || (t.backend == "slack" && slackResponseFailed(resp)) {
+		backend_errors_total.WithLabelValues(t.backend, operation).Inc()
+	}
+	return resp, err
+}
+
+// slackResponseFailed reads a Slack API response to see whether it says
+// "ok": false, putting the body back for the caller.
+func slackResponseFailed(resp *http.Response) bool {
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return false
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+	if err != nil {
+		return true
+	}
+	result := struct {
+		Ok *bool `json:"ok"`
+	}{}
+	return json.Unmarshal(b, &result) == nil && result.Ok != nil && !*result.Ok
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// `pharbot migrate` copies the Run Job List and Execution Audit Log tabs into
+// the local database. Rows are parsed the same way LoadSheets parses them, so
+// timestamps, yes/no cells and IDs come out the way the bot sees them; rows
+// that can't be made sense of are reported and left out. Running it again
+// only adds or updates what changed in the sheet since, matching executions
+// up by their start time, job, run user and host. --dry-run reports
+// what would be written without touching the database.
+
+type migrationCounts struct {
+	added		int
+	updated		int
+	unchanged	int
+}
+
+func (c *migrationCounts) count(status string) {
+	switch status {
+	case "added":
+		c.added++
+	case "updated":
+		c.updated++
+	default:
+		c.unchanged++
+	}
+}
+
+func (c migrationCounts) String() string {
+	return fmt.Sprintf("%v new, %v updated, %v unchanged", c.added, c.updated, c.unchanged)
+}
+
+// clearBool is false for cells that are filled in but aren't clearly yes or no
+func clearBool(v interface{}) bool {
+	return strings.TrimSpace(cellString(v)) == "" || cellBool(v, true) == cellBool(v, false)
+}
+
+// clearTime is false for cells that are filled in but aren't a time we understand
+func clearTime(v interface{}) bool {
+	s := strings.TrimSpace(cellString(v))
+	return s == "" || strings.HasPrefix(s, "0001-01-01") || !cellTime(v).IsZero()
+}
+
+// normalizeJobRows parses the Run Job List, returning the jobs and a
+// description of every row that was skipped or needed guessing at.
+func normalizeJobRows(values [][]interface{}) ([]ProdJob, []string) {
+	t := job_list_tab
+	jobs, problems := []ProdJob{}, []string{}
+	seen := make(map[int]int)
+	for i, row := range values {
+		job, ok := parseJobRow(row)
+		if !ok {
+			continue
+		}
+		where := fmt.Sprintf("%v row %v", t.name, t.dataRow(i))
+		if job.job_id < 0 {
+			problems = append(problems, fmt.Sprintf("%v: job ID '%v' isn't a number; skipped", where, t.str(row, "job_id")))
+			continue
+		}
+		if first, dup := seen[job.job_id]; dup {
+			problems = append(problems, fmt.Sprintf("%v: job %v is already on row %v; skipped", where, job.job_id, first))
+			continue
+		}
+		seen[job.job_id] = t.dataRow(i)
+		if !clearBool(t.get(row, "archived")) {
+			problems = append(problems, fmt.Sprintf("%v: archived is '%v'; treated as not archived", where, t.str(row, "archived")))
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, problems
+}
+
+// normalizeExecutionRows parses the Execution Audit Log like
+// normalizeJobRows. Artifacts are returned by row index. Executions are
+// stored by start time, so rows without one are skipped; rows that look like
+// an earlier one are imported, but reported in case they're copies.
+func normalizeExecutionRows(values [][]interface{}, jobs []ProdJob) ([]JobExecution, map[int][]Artifact, []string) {
+	t := audit_log_tab
+	seen := make(map[string]int)
+	known := make(map[int]bool)
+	for _, job := range jobs {
+		known[job.job_id] = true
+	}
+	execs, artifacts, problems := []JobExecution{}, make(map[int][]Artifact), []string{}
+	for i, row := range values {
+		exec, ok := parseExecutionRow(row, i)
+		if !ok {
+			continue
+		}
+		where := fmt.Sprintf("%v row %v", t.name, t.dataRow(i))
+		switch {
+		case exec.job_id < 0:
+			problems = append(problems, fmt.Sprintf("%v: job ID '%v' isn't a number; skipped", where, t.str(row, "job_id")))
+			continue
+		case exec.run_user == "" || exec.host == "":
+			problems = append(problems, fmt.Sprintf("%v: no run user or host; skipped", where))
+			continue
+		case !clearTime(t.get(row, "start_time")):
+			problems = append(problems, fmt.Sprintf("%v: start time '%v' isn't a time; skipped", where, t.str(row, "start_time")))
+			continue
+		case exec.start_time.IsZero():
+			problems = append(problems, fmt.Sprintf("%v: no start time; skipped", where))
+			continue
+		}
+		key := string(execStoreKey(exec, 0))
+		if first, dup := seen[key]; dup {
+			problems = append(problems, fmt.Sprintf("%v: same start time (%v), job, run user and host as row %v; imported as a separate execution, delete it if it's a copy", where, t.str(row, "start_time"), first))
+		} else {
+			seen[key] = t.dataRow(i)
+		}
+		if !known[exec.job_id] {
+			problems = append(problems, fmt.Sprintf("%v: job %v isn't in the %v; imported anyway", where, exec.job_id, job_list_tab.name))
+		}
+		if !clearTime(t.get(row, "end_time")) {
+			problems = append(problems, fmt.Sprintf("%v: end time '%v' isn't a time; imported as unfinished", where, t.str(row, "end_time")))
+		}
+		for _, field := range []string{"one_off", "writes", "primary_read"} {
+			if !clearBool(t.get(row, field)) {
+				problems = append(problems, fmt.Sprintf("%v: %v is '%v'; treated as yes", where, field, t.str(row, field)))
+			}
+		}
+		if cell := t.str(row, "artifacts"); cell != "" {
+			artifacts[i] = parseArtifactCell(cell)
+		}
+		execs = append(execs, exec)
+	}
+	return execs, artifacts, problems
+}
+
+// migrateRecords writes jobs and executions in one transaction. With dry_run
+// nothing is written, and tx can be a read-only transaction or nil for a
+// database that doesn't exist yet.
+func migrateRecords(tx *bolt.Tx, jobs []ProdJob, execs []JobExecution, artifacts map[int][]Artifact, dry_run bool) (migrationCounts, migrationCounts, error) {
+	job_counts, exec_counts := migrationCounts{}, migrationCounts{}
+	var job_bucket, exec_bucket *bolt.Bucket
+	if tx != nil {
+		job_bucket, exec_bucket = tx.Bucket(jobs_bucket), tx.Bucket(executions_bucket)
+	}
+	put := func(b *bolt.Bucket, key []byte, v interface{}) (string, error) {
+		if b == nil {
+			return "added", nil
+		}
+		if dry_run {
+			return compareRecord(b, key, v)
+		}
+		return putRecord(b, key, v)
+	}
+
+	for _, job := range jobs {
+		status, err := put(job_bucket, jobKey(job.job_id), newJobRecord(job))
+		if err != nil {
+			return job_counts, exec_counts, fmt.Errorf("job %v: %v", job.job_id, err)
+		}
+		job_counts.count(status)
+	}
+
+	repeats := make(map[string]int)
+	for _, exec := range execs {
+		row := exec.exec_id
+		first := string(execStoreKey(exec, 0))
+		key := execStoreKey(exec, repeats[first])
+		repeats[first]++
+
+		// keep the ID from an earlier run, otherwise hand out the next one
+		exec.exec_id = 0
+		if exec_bucket != nil {
+			if old := exec_bucket.Get(key); old != nil {
+				r := execRecord{}
+				if err := json.Unmarshal(old, &r); err == nil {
+					exec.exec_id = r.ExecID
+				}
+			}
+			if exec.exec_id == 0 && !dry_run {
+				seq, err := exec_bucket.NextSequence()
+				if err != nil {
+					return job_counts, exec_counts, err
+				}
+				exec.exec_id = int(seq)
+			}
+		}
+		status, err := put(exec_bucket, key, newExecRecord(exec, artifacts[row]))
+		if err != nil {
+			return job_counts, exec_counts, fmt.Errorf("execution on row %v: %v", audit_log_tab.dataRow(row), err)
+		}
+		exec_counts.count(status)
+	}
+	return job_counts, exec_counts, nil
+}
+
+func runMigrate(args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dry_run := flags.Bool("dry-run", false, "report what would be imported without writing anything")
+	path := flags.String("db", storePath(), "database file to import into")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	srv, err := openSheets()
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		return 1
+	}
+	values := make(map[*sheetTab][][]interface{})
+	for _, t := range []*sheetTab{job_list_tab, audit_log_tab} {
+		resp, err := srv.Spreadsheets.Values.Get(spreadsheet_id, t.dataRange()).Do()
+		if err != nil {
+			fmt.Printf("[ERROR] Unable to read %v: %v\n", t.name, err)
+			return 1
+		}
+		values[t] = resp.Values
+	}
+	jobs, problems := normalizeJobRows(values[job_list_tab])
+	execs, artifacts, exec_problems := normalizeExecutionRows(values[audit_log_tab], jobs)
+	for _, p := range append(problems, exec_problems...) {
+		fmt.Printf("[WARN] %v\n", p)
+	}
+
+	var job_counts, exec_counts migrationCounts
+	if _, err := os.Stat(*path); *dry_run && os.IsNotExist(err) {
+		// everything would be new
+		job_counts, exec_counts, _ = migrateRecords(nil, jobs, execs, artifacts, true)
+	} else {
+		store, err := openStore(*path, *dry_run)
+		if err != nil {
+			fmt.Printf("[ERROR] Unable to open %v: %v\n", *path, err)
+			return 1
+		}
+		defer store.Close()
+		migrate := func(tx *bolt.Tx) error {
+			job_counts, exec_counts, err = migrateRecords(tx, jobs, execs, artifacts, *dry_run)
+			return err
+		}
+		if *dry_run {
+			err = store.db.View(migrate)
+		} else {
+			err = store.db.Update(migrate)
+		}
+		if err != nil {
+			fmt.Printf("[ERROR] Migration failed, nothing was written: %v\n", err)
+			return 1
+		}
+	}
+
+	verb := "Imported"
+	if *dry_run {
+		verb = "Would import"
+	}
+	fmt.Printf("[INFO] %v into %v: jobs %v; executions %v; %v problems\n", verb, *path, job_counts, exec_counts, len(problems)+len(exec_problems))
+	return 0
+}
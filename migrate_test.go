@@ -0,0 +1,105 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// testExecutionRows lays rows out in the Execution Audit Log's default column order.
+func testExecutionRows(rows ...map[string]interface{}) [][]interface{} {
+	audit_log_tab.defaultLayout()
+	values := [][]interface{}{}
+	for _, row := range rows {
+		values = append(values, audit_log_tab.makeRow(row))
+	}
+	return values
+}
+
+func TestNormalizeExecutionRowsStartTimes(t *testing.T) {
+	values := testExecutionRows(
+		map[string]interface{}{"start_time": "2024-03-04T09:00:00.5Z", "job_id": "1", "run_user": "jsmith", "host": "db1"},
+		map[string]interface{}{"start_time": "2024-03-04T09:00:00.5Z", "job_id": "2", "run_user": "jdoe", "host": "db2"},
+		map[string]interface{}{"start_time": "", "job_id": "1", "run_user": "jsmith", "host": "db1"},
+		map[string]interface{}{"start_time": "2024-03-04T09:00:00.5Z", "job_id": "1", "run_user": "jsmith", "host": "db1"},
+	)
+	execs, _, problems := normalizeExecutionRows(values, []ProdJob{{job_id: 1}, {job_id: 2}})
+	if len(execs) != 3 || execs[0].exec_id != 0 || execs[1].exec_id != 1 || execs[2].exec_id != 3 {
+		t.Errorf("imported %+v, want rows 0, 1 and 3", execs)
+	}
+	want := []string{
+		"Execution Audit Log row 5: no start time; skipped",
+		"Execution Audit Log row 6: same start time (2024-03-04T09:00:00.5Z), job, run user and host as row 3; imported as a separate execution, delete it if it's a copy",
+	}
+	if strings.Join(problems, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got problems %q, want %q", problems, want)
+	}
+}
+
+func TestMigrateRecordsAgain(t *testing.T) {
+	store, err := openStore(filepath.Join(t.TempDir(), "pharbot.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	migrate := func(values [][]interface{}) (migrationCounts, []JobExecution) {
+		execs, artifacts, _ := normalizeExecutionRows(values, nil)
+		var counts migrationCounts
+		err := store.db.Update(func(tx *bolt.Tx) (err error) {
+			_, counts, err = migrateRecords(tx, nil, execs, artifacts, false)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, _, err := store.Executions()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return counts, stored
+	}
+	first := map[string]interface{}{"start_time": "2024-03-04T09:00:00Z", "job_id": "1", "run_user": "jsmith", "host": "db1", "command": "SELECT 1"}
+	second := map[string]interface{}{"start_time": "2024-03-04T09:00:30Z", "job_id": "1", "run_user": "jsmith", "host": "db1", "command": "SELECT 2"}
+
+	counts, stored := migrate(testExecutionRows(first, second))
+	if counts != (migrationCounts{added: 2}) {
+		t.Fatalf("first run: %v", counts)
+	}
+	ids := map[string]int{}
+	for _, exec := range stored {
+		ids[exec.command] = exec.exec_id
+	}
+
+	// a row inserted above them, and a typo fixed in the first
+	earlier := map[string]interface{}{"start_time": "2024-03-04T08:00:00Z", "job_id": "1", "run_user": "jsmith", "host": "db1", "command": "SELECT 0"}
+	first["end_time"] = "2024-03-04T09:10:00Z"
+	counts, stored = migrate(testExecutionRows(earlier, first, second))
+	if counts != (migrationCounts{added: 1, updated: 1, unchanged: 1}) {
+		t.Errorf("second run: %v, want 1 new, 1 updated, 1 unchanged", counts)
+	}
+	if len(stored) != 3 {
+		t.Fatalf("stored %v executions, want 3", len(stored))
+	}
+	for _, exec := range stored {
+		if id, ok := ids[exec.command]; ok && exec.exec_id != id {
+			t.Errorf("%q has ID %v, was %v", exec.command, exec.exec_id, id)
+		}
+		if exec.command == "SELECT 1" && exec.end_time.IsZero() {
+			t.Errorf("the fixed end time wasn't imported: %+v", exec)
+		}
+	}
+
+	// two runs in the same second, by the same user on the same host, are kept apart
+	again := map[string]interface{}{"start_time": "2024-03-04T09:00:30Z", "job_id": "1", "run_user": "jsmith", "host": "db1", "command": "SELECT 3"}
+	for run := 0; run < 2; run++ {
+		counts, stored = migrate(testExecutionRows(earlier, first, second, again))
+		if len(stored) != 4 {
+			t.Fatalf("run %v: stored %v executions, want 4", run, len(stored))
+		}
+	}
+	if counts != (migrationCounts{unchanged: 4}) {
+		t.Errorf("importing the same rows again: %v, want 4 unchanged", counts)
+	}
+}
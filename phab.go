@@ -31,6 +31,8 @@ func HandlePhabRequest(s slack.SlashCommand, w http.ResponseWriter) {
         } else {
             w.Write(marshalMessage(error_string))
         }
+    } else if !authorize(s.UserID, s.UserName, "/cherry-pick", role_runner) {
+        w.Write(marshalMessage(permissionDenied("/cherry-pick", role_runner)))
     } else if len(words) < 5 {
         w.Write(marshalMessage(error_string))
     } else {
@@ -61,5 +63,7 @@ func HandlePhabRequest(s slack.SlashCommand, w http.ResponseWriter) {
                        "*Testing Required: *" + words[last_index-1] + "\n" +
                        "*Approver: *" + words[last_index]
         sendDeploymentMessage(pick_message)
+        emitEvent("cherrypick.requested", CherryPickRequest{User: s.UserName, PhabDiff: words[0], SHA: words[1],
+            Tiers: words[2:last_index-1], NeedsTest: words[last_index-1], Approver: strings.TrimPrefix(words[last_index], "@")})
     }
 }
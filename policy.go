@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Per-job execution policies, checked by /prod start before the Start Job
+// button is shown. Policies live in policies.json, keyed by job ID, with an
+// optional "default" applied to jobs without their own entry:
+//
+//	{
+//	  "default": {"hosts": ["*-replica*"]},
+//	  "jobs": {
+//	    "12": {"hosts": ["merchant-backend-*", "re:^mongo-[0-9]+$"], "command_prefixes": ["merch-dbshell"], "read_only": true}
+//	  }
+//	}
+//
+// Host patterns are shell globs, or regexes when prefixed with "re:". Command
+// prefixes match whole words, and a command with shell operators in it never
+// matches, since they could chain on something else. An empty list allows
+// anything. Admins can bypass a failing policy with --override,
+// which is logged and posted alongside the job in #prod.
+
+const policy_config_file = "policies.json"
+
+type JobPolicy struct {
+	Hosts		[]string	`json:"hosts"`
+	CommandPrefixes	[]string	`json:"command_prefixes"`
+	ReadOnly	bool		`json:"read_only"`
+	NoPrimaryReads	bool		`json:"no_primary_reads"`
+}
+
+type PolicyViolation struct {
+	rule	string
+	reason	string
+}
+
+var (
+	shell_operators	[]string	= []string{";", "&", "|", "`", "$(", ">", "<", "\n"}
+	default_policy	*JobPolicy
+	job_policies	map[int]JobPolicy	= make(map[int]JobPolicy)
+)
+
+func LoadPolicies() {
+	b, err := ioutil.ReadFile(policy_config_file)
+	if err != nil {
+		fmt.Printf("[INFO] No %v found, executions aren't policy checked\n", policy_config_file)
+		return
+	}
+	config := struct {
+		Default	*JobPolicy		`json:"default"`
+		Jobs	map[string]JobPolicy	`json:"jobs"`
+	}{}
+	if err := json.Unmarshal(b, &config); err != nil {
+		fmt.Printf("[ERROR] Unable to parse %v: %v\n", policy_config_file, err)
+		return
+	}
+	for k, policy := range config.Jobs {
+		job_id, err := strconv.Atoi(k)
+		if err != nil {
+			fmt.Printf("[ERROR] Ignoring policy for '%v' in %v: not a job ID\n", k, policy_config_file)
+			continue
+		}
+		job_policies[job_id] = policy
+	}
+	default_policy = config.Default
+	fmt.Printf("[INFO] Loaded policies for %v jobs\n", len(job_policies))
+}
+
+func policyFor(job_id int) (JobPolicy, bool) {
+	if policy, ok := job_policies[job_id]; ok {
+		return policy, true
+	}
+	if default_policy != nil {
+		return *default_policy, true
+	}
+	return JobPolicy{}, false
+}
+
+func matchHost(pattern, host string) bool {
+	if strings.HasPrefix(pattern, "re:") {
+		re, err := regexp.Compile(pattern[len("re:"):])
+		if err != nil {
+			fmt.Printf("[ERROR] Bad host pattern '%v' in %v: %v\n", pattern, policy_config_file, err)
+			return false
+		}
+		return re.MatchString(host)
+	}
+	matched, err := path.Match(pattern, host)
+	if err != nil {
+		fmt.Printf("[ERROR] Bad host pattern '%v' in %v: %v\n", pattern, policy_config_file, err)
+		return false
+	}
+	return matched
+}
+
+// shellOperator returns the first shell operator in command, or "".
+func shellOperator(command string) string {
+	for _, op := range shell_operators {
+		if strings.Contains(command, op) {
+			return op
+		}
+	}
+	return ""
+}
+
+// commandHasPrefix reports whether command's first words are prefix's words.
+func commandHasPrefix(command, prefix string) bool {
+	words, prefix_words := strings.Fields(command), strings.Fields(prefix)
+	if len(prefix_words) == 0 || len(words) < len(prefix_words) {
+		return false
+	}
+	for i, word := range prefix_words {
+		if words[i] != word {
+			return false
+		}
+	}
+	return true
+}
+
+// checkPolicy returns every rule of the job's policy the execution breaks.
+func checkPolicy(exec JobExecution) []PolicyViolation {
+	policy, ok := policyFor(exec.job_id)
+	if !ok {
+		return nil
+	}
+	violations := []PolicyViolation{}
+
+	if len(policy.Hosts) > 0 {
+		allowed := false
+		for _, pattern := range policy.Hosts {
+			if matchHost(pattern, exec.host) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			violations = append(violations, PolicyViolation{rule: "hosts", reason: fmt.Sprintf("host `%v` doesn't match any allowed host (%v)", exec.host, strings.Join(policy.Hosts, ", "))})
+		}
+	}
+
+	if len(policy.CommandPrefixes) > 0 {
+		allowed := false
+		for _, prefix := range policy.CommandPrefixes {
+			if commandHasPrefix(exec.command, prefix) {
+				allowed = true
+				break
+			}
+		}
+		if op := shellOperator(exec.command); op != "" {
+			if op == "\n" {
+				op = "a newline"
+			} else {
+				op = "`" + op + "`"
+			}
+			violations = append(violations, PolicyViolation{rule: "command_prefixes", reason: fmt.Sprintf("command contains %v, which could run something besides the allowed command", op)})
+		} else if !allowed {
+			violations = append(violations, PolicyViolation{rule: "command_prefixes", reason: fmt.Sprintf("command must start with one of %v", strings.Join(policy.CommandPrefixes, ", "))})
+		}
+	}
+
+	if policy.ReadOnly && exec.writes {
+		violations = append(violations, PolicyViolation{rule: "read_only", reason: "this job is read-only, so it can't be run with writes"})
+	}
+	if policy.NoPrimaryReads && exec.primary_read {
+		violations = append(violations, PolicyViolation{rule: "no_primary_reads", reason: "this job must read from secondaries, so it can't be run with primary reads"})
+	}
+	return violations
+}
+
+func serializePolicyViolations(violations []PolicyViolation) string {
+	msg := ""
+	for _, v := range violations {
+		msg += fmt.Sprintf("• *%v*: %v\n", v.rule, v.reason)
+	}
+	return msg
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestCheckPolicyCommandPrefixes(t *testing.T) {
+	defer func(policies map[int]JobPolicy) { job_policies = policies }(job_policies)
+	job_policies = map[int]JobPolicy{1: {CommandPrefixes: []string{"psql", "merch-dbshell --read"}}}
+	tests := []struct {
+		command	string
+		ok	bool
+	}{
+		{"psql -c 'SELECT 1'", true},
+		{"  psql", true},
+		{"merch-dbshell --read orders", true},
+		{"merch-dbshell --write orders", false},
+		// whole words only
+		{"psqlx -c 'SELECT 1'", false},
+		{"merch-dbshell --readwrite orders", false},
+		// anything that could chain another command on
+		{"psql; rm -rf /", false},
+		{"psql && rm -rf /", false},
+		{"psql || rm -rf /", false},
+		{"psql & rm -rf /", false},
+		{"psql -c 'SELECT 1' | sh", false},
+		{"psql -c \"`rm -rf /`\"", false},
+		{"psql -c \"$(rm -rf /)\"", false},
+		{"psql > /etc/hosts", false},
+		{"psql\nrm -rf /", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		violations := checkPolicy(JobExecution{job_id: 1, command: test.command})
+		if (len(violations) == 0) != test.ok {
+			t.Errorf("checkPolicy(%q) = %v, want allowed %v", test.command, violations, test.ok)
+		}
+	}
+}
@@ -11,8 +11,9 @@ import (
 	"os"
 	"bytes"
 	"sort"
+	"sync"
 	"github.com/nlopes/slack"
-	"github.com/renstrom/fuzzysearch/fuzzy"
+	"github.com/lithammer/fuzzysearch/fuzzy"
 	"gopkg.in/gomail.v2"
 )
 
@@ -24,6 +25,8 @@ type ProdJob struct {
 	backup_owner	string
 	lead_approver	string
 	diff_uri	string
+	archived	bool
+	template	string
 }
 
 type JobExecution struct {
@@ -37,26 +40,149 @@ type JobExecution struct {
 	primary_read	bool
 	host		string
 	command		string
+	stopped_by	string
+	stop_reason	string
+	policy_override	string
+	flag_warnings	string
+	runner_state	string
+	exit_code	int
+	duration	time.Duration
+	params		string
+}
+
+func (job ProdJob) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		JobID		int	`json:"job_id"`
+		PhabTask	string	`json:"phab_task"`
+		Summary		string	`json:"summary"`
+		Owner		string	`json:"owner"`
+		BackupOwner	string	`json:"backup_owner"`
+		LeadApprover	string	`json:"lead_approver"`
+		DiffURI		string	`json:"diff_uri"`
+		Archived	bool	`json:"archived"`
+		Template	string	`json:"template,omitempty"`
+	}{job.job_id, job.phab_task, job.summary, job.owner, job.backup_owner, job.lead_approver, job.diff_uri, job.archived, job.template})
+}
+
+func (exec JobExecution) MarshalJSON() ([]byte, error) {
+	// zero times mean "hasn't happened yet", so leave them out rather than emit year 1
+	var start_time, end_time *time.Time
+	var exit_code *int
+	var duration *float64
+	var params map[string]string
+	if exec.params != "" {
+		params = parseParams(redactCommand(exec.params))
+	}
+	if !exec.start_time.IsZero() {
+		start_time = &exec.start_time
+	}
+	if !exec.end_time.IsZero() {
+		end_time = &exec.end_time
+	}
+	// only executions the runner ran have an exit code worth reporting
+	if exec.runner_state != "" {
+		seconds := exec.duration.Seconds()
+		exit_code, duration = &exec.exit_code, &seconds
+	}
+	return json.Marshal(struct {
+		ExecID		int		`json:"exec_id"`
+		JobID		int		`json:"job_id"`
+		StartTime	*time.Time	`json:"start_time,omitempty"`
+		EndTime		*time.Time	`json:"end_time,omitempty"`
+		RunUser		string		`json:"run_user"`
+		OneOff		bool		`json:"one_off"`
+		Writes		bool		`json:"writes"`
+		PrimaryRead	bool		`json:"primary_read"`
+		Host		string		`json:"host"`
+		Command		string		`json:"command"`
+		Params		map[string]string	`json:"params,omitempty"`
+		StoppedBy	string		`json:"stopped_by,omitempty"`
+		StopReason	string		`json:"stop_reason,omitempty"`
+		PolicyOverride	string		`json:"policy_override,omitempty"`
+		FlagWarnings	string		`json:"flag_warnings,omitempty"`
+		RunnerState	string		`json:"runner_state,omitempty"`
+		ExitCode	*int		`json:"exit_code,omitempty"`
+		Duration	*float64	`json:"duration_seconds,omitempty"`
+	}{exec.exec_id, exec.job_id, start_time, end_time, exec.run_user, exec.one_off, exec.writes, exec.primary_read, exec.host, redactCommand(exec.command), params, exec.stopped_by, exec.stop_reason, exec.policy_override, exec.flag_warnings,
+		exec.runner_state, exit_code, duration})
 }
 
 var (
 	prod_jobs 	[]ProdJob		= []ProdJob{}
 	execution_log 	[]JobExecution		= []JobExecution{}
-	api		*slack.Client 		= slack.New(os.Getenv("SLACK_TOKEN"))
+	api		*slack.Client 		= slack.New(os.Getenv("SLACK_TOKEN"), slack.OptionHTTPClient(&http.Client{Transport: instrumentTransport("slack", nil)}))
 	prod_channel_id string			= "CA60G6WRH"
 	floating_execs	map[int]JobExecution	= make(map[int]JobExecution)
 	msg_timestamp	map[int]string		= make(map[int]string)
+	// guards the jobs and executions kept in memory (prod_jobs, execution_log,
+	// floating_execs, msg_timestamp, execution_artifacts and the like). The
+	// /prod handlers hold it throughout; anything running on its own goroutine
+	// takes it before touching them.
+	state_mutex	sync.Mutex
+	// Slack posts and emails queued while holding state_mutex, made by
+	// unlockState once it's released so slow servers don't hold up everyone
+	unlocked_io	[]func()
+	// how the /prod command being handled turned out, for the metrics
+	slash_outcome	string
 	helptexts	map[string]string	= map[string]string {
-		"start": "*`/prod start`*: Start a new prod job.\n`/prod start <job id>` - start a previously run prod job, copying old parameters over\n`/prod start <job id> <oneoff> <writes> <primary read> <host> <command>` - start a new prod job, manually populating parameters\n`<job id>` must be a valid job ID (i.e., you have added it with `/prod new` or it shows up in `/prod search` or `/prod search`)\n`<oneoff>`, `<writes>`, `<primary read>` must be booleans; yes/no, true/false, 1/0 are accepted",
-		"stop": "*`/prod stop`*: Stop a job given the execution ID. This should only be used when the interactive button times out. In this case, run the command with the provided execution ID",
-		"list": "*`/prod list`*: List all active jobs. This includes jobs in the [start job / cancel] phase.",
+		"start": "*`/prod start`*: Start a new prod job.\n`/prod start <job id>` - start a previously run prod job, copying parameters over from its most recent execution. You'll be offered a list of other recent hosts/commands to copy instead\n`/prod start <job id> --from <exec id>` - copy the parameters of a specific execution\n`/prod start <job id> name=value ...` - fill in the job's command template (see `/prod help edit`). The host and flags come from the last execution unless given as `host=`, `oneoff=`, `writes=` or `primary_read=`\n`/prod start <job id> <oneoff> <writes> <primary read> <host> <command>` - start a new prod job, manually populating parameters\n`<job id>` must be a valid job ID (i.e., you have added it with `/prod new` or it shows up in `/prod search` or `/prod search`)\n`<oneoff>`, `<writes>`, `<primary read>` must be booleans; yes/no, true/false, 1/0 are accepted\nIf the job has a policy (allowed hosts, command prefixes, read-only), the execution must follow it. Admins can bypass a failing policy with `/prod start --override <job id> ...`; overrides are logged and posted in #prod",
+		"stop": "*`/prod stop`*: Stop a job given the execution ID. This should only be used when the interactive button times out. In this case, run the command with the provided execution ID\n`/prod stop <exec id>` - stop your own job\n`/prod stop <exec id> <reason>` - stop someone else's job. Only the job's owner, backup owner and prod admins can do this, and the reason is posted in #prod",
+		"list": "*`/prod list`*: List running jobs, longest running first.\n`/prod list --all` - also include jobs still in the [start job / cancel] phase\n`/prod list --mine` - only list your own jobs\n`/prod list --public` - post the list to the channel instead of just to you\nOptions can be combined, e.g. `/prod list --mine --all`",
 		"new": "*`/prod new`*: Create a new prod job.\n`/prod new <phab task> <diff URI> <owner> <backup owner> <lead approver> <summary>` - create a new prod job with the listed parameters; also returns the ID of the job for use with `/prod start`.",
 		"search": "*`/prod search`*: Search prod jobs, execution logs.\n`/prod search executions <query>` - search job execution logs for `query`\n`/prod search jobs <query>` - search prod jobs for `query`",
+		"webhooks": "*`/prod webhooks`*: List recent outbound webhook deliveries.\n`/prod webhooks <n>` - show the last `n` deliveries (default 10)",
+		"edit": "*`/prod edit`*: Change a prod job. Only its owner, backup owner or a prod admin can.\n`/prod edit <job id> field=value ...` - fields are `summary`, `phab_task`, `diff_uri`, `owner`, `backup_owner`, `lead_approver` and `template`. Values can contain spaces, e.g. `/prod edit 12 summary=Recalibrate Flux Capacitors owner=jdoe`\n`template` is a command with typed parameters, e.g. `/prod edit 12 template=backfill --merchant {{merchant_id:int}} --dry-run={{dry_run:bool}}`; types are int, signed_int (which can be negative), bool and string",
+		"archive": "*`/prod archive`*: Archive a prod job so it can't be started any more. Only its owner, backup owner or a prod admin can.\n`/prod archive <job id>`",
+		"unarchive": "*`/prod unarchive`*: Make an archived prod job startable again. Only its owner, backup owner or a prod admin can.\n`/prod unarchive <job id>`",
+		"transfer": "*`/prod transfer`*: Hand a prod job over to a new owner. Only its owner, backup owner or a prod admin can.\n`/prod transfer <job id> <new owner>`",
+		"history": "*`/prod history`*: Show every edit made to a prod job.\n`/prod history <job id>`",
+		"attach": "*`/prod attach`*: Attach logs, CSVs, screenshots or links to an execution.\n`/prod attach <exec id>` - the files you upload in a DM with me over the next 10 minutes get attached\n`/prod attach <exec id> <url> [description]` - attach a link\nFiles uploaded to a job's #prod thread are attached automatically.",
+		"artifacts": "*`/prod artifacts`*: List what's been attached to an execution.\n`/prod artifacts <exec id>`",
+		"whoami": "*`/prod whoami`*: Show your role. Roles are viewer (list, search), runner (start and stop jobs, cherry-picks), approver (create jobs) and admin (everything).",
+		"schedule": "*`/prod schedule`*: Run a job on a schedule.\n`/prod schedule <job id> <minute> <hour> <day of month> <month> <day of week> [--window <minutes>]` - when the cron expression matches (server time), I'll DM you the job's start confirmation, copied from its last execution. If it isn't started within the window (default 60 minutes), the job's backup owner is asked to run it instead\nFor example, `/prod schedule 12 0 9 * * 1` every Monday at 9:00",
+		"schedules": "*`/prod schedules`*: List scheduled jobs.\n`/prod schedules cancel <schedule id>` - cancel a schedule; only its creator or a prod admin can do this",
+		"export": "*`/prod export`*: Export executions and the jobs they ran, for audits.\n`/prod export executions [--since <date>] [--until <date>] [--format csv|json]` - I'll DM you the file. Dates are YYYY-MM-DD (both ends included) or RFC 3339 times; the default format is csv",
+		"admin": "*`/prod admin`*: Manage roles.\n`/prod admin grant <user> <role>` - give a user a role (viewer, runner, approver or admin)\n`/prod admin revoke <user>` - remove a user's role\n`/prod admin audit [n]` - show the last `n` permission decisions\n`/prod admin resync` - pick up changes made directly in the spreadsheet now, instead of waiting for the next sync\n`/prod admin verify-audit` - check that pharbot's audit journal hasn't been tampered with, and list executions that were edited or added by hand in the Execution Audit Log",
+	}
+	// anything not listed here only needs role_viewer
+	prod_command_roles	map[string]int	= map[string]int {
+		"start": role_runner,
+		"stop": role_runner,
+		"attach": role_runner,
+		"schedule": role_runner,
+		"new": role_approver,
+		"edit": role_approver,
+		"archive": role_approver,
+		"unarchive": role_approver,
+		"transfer": role_approver,
+		"webhooks": role_admin,
+		"admin": role_admin,
 	}
 	helpmsg		string			=
-		"Pharbot: A simple bot to help out with (some) Phab and (mostly) Prod related things.\n`/prod start`: start a prod job\n`/prod new`: create a new prod job\n`/prod stop`: stop a prod job\n`/prod list`: list active prod jobs\n`/prod search`: search prod jobs / execution logs"
+		"Pharbot: A simple bot to help out with (some) Phab and (mostly) Prod related things.\n`/prod start`: start a prod job\n`/prod new`: create a new prod job\n`/prod stop`: stop a prod job\n`/prod list`: list active prod jobs\n`/prod search`: search prod jobs / execution logs\n`/prod webhooks`: list recent webhook deliveries\n`/prod edit`: edit a prod job\n`/prod archive`: archive a prod job\n`/prod transfer`: transfer a prod job to a new owner\n`/prod history`: show a prod job's edit history\n`/prod attach`: attach output to an execution\n`/prod artifacts`: list an execution's attachments\n`/prod schedule`: run a prod job on a schedule\n`/prod schedules`: list scheduled prod jobs\n`/prod export`: export executions for audits\n`/prod whoami`: show your role\n`/prod admin`: manage roles"
 )
 
+// afterUnlock queues f to run once state_mutex is released by unlockState.
+// The caller holds state_mutex.
+func afterUnlock(f func()) {
+	unlocked_io = append(unlocked_io, f)
+}
+
+// unlockState releases state_mutex, then does the I/O queued while it was held.
+func unlockState() {
+	queued := unlocked_io
+	unlocked_io = nil
+	state_mutex.Unlock()
+	for _, f := range queued {
+		f()
+	}
+}
+
+// respondToAction replies to a button press once state_mutex is released.
+func respondToAction(cb slack.AttachmentActionCallback, msg []byte) {
+	afterUnlock(func() { http.Post(cb.ResponseURL, "application/json", bytes.NewBuffer(msg)) })
+}
+
 func sendProdMessage(msg string) string {
 	params := slack.PostMessageParameters{LinkNames: 1, Markdown: true}
 	_, timestamp, _ := api.PostMessage(prod_channel_id, msg, params)
@@ -70,6 +196,13 @@ func replyToSlash(s slack.SlashCommand, msg string) string {
 	return timestamp
 }
 
+// rejectSlash replies to a command that wasn't carried out, recording why
+// (invalid, denied or failed) as the command's outcome.
+func rejectSlash(s slack.SlashCommand, outcome, msg string) string {
+	slash_outcome = outcome
+	return replyToSlash(s, msg)
+}
+
 func replyToSlashWithAttachments(s slack.SlashCommand, msg string, attachments []slack.Attachment) string {
 	timestamp, _ := api.PostEphemeral(s.ChannelID, s.UserID, slack.MsgOptionText(msg, false), slack.MsgOptionAttachments(attachments...))
 	fmt.Printf("replyToSlashA: %v\n", timestamp)
@@ -95,27 +228,56 @@ func generateExecId() int {
 
 func generateExecution(job_id int, user string, one_off, writes, primary_read bool, host, command string) JobExecution {
 	return JobExecution{exec_id: generateExecId(), job_id: job_id, run_user: user, one_off: one_off, writes: writes,
-				primary_read: primary_read, host: host, command: command}		
+				primary_read: primary_read, host: host, command: storedCommand(command)}		
 }
 
+func generateExecutionFromExecution(prev JobExecution, user string) JobExecution {
+	return JobExecution{exec_id: generateExecId(), job_id: prev.job_id, run_user: user, one_off: prev.one_off, writes: prev.writes,
+				primary_read: prev.primary_read, host: prev.host, command: storedCommand(prev.command), params: prev.params}
+}
+
+// Copies the job's most recent execution
 func generateExecutionFromPreviousExecution(job_id int, user string) JobExecution {
-	for _, job := range execution_log {
-		if job.job_id == job_id {
-			return JobExecution{exec_id: generateExecId(), job_id: job_id, run_user: user, one_off: job.one_off, writes: job.writes,
-						primary_read: job.primary_read, host: job.host, command: job.command}
+	for i := len(execution_log) - 1; i >= 0; i-- {
+		if execution_log[i].job_id == job_id {
+			return generateExecutionFromExecution(execution_log[i], user)
 		}
 	}
 	return JobExecution{exec_id: -1}
 }
 
+// recentExecutionChoices returns the job's last few executions with distinct
+// host/command combinations, newest first.
+func recentExecutionChoices(job_id int) []JobExecution {
+	choices := []JobExecution{}
+	seen := make(map[string]bool)
+	for i := len(execution_log) - 1; i >= 0 && len(choices) < start_choice_count; i-- {
+		exec := execution_log[i]
+		key := exec.host + "\x00" + exec.command
+		if exec.job_id != job_id || seen[key] {
+			continue
+		}
+		seen[key] = true
+		choices = append(choices, exec)
+	}
+	return choices
+}
+
 func serializeJobExecutionAndProdJob(exec JobExecution, job ProdJob) string {
-	return fmt.Sprintf("*Job ID:* %v (%v)\n*Run User:* @%v\n*Oneoff:* %v\n*Writes*: %v\n*Primary Reads:* %v\n*Host:* `%v`\n*Command:* `%v`",
-				exec.job_id, job.summary, exec.run_user, exec.one_off, exec.writes, exec.primary_read, exec.host, exec.command)
+	msg := fmt.Sprintf("*Job ID:* %v (%v)\n*Run User:* @%v\n*Oneoff:* %v\n*Writes*: %v\n*Primary Reads:* %v\n*Host:* `%v`\n*Command:* `%v`",
+				exec.job_id, job.summary, exec.run_user, exec.one_off, exec.writes, exec.primary_read, exec.host, redactCommand(exec.command))
+	if exec.params != "" {
+		msg += fmt.Sprintf("\n*Params:* `%v`", redactCommand(exec.params))
+	}
+	if exec.policy_override != "" {
+		msg += fmt.Sprintf("\n*Policy Override:* %v", exec.policy_override)
+	}
+	return msg
 }
 
 func serializeJobExecution(exec JobExecution) string {
 	return fmt.Sprintf("*Job ID:* %v\n*Run User:* @%v\n*Oneoff:* %v\n*Writes*: %v\n*Primary Reads:* %v\n*Host:* `%v`\n*Command:* `%v`",
-				exec.job_id, exec.run_user, exec.one_off, exec.writes, exec.primary_read, exec.host, exec.command)
+				exec.job_id, exec.run_user, exec.one_off, exec.writes, exec.primary_read, exec.host, redactCommand(exec.command))
 }
 
 // This has totally different behaviour from its transposed partner. Don't think too hard about it.
@@ -128,8 +290,16 @@ func serializeProdJobAndJobExecution(job ProdJob, exec JobExecution) string {
 }
 
 func serializeProdJob(job ProdJob) string {
-	return fmt.Sprintf("*ID:* %v\n*Summary:* %v\n*Owner:* @%v\n*Backup Owner:* @%v\n*Lead Approver:* @%v\n*Phab Task:* %v\n*Diff URI:* %v\n",
-		job.job_id, job.summary, job.owner, job.backup_owner, job.lead_approver, job.phab_task, job.diff_uri)
+	archived := ""
+	if job.archived {
+		archived = "*Archived:* yes\n"
+	}
+	template := ""
+	if job.template != "" {
+		template = fmt.Sprintf("*Command Template:* `%v`\n", job.template)
+	}
+	return fmt.Sprintf("*ID:* %v\n*Summary:* %v\n*Owner:* @%v\n*Backup Owner:* @%v\n*Lead Approver:* @%v\n*Phab Task:* %v\n*Diff URI:* %v\n%v%v",
+		job.job_id, job.summary, job.owner, job.backup_owner, job.lead_approver, job.phab_task, job.diff_uri, template, archived)
 }
 
 func getProdJob(job_id int) ProdJob {
@@ -141,11 +311,135 @@ func getProdJob(job_id int) ProdJob {
 	return ProdJob{}
 }
 
+func formatBool(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func serializeActiveExecution(exec JobExecution) string {
+	state := "pending"
+	if !exec.start_time.IsZero() {
+		state = fmt.Sprintf("running for %v", formatElapsed(time.Since(exec.start_time)))
+	}
+	return fmt.Sprintf("`%v` [job id %v] %v - @%v on `%v` (writes: %v, primary read: %v) - %v",
+		exec.exec_id, exec.job_id, getProdJob(exec.job_id).summary, exec.run_user, exec.host, formatBool(exec.writes), formatBool(exec.primary_read), state)
+}
+
+func handleProdList(s slack.SlashCommand, args []string) {
+	mine, all, public := false, false, false
+	for _, arg := range args {
+		switch arg {
+		case "--mine":
+			mine = true
+		case "--all":
+			all = true
+		case "--public":
+			public = true
+		case "":
+		default:
+			rejectSlash(s, "invalid", fmt.Sprintf("`%v` is not a valid option for `/prod list`. Try `/prod help list`", arg))
+			return
+		}
+	}
+
+	execs := []JobExecution{}
+	for _, exec := range floating_execs {
+		if mine && exec.run_user != s.UserName {
+			continue
+		}
+		if !all && exec.start_time.IsZero() {
+			continue
+		}
+		execs = append(execs, exec)
+	}
+	// running jobs by start time, then pending ones; exec ID keeps the order stable
+	sort.Slice(execs, func(i, j int) bool {
+		a, b := execs[i], execs[j]
+		if a.start_time.IsZero() != b.start_time.IsZero() {
+			return b.start_time.IsZero()
+		}
+		if !a.start_time.Equal(b.start_time) {
+			return a.start_time.Before(b.start_time)
+		}
+		return a.exec_id < b.exec_id
+	})
+
+	msg := ""
+	for _, exec := range execs {
+		msg += serializeActiveExecution(exec) + "\n"
+	}
+	if msg == "" {
+		msg = "No active jobs"
+	}
+	if public {
+		// no LinkNames here, listing jobs shouldn't ping everyone running one
+		params := slack.PostMessageParameters{Markdown: true}
+		api.PostMessage(s.ChannelID, msg, params)
+	} else {
+		replyToSlash(s, msg)
+	}
+}
+
+const start_choice_count = 10
+
+const start_confirmation_text = "Please inspect the below job for correctness. Click 'Start Job' to add this job to the spreadsheet in a few minutes, and message #prod immediately. Click 'Cancel' to delete it."
+
+// startAttachments builds the Start Job / Cancel confirmation for exec. It also
+// records any flag warnings on exec, since starting then needs acknowledgement.
+func startAttachments(exec *JobExecution, job ProdJob) []slack.Attachment {
+	start_action := slack.AttachmentAction{Name: "start", Value: "start", Text: "Start Job", Type: "button", Style: "primary"}
+	cancel_action := slack.AttachmentAction{Name: "cancel", Value: "cancel", Text: "Cancel", Type: "button", Style: "danger"}
+	attachments := []slack.Attachment{}
+	// if the command doesn't look like the flags say, make them say so explicitly
+	exec.flag_warnings = flagMismatches(*exec)
+	if exec.flag_warnings != "" {
+		start_action = slack.AttachmentAction{Name: "start_ack", Value: "start_ack", Text: "Flags Are Correct, Start Job", Type: "button", Style: "primary",
+			Confirm: &slack.ConfirmationField{Title: "Start with these flags?", Text: "pharbot thinks this command's writes/primary read flags are wrong. Your acknowledgement will be posted in #prod.", OkText: "Start Job", DismissText: "Go Back"}}
+		attachments = append(attachments, slack.Attachment{Color: "warning", Title: "Double check the writes / primary read flags", Text: exec.flag_warnings +
+			"If the flags are wrong, cancel and run `/prod start` again with the right ones."})
+	}
+	start_attach := slack.Attachment{Text: serializeJobExecutionAndProdJob(*exec, job), Actions: []slack.AttachmentAction{start_action, cancel_action}, CallbackID: fmt.Sprintf("prod_start_%v", exec.exec_id)}
+	attachments = append([]slack.Attachment{start_attach}, attachments...)
+	// let them swap in a different previous execution's host and command
+	choices := recentExecutionChoices(exec.job_id)
+	if len(choices) > 1 {
+		options := []slack.AttachmentActionOption{}
+		for _, prev := range choices {
+			text := fmt.Sprintf("%v: %v", prev.host, redactCommand(prev.command))
+			if len(text) > 72 {
+				text = text[:72] + "..."
+			}
+			options = append(options, slack.AttachmentActionOption{Text: text, Value: strconv.Itoa(prev.exec_id)})
+		}
+		pick_action := slack.AttachmentAction{Name: "pick", Text: "Copy a different execution", Type: "select", Options: options}
+		attachments = append(attachments, slack.Attachment{Text: "Not the host or command you wanted? These were used recently:", Actions: []slack.AttachmentAction{pick_action}, CallbackID: start_attach.CallbackID})
+	}
+	return attachments
+}
+
 func HandleProdRequest(s slack.SlashCommand, w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json")
+	state_mutex.Lock()
+	defer unlockState()
 	msg := strings.TrimSpace(s.Text)
 	words := strings.Split(msg, " ")
 
+	// a lone subcommand is a request for its help text, except for these
+	command := words[0]
+	if len(words) == 1 && command != "list" && command != "webhooks" && command != "whoami" && command != "schedules" {
+		command = "help"
+	}
+	slash_outcome = "ok"
+	defer func() { recordSlashCommand(command, slash_outcome) }()
+	if required := prod_command_roles[command]; !authorize(s.UserID, s.UserName, "/prod "+command, required) {
+		journalAppend(s.UserName, "command.denied", "/prod "+command, redactCommand(s.Text), "")
+		rejectSlash(s, "denied", permissionDenied("/prod "+command, required))
+		return
+	}
+	journalAppend(s.UserName, "command", "/prod "+command, redactCommand(s.Text), "")
+
 	switch len(words) {
 	case 1:
 		switch words[0] {
@@ -156,20 +450,25 @@ func HandleProdRequest(s slack.SlashCommand, w http.ResponseWriter) {
 		default:
 			// oops, process it anyway
 			if words[0] == "list" {
-				msg := ""
-				for _, v := range floating_execs {
-					msg += fmt.Sprintf("@%v, %v\n", v.run_user, v.job_id)
-				}
-				if msg == "" {
-					msg = "No active jobs"
-				}
-				replyToSlash(s, msg)
+				handleProdList(s, []string{})
+				return
+			}
+			if words[0] == "webhooks" {
+				replyToSlash(s, listWebhookDeliveries(10))
+				return
+			}
+			if words[0] == "schedules" {
+				handleProdSchedules(s, words)
+				return
+			}
+			if words[0] == "whoami" {
+				replyToSlash(s, whoami(s.UserID, s.UserName))
 				return
 			}
 			if val, ok := helptexts[words[0]]; ok {
 				replyToSlash(s, val)
 			} else {
-				replyToSlash(s, fmt.Sprintf("`%v` is not a valid command", words[0]))
+				rejectSlash(s, "invalid", fmt.Sprintf("`%v` is not a valid command", words[0]))
 			}
 		}
 	default:
@@ -180,38 +479,83 @@ func HandleProdRequest(s slack.SlashCommand, w http.ResponseWriter) {
 				if val, ok := helptexts[words[1]]; ok {
 					replyToSlash(s, val)
 				} else {
-					replyToSlash(s, fmt.Sprintf("`%v` is not a valid command", words[1]))
+					rejectSlash(s, "invalid", fmt.Sprintf("`%v` is not a valid command", words[1]))
 				}
 			} else {
-				replyToSlash(s, "Help can only be called on one command at a time")
+				rejectSlash(s, "invalid", "Help can only be called on one command at a time")
 			}
 		case "start":
 
 			exec := JobExecution{}
 
+			// /prod start --override ... lets admins bypass the job's policy
+			override := false
+			if words[1] == "--override" {
+				override = true
+				words = append(words[:1], words[2:]...)
+				if len(words) == 1 {
+					rejectSlash(s, "invalid", helptexts["start"])
+					return
+				}
+			}
+
 			// assume the format is /prod start <job id>
 			// search execution log to pull a similar job
 			// if we can't find one, inform the user and ask for the full format
 			// /prod start <job id> <oneoff> <writes> <primary read> <host> <command>
-			if len(words) == 2 {
+			if len(words) == 4 && words[2] == "--from" {
 				job_id, err := strconv.Atoi(words[1])
 				if err != nil {
-					replyToSlash(s, fmt.Sprintf("Couldn't parse '%s' as a job ID. Please run `/prod start` or `/prod help start` for usage notes", words[1]))
+					rejectSlash(s, "invalid", fmt.Sprintf("Couldn't parse '%s' as a job ID. Please run `/prod start` or `/prod help start` for usage notes", words[1]))
+					return
+				}
+				prev_id, err := strconv.Atoi(words[3])
+				if err != nil {
+					rejectSlash(s, "invalid", fmt.Sprintf("Couldn't parse '%v' as an execution ID", words[3]))
+					return
+				}
+				prev, ok := findExecution(prev_id)
+				if !ok || prev.job_id != job_id {
+					rejectSlash(s, "invalid", fmt.Sprintf("Job %v doesn't have an execution with ID %v", job_id, prev_id))
+					return
+				}
+				exec = generateExecutionFromExecution(prev, s.UserName)
+			} else if values, ok := parseKeyValues(words[2:]); len(words) > 2 && ok {
+				// /prod start <job id> param=value ... renders the job's command template
+				job_id, err := strconv.Atoi(words[1])
+				if err != nil {
+					rejectSlash(s, "invalid", fmt.Sprintf("Couldn't parse '%s' as a job ID. Please run `/prod start` or `/prod help start` for usage notes", words[1]))
+					return
+				}
+				job := getProdJob(job_id)
+				if job.template == "" {
+					rejectSlash(s, "invalid", fmt.Sprintf("Job %v doesn't have a command template. Add one with `/prod edit %v template=<command>`, or use `/prod start <job id> <oneoff> <writes> <primary read> <host> <command>`", job_id, job_id))
+					return
+				}
+				exec, err = generateExecutionFromTemplate(job, s.UserName, values)
+				if err != nil {
+					rejectSlash(s, "invalid", fmt.Sprintf("Couldn't fill in job %v's template: %v. Usage: `/prod start %v %v [host=<host>]`", job_id, err, job_id, serializeTemplateParams(job.template)))
+					return
+				}
+			} else if len(words) == 2 {
+				job_id, err := strconv.Atoi(words[1])
+				if err != nil {
+					rejectSlash(s, "invalid", fmt.Sprintf("Couldn't parse '%s' as a job ID. Please run `/prod start` or `/prod help start` for usage notes", words[1]))
 					return
 				}
 				exec = generateExecutionFromPreviousExecution(job_id, s.UserName)
 				if (exec.exec_id < 0) {
-					replyToSlash(s, fmt.Sprintf("It looks like job ID %v doesn't have any executions on record. Please create one with `/prod start %v <oneoff> <writes> <primary read> <host> <command>`. For example, `/prod start %v no no yes merchant-backend-master merch-dbshell`", job_id, job_id, job_id))
+					rejectSlash(s, "invalid", fmt.Sprintf("It looks like job ID %v doesn't have any executions on record. Please create one with `/prod start %v <oneoff> <writes> <primary read> <host> <command>`. For example, `/prod start %v no no yes merchant-backend-master merch-dbshell`", job_id, job_id, job_id))
 					return
 				}
 			} else {
 				if len(words) < 7 {
-					replyToSlash(s, "I can't parse that format. Please use the command in the form `/prod start <job id>` or `/prod start <job id> <oneoff> <writes> <primary read> <host> <command>`")
+					rejectSlash(s, "invalid", "I can't parse that format. Please use the command in the form `/prod start <job id>` or `/prod start <job id> <oneoff> <writes> <primary read> <host> <command>`")
 					return
 				}
 				job_id, err := strconv.Atoi(words[1])
 				if err != nil {
-					replyToSlash(s, fmt.Sprintf("Couldn't parse '%v' as a job ID. Please run `/prod start` or `/prod help start` for usage notes", words[1]))
+					rejectSlash(s, "invalid", fmt.Sprintf("Couldn't parse '%v' as a job ID. Please run `/prod start` or `/prod help start` for usage notes", words[1]))
 					return
 				}
 				oneoff := false
@@ -220,7 +564,7 @@ func HandleProdRequest(s slack.SlashCommand, w http.ResponseWriter) {
 				} else if words[2] == "no" || words[2] == "false" || words[2] == "0" {
 					oneoff = false
 				} else {
-					replyToSlash(s, fmt.Sprintf("Couldn't parse '%v' as a boolean. Please use one of yes/no, true/false, 1/0", words[2]))
+					rejectSlash(s, "invalid", fmt.Sprintf("Couldn't parse '%v' as a boolean. Please use one of yes/no, true/false, 1/0", words[2]))
 					return
 				}
 				writes := false
@@ -229,7 +573,7 @@ func HandleProdRequest(s slack.SlashCommand, w http.ResponseWriter) {
 				} else if words[3] == "no" || words[3] == "false" || words[3] == "0" {
 					writes = false
 				} else {
-					replyToSlash(s, fmt.Sprintf("Couldn't parse '%v' as a boolean. Please use one of yes/no, true/false, 1/0", words[3]))
+					rejectSlash(s, "invalid", fmt.Sprintf("Couldn't parse '%v' as a boolean. Please use one of yes/no, true/false, 1/0", words[3]))
 					return
 				}
 				primary_read := false
@@ -238,7 +582,7 @@ func HandleProdRequest(s slack.SlashCommand, w http.ResponseWriter) {
 				} else if words[4] == "no" || words[4] == "false" || words[4] == "0" {
 					primary_read = false
 				} else {
-					replyToSlash(s, fmt.Sprintf("Couldn't parse '%v' as a boolean. Please use one of yes/no, true/false, 1/0", words[4]))
+					rejectSlash(s, "invalid", fmt.Sprintf("Couldn't parse '%v' as a boolean. Please use one of yes/no, true/false, 1/0", words[4]))
 					return
 				}
 				host := words[5]
@@ -248,21 +592,40 @@ func HandleProdRequest(s slack.SlashCommand, w http.ResponseWriter) {
 			
 			job := getProdJob(exec.job_id)
 			if (job == ProdJob{}) {
-				replyToSlash(s, fmt.Sprintf("Could not find a prod job with ID %v; perhaps try `/prod new`?", exec.job_id))
+				rejectSlash(s, "invalid", fmt.Sprintf("Could not find a prod job with ID %v; perhaps try `/prod new`?", exec.job_id))
+				return
+			}
+			if job.archived {
+				rejectSlash(s, "invalid", fmt.Sprintf("Job %v (%v) has been archived and can't be started. Ask @%v, @%v or a prod admin to `/prod unarchive %v` it if it's still needed.", job.job_id, job.summary, job.owner, job.backup_owner, job.job_id))
 				return
 			}
 
-			start_action := slack.AttachmentAction{Name: "start", Value: "start", Text: "Start Job", Type: "button", Style: "primary"}
-			cancel_action := slack.AttachmentAction{Name: "cancel", Value: "cancel", Text: "Cancel", Type: "button", Style: "danger"}
-			start_attach := slack.Attachment{Text: serializeJobExecutionAndProdJob(exec, job), Actions: []slack.AttachmentAction{start_action, cancel_action}, CallbackID: fmt.Sprintf("prod_start_%v", exec.exec_id)}
-			attachments := []slack.Attachment{start_attach}
-			replyToSlashWithAttachments(s, "Please inspect the below job for correctness. Click 'Start Job' to add this job to the spreadsheet in a few minutes, and message #prod immediately. Click 'Cancel' to delete it.", attachments)
+			if violations := checkPolicy(exec); len(violations) > 0 {
+				if !override {
+					rejectSlash(s, "denied", fmt.Sprintf("This execution breaks job %v's policy:\n%vPlease fix the execution, or ask a prod admin to run it with `/prod start --override`.", job.job_id, serializePolicyViolations(violations)))
+					return
+				}
+				if !authorize(s.UserID, s.UserName, "/prod start --override", role_admin) {
+					rejectSlash(s, "denied", permissionDenied("/prod start --override", role_admin))
+					return
+				}
+				rules := []string{}
+				for _, v := range violations {
+					rules = append(rules, v.rule)
+				}
+				exec.policy_override = fmt.Sprintf("@%v overrode %v", s.UserName, strings.Join(rules, ", "))
+				fmt.Printf("[AUDIT] @%v overrode policy for execution %v of job %v:\n%v", s.UserName, exec.exec_id, job.job_id, serializePolicyViolations(violations))
+				journalAppend(s.UserName, "approval.policy_override", fmt.Sprintf("execution %v of job %v", exec.exec_id, job.job_id), serializePolicyViolations(violations), "")
+			}
+
+			attachments := startAttachments(&exec, job)
+			replyToSlashWithAttachments(s, start_confirmation_text, attachments)
 				
 			floating_execs[exec.exec_id] = exec
 			fmt.Printf("%v\n", msg_timestamp[exec.exec_id])
 		case "search":
 			if len(words) < 3 {
-				replyToSlash(s, "I can't parse that format. Please use the format `/prod search executions <query>` or `/prod search jobs <query>`")
+				rejectSlash(s, "invalid", "I can't parse that format. Please use the format `/prod search executions <query>` or `/prod search jobs <query>`")
 				return
 			}
 			serials := []string{}
@@ -275,7 +638,8 @@ func HandleProdRequest(s slack.SlashCommand, w http.ResponseWriter) {
 					serials = append(serials, serializeProdJob(job))
 				}
 			} else {
-				replyToSlash(s, fmt.Sprintf("The search domain must be one of `executions` or `jobs`; `%v` is invalid", words[1]))
+				rejectSlash(s, "invalid", fmt.Sprintf("The search domain must be one of `executions` or `jobs`; `%v` is invalid", words[1]))
+				return
 			}
 			matches := fuzzy.RankFind(strings.Join(words[2:], " "), serials)
 			sort.Sort(matches)
@@ -288,26 +652,94 @@ func HandleProdRequest(s slack.SlashCommand, w http.ResponseWriter) {
 			}	
 			replyToSlash(s, msg)
 		case "stop":
-			exec_id, _ := strconv.Atoi(words[1])
-			if _, ok := floating_execs[exec_id]; ok {
-				for _, v := range execution_log {
-					if v.exec_id == exec_id {
-						v.end_time = time.Now()
+			exec_id, err := strconv.Atoi(words[1])
+			if err != nil {
+				rejectSlash(s, "invalid", fmt.Sprintf("Couldn't parse '%v' as an execution ID", words[1]))
+				return
+			}
+			exec, ok := floating_execs[exec_id]
+			if !ok || exec.start_time.IsZero() {
+				rejectSlash(s, "invalid", "It appears this job has already been completed.")
+				return
+			}
+			allowed, forced := canStopExecution(exec, s.UserID, s.UserName)
+			if !allowed {
+				fmt.Printf("[WARN] @%v tried to stop execution %v run by @%v\n", s.UserName, exec_id, exec.run_user)
+				rejectSlash(s, "denied", fmt.Sprintf("Sorry, only @%v, the job's owner or backup owner, or a prod admin can stop this job.", exec.run_user))
+				return
+			}
+			reason := strings.Join(words[2:], " ")
+			if forced && reason == "" {
+				rejectSlash(s, "invalid", fmt.Sprintf("This job was started by @%v. Please give a reason for stopping it: `/prod stop %v <reason>`", exec.run_user, exec_id))
+				return
+			}
+			if abortExecution(exec_id, s.UserName, forced, reason) {
+				replyToSlash(s, "Aborting the running command. The result will be posted in the #prod thread.")
+				return
+			}
+			finishExecution(exec, s.UserName, forced, reason)
+			replyToSlash(s, fmt.Sprintf("Job stopped."))
+		case "list":
+			handleProdList(s, words[1:])
+		case "edit":
+			handleProdEdit(s, words)
+		case "archive", "unarchive":
+			handleProdArchive(s, words, words[0] == "archive")
+		case "transfer":
+			handleProdTransfer(s, words)
+		case "history":
+			handleProdHistory(s, words)
+		case "schedule":
+			handleProdSchedule(s, words)
+		case "schedules":
+			handleProdSchedules(s, words)
+		case "attach":
+			handleProdAttach(s, words)
+		case "export":
+			handleProdExport(s, words)
+		case "artifacts":
+			exec_id, err := strconv.Atoi(words[1])
+			if err != nil {
+				rejectSlash(s, "invalid", fmt.Sprintf("Couldn't parse '%v' as an execution ID", words[1]))
+				return
+			}
+			replyToSlash(s, serializeArtifacts(exec_id))
+		case "admin":
+			switch {
+			case words[1] == "grant" && len(words) == 4:
+				fmt.Printf("[AUDIT] @%v granted @%v the %v role\n", s.UserName, words[2], words[3])
+				journalAppend(s.UserName, "role.granted", "@"+strings.TrimPrefix(words[2], "@"), words[3], "")
+				replyToSlash(s, grantRole(words[2], words[3]))
+			case words[1] == "revoke" && len(words) == 3:
+				fmt.Printf("[AUDIT] @%v revoked @%v's role\n", s.UserName, words[2])
+				journalAppend(s.UserName, "role.revoked", "@"+strings.TrimPrefix(words[2], "@"), "", "")
+				replyToSlash(s, revokeRole(words[2]))
+			case words[1] == "audit" && len(words) <= 3:
+				n := 20
+				if len(words) == 3 {
+					if v, err := strconv.Atoi(words[2]); err == nil && v > 0 {
+						n = v
 					}
 				}
-				ts := msg_timestamp[exec_id]
-				params := slack.PostMessageParameters{ThreadTimestamp: ts}
-				msg := "Done"
-				api.PostMessage(prod_channel_id, msg, params)
-				delete(floating_execs, exec_id)
-				replyToSlash(s, fmt.Sprintf("Job stopped."))
-			} else {
-				replyToSlash(s, "It appears this job has already been completed.")
+				replyToSlash(s, listPermissionDecisions(n))
+			case words[1] == "resync" && len(words) == 2:
+				replyToSlash(s, handleResync(s.UserName))
+			case words[1] == "verify-audit" && len(words) == 2:
+				replyToSlash(s, handleVerifyAudit(s.UserName))
+			default:
+				rejectSlash(s, "invalid", helptexts["admin"])
 			}
+		case "webhooks":
+			n, err := strconv.Atoi(words[1])
+			if err != nil || n <= 0 {
+				rejectSlash(s, "invalid", fmt.Sprintf("Couldn't parse '%v' as a number of deliveries", words[1]))
+				return
+			}
+			replyToSlash(s, listWebhookDeliveries(n))
 		case "new":
 			new_prod_id := len(prod_jobs) + 1
 			if len(words) < 7 {
-				replyToSlash(s, "I can't parse that format. Please use the format `/prod new <phab task> <diff URI> <owner> <backup owner> <lead approver> <summary>`. For example, `/prod new https://phab.wish.com/T1234321 https://phab.wish.com/D1234321 jsmith jdoe jdoe Recalibrate Flux Capacitors`")
+				rejectSlash(s, "invalid", "I can't parse that format. Please use the format `/prod new <phab task> <diff URI> <owner> <backup owner> <lead approver> <summary>`. For example, `/prod new https://phab.wish.com/T1234321 https://phab.wish.com/D1234321 jsmith jdoe jdoe Recalibrate Flux Capacitors`")
 				return
 			}
 			phab_task := words[1]
@@ -320,62 +752,183 @@ func HandleProdRequest(s slack.SlashCommand, w http.ResponseWriter) {
 			job := ProdJob{job_id: new_prod_id, phab_task: phab_task, diff_uri: diff_uri, owner: owner, backup_owner: backup_owner, lead_approver: lead_approver, summary: summary}
 			WriteProdJob(job)
 			prod_jobs = append(prod_jobs, job)
+			journalAppend(s.UserName, "job.created", fmt.Sprintf("job %v", job.job_id), serializeJobChanges(ProdJob{}, job), "")
+			emitEvent("job.created", job)
 			replyToSlash(s, fmt.Sprintf("Created prod job:\n%v", serializeProdJob(job)))
 		}
 	}	
 }
 
+// setExecution replaces the stored copies of exec with this one.
+func setExecution(exec JobExecution) {
+	if _, ok := floating_execs[exec.exec_id]; ok {
+		floating_execs[exec.exec_id] = exec
+	}
+	for i := range execution_log {
+		if execution_log[i].exec_id == exec.exec_id {
+			execution_log[i] = exec
+		}
+	}
+}
+
+// finishExecution marks a running execution as done, updating the audit log and
+// the #prod thread. Forced stops record who did it and why.
+func finishExecution(exec JobExecution, user string, forced bool, reason string) {
+	exec.end_time = time.Now()
+	if forced {
+		exec.stopped_by = user
+		exec.stop_reason = reason
+		fmt.Printf("[INFO] Execution %v (run by @%v) force stopped by @%v: %v\n", exec.exec_id, exec.run_user, user, reason)
+	}
+	setExecution(exec)
+	MarkExecCompleted(exec)
+	journalExecution(user, "execution.stopped", exec)
+	recordExecutionCompleted(exec, forced)
+	emitEvent("execution.completed", executionEventData(exec))
+
+	msg := "Done"
+	if forced {
+		msg = fmt.Sprintf("Done. Stopped by @%v on behalf of @%v: %v", user, exec.run_user, reason)
+	}
+	params := slack.PostMessageParameters{ThreadTimestamp: msg_timestamp[exec.exec_id], LinkNames: 1}
+	afterUnlock(func() { api.PostMessage(prod_channel_id, msg, params) })
+	delete(floating_execs, exec.exec_id)
+}
+
 func HandleProdAction(cb slack.AttachmentActionCallback, w http.ResponseWriter) {
+	state_mutex.Lock()
+	defer unlockState()
 	api.SetDebug(true)
 	fmt.Printf("%v\n%v\n", cb.CallbackID, len(cb.Actions))
 	for _, v := range cb.Actions {
 		fmt.Printf("%v\n", v.Name)
 	}
+	if len(cb.Actions) == 0 {
+		return
+	}
+	if action := "prod button " + cb.Actions[0].Name; !authorize(cb.User.ID, cb.User.Name, action, role_runner) {
+		journalAppend(cb.User.Name, "action.denied", action, cb.CallbackID, "")
+		recordInteraction(cb.Actions[0].Name, "denied")
+		respondToAction(cb, marshalMessage(permissionDenied(action, role_runner)))
+		return
+	}
+	recordInteraction(cb.Actions[0].Name, "ok")
 	if strings.HasPrefix(cb.CallbackID, "prod_start_") {
-		if cb.Actions[0].Name == "start" {
+		if cb.Actions[0].Name == "start" || cb.Actions[0].Name == "start_ack" {
 			exec_id, _ := strconv.Atoi(cb.CallbackID[len("prod_start_"):])
-			exec := floating_execs[exec_id]
+			exec := claimScheduledExecution(floating_execs[exec_id], cb.User.Name)
+			if exec.flag_warnings != "" {
+				if cb.Actions[0].Name != "start_ack" {
+					respondToAction(cb, marshalMessage("This job's flags need to be acknowledged before it can start. Please run `/prod start` again."))
+					return
+				}
+				fmt.Printf("[AUDIT] @%v acknowledged flag warnings for execution %v:\n%v", cb.User.Name, exec_id, exec.flag_warnings)
+				journalAppend(cb.User.Name, "approval.flag_warnings", fmt.Sprintf("execution %v of job %v", exec_id, exec.job_id), exec.flag_warnings, "")
+			}
 			job := getProdJob(exec.job_id)
-			ts := sendProdMessage(fmt.Sprintf("%v\n", serializeProdJobAndJobExecution(job, exec)))
-			msg_timestamp[exec_id] = ts
+			if job.archived {
+				respondToAction(cb, marshalMessage(fmt.Sprintf("Job %v has been archived since you asked to start it, so it can't be started.", job.job_id)))
+				delete(floating_execs, exec_id)
+				return
+			}
+			prod_msg := serializeProdJobAndJobExecution(job, exec)
+			if exec.policy_override != "" {
+				prod_msg += fmt.Sprintf("\n:warning: Policy override: %v", exec.policy_override)
+			}
+			if exec.flag_warnings != "" {
+				prod_msg += fmt.Sprintf("\n:warning: @%v confirmed writes: %v, primary read: %v despite:\n%v", cb.User.Name, formatBool(exec.writes), formatBool(exec.primary_read), exec.flag_warnings)
+			}
 			exec.start_time = time.Now()
+			floating_execs[exec_id] = exec
 			execution_log = append(execution_log, exec)
 			WriteExecution(exec)
-			done_action := slack.AttachmentAction{Name: "done", Value: "done", Text: "Finish Job", Type: "button"}
-			done_attach := slack.Attachment{Text: fmt.Sprintf("This button will expire in 30 minutes. If you would like to end the job after this time, please run `/prod stop %v`", exec_id), Actions: []slack.AttachmentAction{done_action}, CallbackID: cb.CallbackID}
-			http.Post(cb.ResponseURL, "application/json", bytes.NewBuffer(marshalMessageAttachments("Thanks. Your message has been posted. The prod spreadsheet will update shortly. Click the button below when you have completed the job.", []slack.Attachment{done_attach})))
-			m := gomail.NewMessage()
-			m.SetHeader("From", fmt.Sprintf("%v@wish.com", exec.run_user))
-			m.SetHeader("To", "afoley@wish.com")
-			m.SetHeader("Subject", fmt.Sprintf("[prod] [job-id %v] %v", exec.job_id, job.summary))
-
-			d := gomail.NewDialer("smtp.gmail.com", 465, "swhitehead@contextlogic.com", "you wish")
-
-			// Send the email to Bob, Cora and Dan.
-			if err := d.DialAndSend(m); err != nil {
-			    panic(err)
-			}	
+			journalExecution(cb.User.Name, "execution.started", exec)
+			executions_started_total.Inc()
+			emitEvent("execution.started", executionEventData(exec))
+			var response []byte
+			if command_runner != nil {
+				// the runner finishes the job itself when the command exits, so all that's left to offer is aborting it
+				abort_action := slack.AttachmentAction{Name: "abort", Value: "abort", Text: "Abort Job", Type: "button", Style: "danger",
+					Confirm: &slack.ConfirmationField{Title: "Abort this job?", Text: "The command will be killed on the host.", OkText: "Abort", DismissText: "Keep Running"}}
+				abort_attach := slack.Attachment{Text: fmt.Sprintf("This button will expire in 30 minutes. If you need to abort the job after this time, please run `/prod stop %v`", exec_id), Actions: []slack.AttachmentAction{abort_action}, CallbackID: cb.CallbackID}
+				response = marshalMessageAttachments("Thanks. Your message has been posted and the command is running; its output will show up in the #prod thread.", []slack.Attachment{abort_attach})
+			} else {
+				done_action := slack.AttachmentAction{Name: "done", Value: "done", Text: "Finish Job", Type: "button"}
+				done_attach := slack.Attachment{Text: fmt.Sprintf("This button will expire in 30 minutes. If you would like to end the job after this time, please run `/prod stop %v`", exec_id), Actions: []slack.AttachmentAction{done_action}, CallbackID: cb.CallbackID}
+				response = marshalMessageAttachments("Thanks. Your message has been posted. The prod spreadsheet will update shortly. Click the button below when you have completed the job.", []slack.Attachment{done_attach})
+			}
+			afterUnlock(func() {
+				// the runner posts its output in the #prod message's thread, so that goes first
+				ts := sendProdMessage(fmt.Sprintf("%v\n", prod_msg))
+				state_mutex.Lock()
+				msg_timestamp[exec_id] = ts
+				// unless it was stopped in the meantime
+				if _, running := floating_execs[exec_id]; running && command_runner != nil {
+					startExecution(exec)
+				}
+				unlockState()
+				http.Post(cb.ResponseURL, "application/json", bytes.NewBuffer(response))
+
+				m := gomail.NewMessage()
+				m.SetHeader("From", fmt.Sprintf("%v@wish.com", exec.run_user))
+				m.SetHeader("To", "afoley@wish.com")
+				m.SetHeader("Subject", fmt.Sprintf("[prod] [job-id %v] %v", exec.job_id, job.summary))
+
+				d := gomail.NewDialer("smtp.gmail.com", 465, "swhitehead@contextlogic.com", "you wish")
+
+				// Send the email to Bob, Cora and Dan.
+				if err := observeBackend("smtp", "send", func() error { return d.DialAndSend(m) }); err != nil {
+					fmt.Printf("[ERROR] Unable to email about execution %v: %v\n", exec_id, err)
+				}
+			})
+		} else if cb.Actions[0].Name == "pick" {
+			exec_id, _ := strconv.Atoi(cb.CallbackID[len("prod_start_"):])
+			exec, ok := floating_execs[exec_id]
+			if !ok || len(cb.Actions[0].SelectedOptions) == 0 {
+				respondToAction(cb, marshalMessage("This job has already been started or cancelled."))
+				return
+			}
+			prev_id, _ := strconv.Atoi(cb.Actions[0].SelectedOptions[0].Value)
+			prev, ok := findExecution(prev_id)
+			if !ok || prev.job_id != exec.job_id {
+				respondToAction(cb, marshalMessage(fmt.Sprintf("Couldn't find execution %v", prev_id)))
+				return
+			}
+			picked := generateExecutionFromExecution(prev, exec.run_user)
+			picked.exec_id = exec_id
+			job := getProdJob(exec.job_id)
+			if violations := checkPolicy(picked); len(violations) > 0 {
+				delete(floating_execs, exec_id)
+				respondToAction(cb, marshalMessage(fmt.Sprintf("Execution %v breaks job %v's policy:\n%vPlease run `/prod start` again and pick another, or ask a prod admin to run `/prod start --override %v --from %v`.", prev_id, job.job_id, serializePolicyViolations(violations), job.job_id, prev_id)))
+				return
+			}
+			attachments := startAttachments(&picked, job)
+			floating_execs[exec_id] = picked
+			respondToAction(cb, marshalMessageAttachments(start_confirmation_text, attachments))
 		} else if cb.Actions[0].Name == "cancel" {
 			exec_id, _ := strconv.Atoi(cb.CallbackID[len("prod_start_"):])
-			http.Post(cb.ResponseURL, "application/json", bytes.NewBuffer(marshalMessage("This job has been cancelled.")))
+			respondToAction(cb, marshalMessage("This job has been cancelled."))
+			if exec, ok := floating_execs[exec_id]; ok {
+				emitEvent("execution.cancelled", executionEventData(exec))
+			}
 			delete(floating_execs, exec_id)
 		} else {
 			exec_id, _ := strconv.Atoi(cb.CallbackID[len("prod_start_"):])
-			if _, ok := floating_execs[exec_id]; ok {
-				for _, v := range execution_log {
-					if v.exec_id == exec_id {
-						v.end_time = time.Now()
-						MarkExecCompleted(v)
-					}
+			if exec, ok := floating_execs[exec_id]; ok {
+				allowed, forced := canStopExecution(exec, cb.User.ID, cb.User.Name)
+				if !allowed {
+					fmt.Printf("[WARN] @%v tried to finish execution %v run by @%v\n", cb.User.Name, exec_id, exec.run_user)
+					respondToAction(cb, marshalMessage(fmt.Sprintf("Sorry, only @%v, the job's owner or backup owner, or a prod admin can finish this job.", exec.run_user)))
+					return
 				}
-				ts := msg_timestamp[exec_id]
-				params := slack.PostMessageParameters{ThreadTimestamp: ts}
-				msg := "Done"
-				api.PostMessage(prod_channel_id, msg, params)
-				http.Post(cb.ResponseURL, "application/json", bytes.NewBuffer(marshalMessage("Thanks! This job has been completed.")))
-				delete(floating_execs, exec_id)
+				if abortExecution(exec_id, cb.User.Name, forced, "used the Abort Job button") {
+					respondToAction(cb, marshalMessage("Aborting. The result will be posted in the #prod thread."))
+					return
+				}
+				finishExecution(exec, cb.User.Name, forced, "used the Finish Job button")
+				respondToAction(cb, marshalMessage("Thanks! This job has been completed."))
 			} else {
-				http.Post(cb.ResponseURL, "application/json", bytes.NewBuffer(marshalMessage("It appears this job has already been completed.")))
+				respondToAction(cb, marshalMessage("It appears this job has already been completed."))
 			}
 		}
 	}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnlockStateRunsQueuedIO(t *testing.T) {
+	order := []string{}
+	state_mutex.Lock()
+	afterUnlock(func() {
+		// the lock is free again, so this can't hold anyone up
+		state_mutex.Lock()
+		order = append(order, "first")
+		afterUnlock(func() { order = append(order, "nested") })
+		unlockState()
+	})
+	afterUnlock(func() { order = append(order, "second") })
+	order = append(order, "locked")
+	unlockState()
+	if want := "locked first nested second"; strings.Join(order, " ") != want {
+		t.Errorf("ran %q, want %q", order, want)
+	}
+	if len(unlocked_io) != 0 {
+		t.Errorf("%v functions still queued", len(unlocked_io))
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Runner mode. With PHARBOT_RUNNER=ssh, starting a job runs its command on its
+// host over SSH instead of just recording that a human is running it.
+// Output is streamed into the job's #prod thread, and the exit code and
+// duration are recorded on the execution.
+//
+//	PHARBOT_SSH_USER         user to log in as (default "pharbot")
+//	PHARBOT_SSH_KEY          private key; should be restricted on the hosts' side
+//	PHARBOT_SSH_KNOWN_HOSTS  known_hosts file used to verify hosts (required)
+//	PHARBOT_SSH_PORT         port used when the host doesn't have one (default 22)
+//
+// Point these at a local sshd to try it out without touching prod.
+
+const (
+	runner_chunk_size	= 3000
+	runner_dial_timeout	= 15 * time.Second
+)
+
+type CommandRunner interface {
+	// Run executes command on host, blocking until it finishes or ctx is
+	// cancelled. The exit code is -1 if the command never finished.
+	Run(ctx context.Context, host, command string, stdout, stderr io.Writer) (int, error)
+}
+
+type sshRunner struct {
+	user		string
+	port		string
+	config		*ssh.ClientConfig
+}
+
+type runnerAbort struct {
+	user	string
+	forced	bool
+	reason	string
+}
+
+var (
+	command_runner	CommandRunner
+	// output is posted at least this often while a command runs
+	runner_flush_interval	time.Duration	= 2 * time.Second
+	runner_cancels	map[int]context.CancelFunc	= make(map[int]context.CancelFunc)
+	runner_aborts	map[int]runnerAbort		= make(map[int]runnerAbort)
+	runner_mutex	sync.Mutex
+)
+
+func LoadRunner() {
+	if os.Getenv("PHARBOT_RUNNER") != "ssh" {
+		return
+	}
+	runner, err := newSSHRunner(os.Getenv("PHARBOT_SSH_USER"), os.Getenv("PHARBOT_SSH_KEY"), os.Getenv("PHARBOT_SSH_KNOWN_HOSTS"), os.Getenv("PHARBOT_SSH_PORT"))
+	if err != nil {
+		fmt.Printf("[ERROR] Unable to set up SSH runner: %v\n", err)
+		os.Exit(1)
+	}
+	if !redaction_keep_original {
+		fmt.Printf("[WARN] Runner mode without keep_original in %v: commands with secrets in them can't be run\n", redaction_config_file)
+	}
+	command_runner = runner
+	fmt.Println("[INFO] SSH runner enabled")
+}
+
+func newSSHRunner(user, key_file, known_hosts_file, port string) (*sshRunner, error) {
+	if user == "" {
+		user = "pharbot"
+	}
+	if port == "" {
+		port = "22"
+	}
+	key, err := ioutil.ReadFile(key_file)
+	if err != nil {
+		return nil, fmt.Errorf("reading key: %v", err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("parsing key: %v", err)
+	}
+	if known_hosts_file == "" {
+		return nil, errors.New("PHARBOT_SSH_KNOWN_HOSTS must be set; refusing to run commands on unverified hosts")
+	}
+	host_key_callback, err := knownhosts.New(known_hosts_file)
+	if err != nil {
+		return nil, fmt.Errorf("reading known hosts: %v", err)
+	}
+	config := &ssh.ClientConfig{
+		User:			user,
+		Auth:			[]ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback:	host_key_callback,
+		Timeout:		runner_dial_timeout,
+	}
+	return &sshRunner{user: user, port: port, config: config}, nil
+}
+
+func (r *sshRunner) Run(ctx context.Context, host, command string, stdout, stderr io.Writer) (int, error) {
+	addr := host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		addr = net.JoinHostPort(host, r.port)
+	}
+	client, err := ssh.Dial("tcp", addr, r.config)
+	if err != nil {
+		return -1, err
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return -1, err
+	}
+	defer session.Close()
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	done := make(chan error, 1)
+	if err := session.Start(command); err != nil {
+		return -1, err
+	}
+	go func() { done <- session.Wait() }()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		session.Signal(ssh.SIGKILL)
+		// closing the client unblocks Wait even if the server ignores the signal
+		client.Close()
+		<-done
+		return -1, ctx.Err()
+	}
+	if err == nil {
+		return 0, nil
+	}
+	if exit, ok := err.(*ssh.ExitError); ok {
+		return exit.ExitStatus(), nil
+	}
+	return -1, err
+}
+
+// threadWriter batches output and posts it into a #prod thread in code blocks,
+// so a chatty command doesn't post a message per line. Whatever's buffered is
+// also posted every runner_flush_interval, so a line printed before the
+// command goes quiet doesn't wait for it to exit.
+type threadWriter struct {
+	label	string
+	post	func(msg string)
+	mutex	sync.Mutex
+	buf	bytes.Buffer
+	done	chan struct{}
+}
+
+func newThreadWriter(label string, post func(msg string)) *threadWriter {
+	t := &threadWriter{label: label, post: post, done: make(chan struct{})}
+	ticker := time.NewTicker(runner_flush_interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				t.Flush()
+			case <-t.done:
+				return
+			}
+		}
+	}()
+	return t
+}
+
+func (t *threadWriter) Write(p []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.buf.Write(p)
+	if t.buf.Len() >= runner_chunk_size {
+		t.flushLocked()
+	}
+	return len(p), nil
+}
+
+func (t *threadWriter) Flush() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.flushLocked()
+}
+
+// Close stops the periodic flushes and posts what's left.
+func (t *threadWriter) Close() {
+	close(t.done)
+	t.Flush()
+}
+
+func (t *threadWriter) flushLocked() {
+	for t.buf.Len() > 0 {
+		chunk := string(t.buf.Next(runner_chunk_size))
+		// output is as likely to contain secrets as the command was
+		t.post(fmt.Sprintf("%v:\n```%v```", t.label, redactCommand(strings.TrimRight(chunk, "\n"))))
+	}
+}
+
+// runCommand runs exec's command with runner, recording its exit code and
+// how long it ran.
+func runCommand(ctx context.Context, runner CommandRunner, exec JobExecution, stdout, stderr io.Writer) (JobExecution, error) {
+	started := time.Now()
+	exit_code, err := runner.Run(ctx, exec.host, exec.command, stdout, stderr)
+	exec.exit_code = exit_code
+	exec.duration = time.Since(started)
+	return exec, err
+}
+
+// startExecution hands a started execution to the runner. The abort hook is
+// registered before the command starts, so a stop that comes in straight away
+// still reaches it. Called with state_mutex held.
+func startExecution(exec JobExecution) {
+	if strings.Contains(exec.command, redacted) {
+		msg := fmt.Sprintf("Can't run this command because secrets were redacted from it. Run it by hand and `/prod stop %v` when done.", exec.exec_id)
+		params := slack.PostMessageParameters{ThreadTimestamp: msg_timestamp[exec.exec_id]}
+		afterUnlock(func() { api.PostMessage(prod_channel_id, msg, params) })
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	runner_mutex.Lock()
+	runner_cancels[exec.exec_id] = cancel
+	runner_mutex.Unlock()
+	goBackground(func() { runExecution(ctx, cancel, exec) })
+}
+
+// runExecution runs a started execution through command_runner and finishes
+// it when the command exits or is aborted.
+func runExecution(ctx context.Context, cancel context.CancelFunc, exec JobExecution) {
+	defer func() {
+		runner_mutex.Lock()
+		delete(runner_cancels, exec.exec_id)
+		runner_mutex.Unlock()
+		cancel()
+	}()
+
+	state_mutex.Lock()
+	ts := msg_timestamp[exec.exec_id]
+	state_mutex.Unlock()
+	post := func(msg string) {
+		api.PostMessage(prod_channel_id, msg, slack.PostMessageParameters{ThreadTimestamp: ts})
+	}
+	post(fmt.Sprintf("Running on `%v`...", exec.host))
+	stdout, stderr := newThreadWriter("stdout", post), newThreadWriter("stderr", post)
+	exec, err := runCommand(ctx, command_runner, exec, stdout, stderr)
+	stdout.Close()
+	stderr.Close()
+
+	runner_mutex.Lock()
+	abort, aborted := runner_aborts[exec.exec_id]
+	delete(runner_aborts, exec.exec_id)
+	runner_mutex.Unlock()
+
+	switch {
+	case aborted:
+		exec.runner_state = "aborted"
+		post(fmt.Sprintf("Aborted by @%v after %v", abort.user, formatElapsed(exec.duration)))
+	case err != nil:
+		exec.runner_state = "failed"
+		post(fmt.Sprintf("Couldn't run the command: %v", err))
+	default:
+		exec.runner_state = "exited"
+		post(fmt.Sprintf("Exited with code %v after %v", exec.exit_code, formatElapsed(exec.duration)))
+	}
+	state_mutex.Lock()
+	defer unlockState()
+	setExecution(exec)
+	if aborted {
+		finishExecution(exec, abort.user, abort.forced, abort.reason)
+	} else {
+		finishExecution(exec, exec.run_user, false, "")
+	}
+}
+
+// abortExecution cancels a command the runner is running on the execution's
+// behalf. It returns false if the runner isn't running anything for it, in
+// which case the caller should finish it the normal way.
+func abortExecution(exec_id int, user string, forced bool, reason string) bool {
+	runner_mutex.Lock()
+	defer runner_mutex.Unlock()
+	cancel, ok := runner_cancels[exec_id]
+	if !ok {
+		return false
+	}
+	runner_aborts[exec_id] = runnerAbort{user: user, forced: forced, reason: reason}
+	cancel()
+	return true
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// A stand-in for sshd that understands a few commands instead of running a
+// shell:
+//
+//	print <n>   writes n lines of output
+//	exit <n>    exits with status n
+//	sleep <ms>  sleeps, then exits 0
+//	hang        waits until it's killed
+type fakeSSHD struct {
+	addr	string
+	signals	chan string
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func startFakeSSHD(t *testing.T, client_key ssh.PublicKey) (*fakeSSHD, ssh.PublicKey) {
+	host_signer, err := ssh.NewSignerFromKey(newKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(client_key.Marshal()) {
+				return nil, fmt.Errorf("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(host_signer)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	sshd := &fakeSSHD{addr: listener.Addr().String(), signals: make(chan string, 10)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go sshd.serve(conn, config)
+		}
+	}()
+	return sshd, host_signer.PublicKey()
+}
+
+func (sshd *fakeSSHD) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for new_channel := range chans {
+		if new_channel.ChannelType() != "session" {
+			new_channel.Reject(ssh.UnknownChannelType, "sessions only")
+			continue
+		}
+		channel, requests, err := new_channel.Accept()
+		if err != nil {
+			continue
+		}
+		go sshd.session(channel, requests)
+	}
+}
+
+func (sshd *fakeSSHD) session(channel ssh.Channel, requests <-chan *ssh.Request) {
+	killed := make(chan struct{})
+	var kill sync.Once
+	for req := range requests {
+		switch req.Type {
+		case "exec":
+			length := binary.BigEndian.Uint32(req.Payload)
+			command := string(req.Payload[4 : 4+length])
+			req.Reply(true, nil)
+			go func() {
+				status := sshd.run(channel, command, killed)
+				binary_status := make([]byte, 4)
+				binary.BigEndian.PutUint32(binary_status, uint32(status))
+				channel.SendRequest("exit-status", false, binary_status)
+				channel.Close()
+			}()
+		case "signal":
+			length := binary.BigEndian.Uint32(req.Payload)
+			sshd.signals <- string(req.Payload[4 : 4+length])
+			kill.Do(func() { close(killed) })
+		default:
+			req.Reply(false, nil)
+		}
+	}
+	kill.Do(func() { close(killed) })
+}
+
+func (sshd *fakeSSHD) run(channel ssh.Channel, command string, killed chan struct{}) int {
+	fields := strings.Fields(command)
+	n := 0
+	if len(fields) > 1 {
+		n, _ = strconv.Atoi(fields[1])
+	}
+	switch fields[0] {
+	case "print":
+		for i := 1; i <= n; i++ {
+			fmt.Fprintf(channel, "line %v\n", i)
+		}
+	case "exit":
+		fmt.Fprintf(channel.Stderr(), "exiting with %v\n", n)
+		return n
+	case "sleep":
+		time.Sleep(time.Duration(n) * time.Millisecond)
+	case "hang":
+		<-killed
+		return 137
+	default:
+		return 127
+	}
+	return 0
+}
+
+// newTestRunner starts a fake sshd and returns an sshRunner set up to talk to it.
+func newTestRunner(t *testing.T) (*sshRunner, *fakeSSHD) {
+	client_key := newKey(t)
+	client_signer, err := ssh.NewSignerFromKey(client_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshd, host_key := startFakeSSHD(t, client_signer.PublicKey())
+
+	dir := t.TempDir()
+	der, err := x509.MarshalECPrivateKey(client_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key_file := filepath.Join(dir, "id_ecdsa")
+	if err := ioutil.WriteFile(key_file, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	known_hosts_file := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(sshd.addr)}, host_key)
+	if err := ioutil.WriteFile(known_hosts_file, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	runner, err := newSSHRunner("pharbot", key_file, known_hosts_file, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return runner, sshd
+}
+
+// postRecorder collects what a threadWriter would post to Slack.
+type postRecorder struct {
+	mutex	sync.Mutex
+	posts	[]string
+}
+
+func (r *postRecorder) post(msg string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.posts = append(r.posts, msg)
+}
+
+func (r *postRecorder) all() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string{}, r.posts...)
+}
+
+func TestSSHRunner(t *testing.T) {
+	runner, sshd := newTestRunner(t)
+	tests := []struct {
+		command		string
+		exit_code	int
+		stdout		string
+		stderr		string
+		min_duration	time.Duration
+	}{
+		{"print 2", 0, "line 1\nline 2\n", "", 0},
+		{"exit 3", 3, "", "exiting with 3\n", 0},
+		{"sleep 300", 0, "", "", 300 * time.Millisecond},
+		{"missing", 127, "", "", 0},
+	}
+	for _, test := range tests {
+		var stdout, stderr strings.Builder
+		exec, err := runCommand(context.Background(), runner, JobExecution{host: sshd.addr, command: test.command}, &stdout, &stderr)
+		if err != nil {
+			t.Errorf("%v: %v", test.command, err)
+			continue
+		}
+		if exec.exit_code != test.exit_code {
+			t.Errorf("%v: exit code %v, want %v", test.command, exec.exit_code, test.exit_code)
+		}
+		if stdout.String() != test.stdout || stderr.String() != test.stderr {
+			t.Errorf("%v: output %q / %q, want %q / %q", test.command, stdout.String(), stderr.String(), test.stdout, test.stderr)
+		}
+		if exec.duration < test.min_duration || exec.duration > test.min_duration+5*time.Second {
+			t.Errorf("%v: duration %v, want at least %v", test.command, exec.duration, test.min_duration)
+		}
+	}
+}
+
+func TestSSHRunnerAbort(t *testing.T) {
+	runner, sshd := newTestRunner(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	exec, err := runCommand(ctx, runner, JobExecution{host: sshd.addr, command: "hang"}, ioutil.Discard, ioutil.Discard)
+	if err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if exec.exit_code != -1 {
+		t.Errorf("exit code %v, want -1", exec.exit_code)
+	}
+	if exec.duration < 200*time.Millisecond {
+		t.Errorf("returned after %v, before it was aborted", exec.duration)
+	}
+	select {
+	case sig := <-sshd.signals:
+		if sig != "KILL" {
+			t.Errorf("sent SIG%v, want SIGKILL", sig)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("no signal was sent")
+	}
+}
+
+func TestSSHRunnerUnknownHost(t *testing.T) {
+	runner, sshd := newTestRunner(t)
+	// a known_hosts file without the host in it
+	empty := filepath.Join(t.TempDir(), "known_hosts")
+	ioutil.WriteFile(empty, nil, 0600)
+	callback, err := knownhosts.New(empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner.config.HostKeyCallback = callback
+	if _, err := runner.Run(context.Background(), sshd.addr, "print 1", ioutil.Discard, ioutil.Discard); err == nil {
+		t.Error("ran a command on a host that isn't in known_hosts")
+	}
+}
+
+func TestThreadWriterChunks(t *testing.T) {
+	runner, sshd := newTestRunner(t)
+	recorder := &postRecorder{}
+	stdout := newThreadWriter("stdout", recorder.post)
+	// enough output for a few chunks
+	if _, err := runCommand(context.Background(), runner, JobExecution{host: sshd.addr, command: "print 1000"}, stdout, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	stdout.Close()
+
+	posts := recorder.all()
+	if len(posts) < 3 {
+		t.Fatalf("got %v posts, want the output split over at least 3", len(posts))
+	}
+	output := ""
+	for _, post := range posts {
+		if !strings.HasPrefix(post, "stdout:\n```") || !strings.HasSuffix(post, "```") {
+			t.Fatalf("post isn't a labelled code block: %q", post)
+		}
+		chunk := strings.TrimSuffix(strings.TrimPrefix(post, "stdout:\n```"), "```")
+		if len(chunk) > runner_chunk_size {
+			t.Errorf("chunk of %v bytes is over %v", len(chunk), runner_chunk_size)
+		}
+		output += chunk
+	}
+	// trailing newlines are trimmed from each chunk, so compare the lines
+	want := ""
+	for i := 1; i <= 1000; i++ {
+		want += fmt.Sprintf("line %v", i)
+	}
+	if strings.Replace(output, "\n", "", -1) != want {
+		t.Error("posted output doesn't match what the command printed")
+	}
+}
+
+func TestThreadWriterFlushesWhenQuiet(t *testing.T) {
+	defer func(interval time.Duration) { runner_flush_interval = interval }(runner_flush_interval)
+	runner_flush_interval = 50 * time.Millisecond
+	recorder := &postRecorder{}
+	w := newThreadWriter("stdout", recorder.post)
+	defer w.Close()
+	w.Write([]byte("starting\n"))
+	// nothing else is written, so only the ticker can post it
+	deadline := time.Now().Add(5 * time.Second)
+	for len(recorder.all()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if posts := recorder.all(); len(posts) != 1 || posts[0] != "stdout:\n```starting```" {
+		t.Errorf("got posts %q, want the line posted without another write", posts)
+	}
+}
+
+// hangingRunner runs every command until it's cancelled.
+type hangingRunner struct{}
+
+func (hangingRunner) Run(ctx context.Context, host, command string, stdout, stderr io.Writer) (int, error) {
+	<-ctx.Done()
+	return -1, ctx.Err()
+}
+
+func TestStopRightAfterStart(t *testing.T) {
+	inTempDir(t)
+	resetSyncState(t)
+	stubSlack(t)
+	defer func(runner CommandRunner) { command_runner = runner }(command_runner)
+	command_runner = hangingRunner{}
+	exec := JobExecution{exec_id: 7, job_id: 1, run_user: "jsmith", host: "db1", command: "hang", start_time: time.Now()}
+
+	// the stop comes in before the runner's goroutine gets going
+	state_mutex.Lock()
+	execution_log = append(execution_log, exec)
+	startExecution(exec)
+	stopped := abortExecution(exec.exec_id, "jdoe", true, "wrong host")
+	state_mutex.Unlock()
+	if !stopped {
+		t.Fatal("abortExecution found nothing to stop")
+	}
+	background.Wait()
+	exec, _ = findExecution(7)
+	if exec.runner_state != "aborted" || exec.stopped_by != "jdoe" {
+		t.Errorf("execution ended up %+v, want aborted by @jdoe", exec)
+	}
+}
+
+func TestShutdownAbortsRunningExecutions(t *testing.T) {
+	inTempDir(t)
+	resetSyncState(t)
+	stubSlack(t)
+	defer func(runner CommandRunner, stop chan struct{}) { command_runner, stopping = runner, stop }(command_runner, stopping)
+	command_runner, stopping = hangingRunner{}, make(chan struct{})
+	defer func(execs map[int]JobExecution) { floating_execs = execs }(floating_execs)
+	floating_execs = make(map[int]JobExecution)
+
+	state_mutex.Lock()
+	for id := 1; id <= 3; id++ {
+		exec := JobExecution{exec_id: id, job_id: 1, run_user: "jsmith", host: "db1", command: "hang", start_time: time.Now()}
+		floating_execs[id] = exec
+		execution_log = append(execution_log, exec)
+		startExecution(exec)
+	}
+	state_mutex.Unlock()
+	shutdown()
+
+	for id := 1; id <= 3; id++ {
+		exec, _ := findExecution(id)
+		if exec.end_time.IsZero() || exec.runner_state != "aborted" || exec.stopped_by != "pharbot" || exec.stop_reason != "shutdown" {
+			t.Errorf("execution %v after shutdown: %+v, want it aborted by pharbot for the shutdown", id, exec)
+		}
+	}
+	if len(floating_execs) != 0 {
+		t.Errorf("%v executions still running after shutdown", len(floating_execs))
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// Scheduled executions. A schedule doesn't run anything by itself: when it
+// fires, the person who made it is DM'd the usual Start Job / Cancel
+// confirmation, pre-filled from the job's last execution. If nobody has
+// started it once the window is up, the job's backup owner is asked instead.
+// Schedules live in schedules.json and use the server's local time.
+
+const (
+	schedules_file		= "schedules.json"
+	default_schedule_window	= 60
+)
+
+type Schedule struct {
+	id		int
+	job_id		int
+	cron_expr	string
+	cron		*CronSchedule
+	window		int
+	user_id		string
+	user		string
+	created_time	time.Time
+	last_fired	time.Time
+}
+
+type scheduleJSON struct {
+	ID		int		`json:"id"`
+	JobID		int		`json:"job_id"`
+	Cron		string		`json:"cron"`
+	Window		int		`json:"window_minutes"`
+	UserID		string		`json:"user_id"`
+	User		string		`json:"user"`
+	Created		time.Time	`json:"created"`
+	LastFired	time.Time	`json:"last_fired"`
+}
+
+var (
+	schedules	map[int]*Schedule	= make(map[int]*Schedule)
+	schedule_mutex	sync.Mutex
+	// executions that came from a schedule, so whoever starts them becomes the run user
+	scheduled_execs	map[int]int		= make(map[int]int)
+)
+
+func LoadSchedules() {
+	b, err := ioutil.ReadFile(schedules_file)
+	if err != nil {
+		return
+	}
+	saved := []scheduleJSON{}
+	if err := json.Unmarshal(b, &saved); err != nil {
+		fmt.Printf("[ERROR] Unable to parse %v: %v\n", schedules_file, err)
+		return
+	}
+	for _, v := range saved {
+		cron, err := parseCron(v.Cron)
+		if err != nil {
+			fmt.Printf("[ERROR] Ignoring schedule %v ('%v'): %v\n", v.ID, v.Cron, err)
+			continue
+		}
+		if v.Window <= 0 {
+			// a window of 0 would escalate the moment the schedule fired
+			v.Window = default_schedule_window
+		}
+		schedules[v.ID] = &Schedule{id: v.ID, job_id: v.JobID, cron_expr: v.Cron, cron: cron, window: v.Window, user_id: v.UserID,
+			user: v.User, created_time: v.Created, last_fired: v.LastFired}
+	}
+	fmt.Printf("[INFO] Loaded %v schedules\n", len(schedules))
+}
+
+// saveSchedules must be called with schedule_mutex held.
+func saveSchedules() error {
+	saved := []scheduleJSON{}
+	for _, v := range schedules {
+		saved = append(saved, scheduleJSON{v.id, v.job_id, v.cron_expr, v.window, v.user_id, v.user, v.created_time, v.last_fired})
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].ID < saved[j].ID })
+	b, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := schedules_file + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, schedules_file)
+}
+
+// RunScheduler checks the schedules at the top of every minute. It never returns.
+func RunScheduler() {
+	for {
+		now := time.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		if !sleepUnlessStopping(next.Sub(now)) {
+			return
+		}
+		fireSchedules(next)
+	}
+}
+
+func fireSchedules(now time.Time) {
+	schedule_mutex.Lock()
+	due := []Schedule{}
+	for _, v := range schedules {
+		if v.cron.Matches(now) && !v.last_fired.Equal(now) {
+			v.last_fired = now
+			due = append(due, *v)
+		}
+	}
+	if len(due) > 0 {
+		if err := saveSchedules(); err != nil {
+			fmt.Printf("[ERROR] Unable to save %v: %v\n", schedules_file, err)
+		}
+	}
+	schedule_mutex.Unlock()
+	for _, v := range due {
+		fireSchedule(v)
+	}
+}
+
+func sendDirectMessage(user_id, msg string, attachments []slack.Attachment) error {
+	_, _, channel, err := api.OpenIMChannel(user_id)
+	if err != nil {
+		return err
+	}
+	_, _, err = api.PostMessage(channel, msg, slack.PostMessageParameters{Attachments: attachments})
+	return err
+}
+
+func fireSchedule(sched Schedule) {
+	fmt.Printf("[INFO] Schedule %v fired for job %v\n", sched.id, sched.job_id)
+	var exec JobExecution
+	var job ProdJob
+	var attachments []slack.Attachment
+	// set up the execution under the state lock, then message people without it
+	problem := func() string {
+		state_mutex.Lock()
+		defer state_mutex.Unlock()
+		exec = generateExecutionFromPreviousExecution(sched.job_id, sched.user)
+		if exec.exec_id < 0 {
+			return fmt.Sprintf("Schedule %v was due to run job %v, but the job has no executions to copy. Run it by hand with `/prod start`.", sched.id, sched.job_id)
+		}
+		job = getProdJob(sched.job_id)
+		if (job == ProdJob{}) || job.archived {
+			return fmt.Sprintf("Schedule %v was due to run job %v, but the job no longer exists or has been archived. Cancel the schedule with `/prod schedules cancel %v`.", sched.id, sched.job_id, sched.id)
+		}
+		if violations := checkPolicy(exec); len(violations) > 0 {
+			return fmt.Sprintf("Schedule %v was due to run job %v, but its last execution breaks the job's policy:\n%vRun it by hand with `/prod start`.", sched.id, sched.job_id, serializePolicyViolations(violations))
+		}
+		attachments = startAttachments(&exec, job)
+		floating_execs[exec.exec_id] = exec
+		return ""
+	}()
+	if problem != "" {
+		sendDirectMessage(sched.user_id, problem, nil)
+		return
+	}
+	schedule_mutex.Lock()
+	scheduled_execs[exec.exec_id] = sched.id
+	schedule_mutex.Unlock()
+	msg := fmt.Sprintf("It's time for scheduled job %v (schedule %v). If nobody starts it in the next %v minutes, @%v will be asked to.\n%v", job.job_id, sched.id, sched.window, job.backup_owner, start_confirmation_text)
+	if err := sendDirectMessage(sched.user_id, msg, attachments); err != nil {
+		fmt.Printf("[ERROR] Unable to DM @%v for schedule %v: %v\n", sched.user, sched.id, err)
+	}
+	time.AfterFunc(time.Duration(sched.window)*time.Minute, func() { escalateSchedule(sched, exec.exec_id) })
+}
+
+// escalateSchedule asks the job's backup owner to run a scheduled execution
+// that's still waiting to be started.
+func escalateSchedule(sched Schedule, exec_id int) {
+	state_mutex.Lock()
+	exec, ok := floating_execs[exec_id]
+	if !ok || !exec.start_time.IsZero() {
+		state_mutex.Unlock()
+		return
+	}
+	job := getProdJob(exec.job_id)
+	attachments := startAttachments(&exec, job)
+	state_mutex.Unlock()
+	fmt.Printf("[INFO] Execution %v from schedule %v wasn't started by @%v, escalating to @%v\n", exec_id, sched.id, sched.user, job.backup_owner)
+	executions_expired_total.Inc()
+	msg := fmt.Sprintf("@%v hasn't started scheduled job %v (schedule %v) in the last %v minutes. As its backup owner, could you take it?\n%v", sched.user, job.job_id, sched.id, sched.window, start_confirmation_text)
+	if user_id := lookupUserID(job.backup_owner); user_id != "" {
+		if err := sendDirectMessage(user_id, msg, attachments); err == nil {
+			return
+		} else {
+			fmt.Printf("[ERROR] Unable to DM @%v for schedule %v: %v\n", job.backup_owner, sched.id, err)
+		}
+	}
+	// can't reach them directly, so fall back to making some noise in #prod
+	params := slack.PostMessageParameters{LinkNames: 1}
+	api.PostMessage(prod_channel_id, fmt.Sprintf("@%v @%v: scheduled job %v (%v) hasn't been started. Please run `/prod start %v`.", sched.user, job.backup_owner, job.job_id, job.summary, job.job_id), params)
+}
+
+func lookupUserID(name string) string {
+	users, err := api.GetUsers()
+	if err != nil {
+		fmt.Printf("[ERROR] Unable to list users: %v\n", err)
+		return ""
+	}
+	for _, u := range users {
+		if u.Name == name {
+			return u.ID
+		}
+	}
+	return ""
+}
+
+// claimScheduledExecution is called when a scheduled execution is started;
+// whoever clicked Start Job runs it, which may be the backup owner.
+func claimScheduledExecution(exec JobExecution, user string) JobExecution {
+	schedule_mutex.Lock()
+	defer schedule_mutex.Unlock()
+	if _, ok := scheduled_execs[exec.exec_id]; ok {
+		exec.run_user = user
+		delete(scheduled_execs, exec.exec_id)
+	}
+	return exec
+}
+
+func handleProdSchedule(s slack.SlashCommand, words []string) {
+	window := default_schedule_window
+	for i := 0; i < len(words); i++ {
+		if words[i] == "--window" && i+1 < len(words) {
+			n, err := strconv.Atoi(words[i+1])
+			if err != nil || n <= 0 {
+				rejectSlash(s, "invalid", fmt.Sprintf("Couldn't parse '%v' as a number of minutes", words[i+1]))
+				return
+			}
+			window = n
+			words = append(words[:i], words[i+2:]...)
+			break
+		}
+	}
+	if len(words) != 7 {
+		rejectSlash(s, "invalid", helptexts["schedule"])
+		return
+	}
+	job, ok := parseJobID(s, words[1])
+	if !ok {
+		return
+	}
+	job_id := job.job_id
+	if job.archived {
+		rejectSlash(s, "invalid", fmt.Sprintf("Job %v has been archived and can't be scheduled.", job_id))
+		return
+	}
+	if generateExecutionFromPreviousExecution(job_id, s.UserName).exec_id < 0 {
+		rejectSlash(s, "invalid", fmt.Sprintf("Job %v doesn't have any executions on record to copy. Run it once with `/prod start` first.", job_id))
+		return
+	}
+	expr := strings.Join(words[2:7], " ")
+	cron, err := parseCron(expr)
+	if err != nil {
+		rejectSlash(s, "invalid", fmt.Sprintf("Couldn't parse `%v`: %v", expr, err))
+		return
+	}
+	next := cron.Next(time.Now())
+	if next.IsZero() {
+		rejectSlash(s, "invalid", fmt.Sprintf("`%v` never fires", expr))
+		return
+	}
+
+	schedule_mutex.Lock()
+	sched := &Schedule{id: generateExecId() % 100000, job_id: job_id, cron_expr: expr, cron: cron, window: window, user_id: s.UserID, user: s.UserName, created_time: time.Now()}
+	for schedules[sched.id] != nil {
+		sched.id++
+	}
+	schedules[sched.id] = sched
+	err = saveSchedules()
+	schedule_mutex.Unlock()
+	if err != nil {
+		fmt.Printf("[ERROR] Unable to save %v: %v\n", schedules_file, err)
+	}
+	fmt.Printf("[INFO] @%v scheduled job %v at '%v' (schedule %v)\n", s.UserName, job_id, expr, sched.id)
+	reply := fmt.Sprintf("Scheduled job %v (%v) at `%v` as schedule %v. The next run is %v; I'll DM you then.", job_id, job.summary, expr, sched.id, next.Format("Mon Jan 2 15:04 MST"))
+	if err != nil {
+		reply += " I couldn't save it though, so it'll be lost on restart."
+	}
+	replyToSlash(s, reply)
+}
+
+func handleProdSchedules(s slack.SlashCommand, words []string) {
+	if len(words) == 1 {
+		replyToSlash(s, listSchedules())
+		return
+	}
+	if words[1] != "cancel" || len(words) != 3 {
+		rejectSlash(s, "invalid", helptexts["schedules"])
+		return
+	}
+	id, err := strconv.Atoi(words[2])
+	if err != nil {
+		rejectSlash(s, "invalid", fmt.Sprintf("Couldn't parse '%v' as a schedule ID", words[2]))
+		return
+	}
+	schedule_mutex.Lock()
+	sched, ok := schedules[id]
+	if !ok {
+		schedule_mutex.Unlock()
+		rejectSlash(s, "invalid", fmt.Sprintf("There's no schedule with ID %v", id))
+		return
+	}
+	if sched.user != s.UserName && !isProdAdmin(s.UserID, s.UserName) {
+		schedule_mutex.Unlock()
+		rejectSlash(s, "denied", fmt.Sprintf("Only @%v, who made schedule %v, or a prod admin can cancel it.", sched.user, id))
+		return
+	}
+	delete(schedules, id)
+	err = saveSchedules()
+	schedule_mutex.Unlock()
+	if err != nil {
+		fmt.Printf("[ERROR] Unable to save %v: %v\n", schedules_file, err)
+	}
+	fmt.Printf("[INFO] @%v cancelled schedule %v for job %v\n", s.UserName, id, sched.job_id)
+	replyToSlash(s, fmt.Sprintf("Cancelled schedule %v for job %v", id, sched.job_id))
+}
+
+func listSchedules() string {
+	schedule_mutex.Lock()
+	defer schedule_mutex.Unlock()
+	if len(schedules) == 0 {
+		return "There are no schedules. Make one with `/prod schedule`."
+	}
+	list := []*Schedule{}
+	for _, v := range schedules {
+		list = append(list, v)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+	lines := []string{}
+	now := time.Now()
+	for _, v := range list {
+		lines = append(lines, fmt.Sprintf("*%v*: job %v (%v) at `%v` by @%v, escalating after %v minutes; next run %v",
+			v.id, v.job_id, getProdJob(v.job_id).summary, v.cron_expr, v.user, v.window, v.cron.Next(now).Format("Mon Jan 2 15:04 MST")))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// The HTTP server, its health checks and shutdown. On SIGTERM (or SIGINT)
+// pharbot stops accepting connections, lets in-flight requests finish, aborts
+// the commands the runner is running, waits for them and the background loops
+// to wind down, then writes out whatever spreadsheet writes are still queued
+// before exiting.
+//
+// /healthz is for liveness: it's 200 as long as the process is serving, and
+// includes the last connectivity check results. /readyz is for load
+// balancers: it checks Slack, the spreadsheet and local storage (at most
+// every health_check_interval) and is 503 if any of them is down or we're
+// shutting down.
+
+const (
+	listen_addr		= ":3000"
+	shutdown_timeout	= 30 * time.Second
+	health_check_interval	= 15 * time.Second
+	// writes queued beyond this mean the spreadsheet has been unreachable for a while
+	max_pending_sheet_writes	= 500
+)
+
+type healthCheck struct {
+	OK		bool	`json:"ok"`
+	Error		string	`json:"error,omitempty"`
+	LatencyMS	int64	`json:"latency_ms"`
+}
+
+var (
+	shutting_down	int32
+	// closed on shutdown, so background loops know to stop
+	stopping	chan struct{}		= make(chan struct{})
+	background	sync.WaitGroup
+	started_time	time.Time		= time.Now()
+	health_mutex	sync.Mutex
+	health_checked	time.Time
+	health_results	map[string]healthCheck	= make(map[string]healthCheck)
+)
+
+// goBackground runs f in a goroutine that shutdown waits for.
+func goBackground(f func()) {
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		f()
+	}()
+}
+
+// sleepUnlessStopping waits for d, returning false if shutdown started first.
+func sleepUnlessStopping(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-stopping:
+		return false
+	}
+}
+
+func timedCheck(check func() error) healthCheck {
+	start := time.Now()
+	err := check()
+	result := healthCheck{OK: err == nil, LatencyMS: time.Since(start).Milliseconds()}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func checkStorage() error {
+	f, err := os.OpenFile(audit_journal_file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("audit journal isn't writable: %v", err)
+	}
+	f.Close()
+	if n := pendingSheetWrites(); n > max_pending_sheet_writes {
+		return fmt.Errorf("%v spreadsheet writes are queued", n)
+	}
+	return nil
+}
+
+// runHealthChecks returns the results of the connectivity checks, running
+// them again if the last ones are older than health_check_interval.
+func runHealthChecks(refresh bool) map[string]healthCheck {
+	health_mutex.Lock()
+	defer health_mutex.Unlock()
+	if refresh && time.Since(health_checked) > health_check_interval {
+		health_results = map[string]healthCheck{
+			"slack": timedCheck(func() error {
+				_, err := api.AuthTest()
+				return err
+			}),
+			"sheets": timedCheck(func() error {
+				if sheets_service == nil {
+					return fmt.Errorf("the spreadsheet isn't loaded")
+				}
+				sheetsThrottle()
+				_, err := sheets_service.Spreadsheets.Values.Get(spreadsheet_id, fmt.Sprintf("%v!A1:A1", job_list_tab.name)).Do()
+				return err
+			}),
+			"storage": timedCheck(checkStorage),
+		}
+		health_checked = time.Now()
+	}
+	results := make(map[string]healthCheck)
+	for k, v := range health_results {
+		results[k] = v
+	}
+	return results
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Status		string			`json:"status"`
+		Uptime		int64			`json:"uptime_seconds"`
+		PendingWrites	int			`json:"pending_sheet_writes"`
+		Checks		map[string]healthCheck	`json:"checks"`
+	}{"ok", int64(time.Since(started_time).Seconds()), pendingSheetWrites(), runHealthChecks(false)})
+}
+
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := runHealthChecks(true)
+	status, code := "ok", http.StatusOK
+	for _, c := range checks {
+		if !c.OK {
+			status, code = "unavailable", http.StatusServiceUnavailable
+		}
+	}
+	if atomic.LoadInt32(&shutting_down) == 1 {
+		status, code = "shutting down", http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Status	string			`json:"status"`
+		Checks	map[string]healthCheck	`json:"checks"`
+	}{status, checks})
+}
+
+// runServer serves until SIGTERM or SIGINT, then shuts down cleanly.
+func runServer() {
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/readyz", handleReadyz)
+	registerMetricsHandler()
+	srv := &http.Server{
+		Addr:			listen_addr,
+		ReadHeaderTimeout:	10 * time.Second,
+		ReadTimeout:		30 * time.Second,
+		// long enough for exports and the slower slash commands
+		WriteTimeout:		2 * time.Minute,
+		IdleTimeout:		2 * time.Minute,
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		sig := <-signals
+		fmt.Printf("[INFO] Got %v, shutting down\n", sig)
+		atomic.StoreInt32(&shutting_down, 1)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdown_timeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			fmt.Printf("[WARN] Gave up waiting for requests to finish: %v\n", err)
+		}
+		shutdown()
+		close(stopped)
+	}()
+
+	fmt.Println("[INFO] Server listening")
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		fmt.Printf("[ERROR] Server failed: %v\n", err)
+		os.Exit(1)
+	}
+	<-stopped
+}
+
+// shutdown stops what the runner is running, waits for the background
+// goroutines, writes out queued spreadsheet writes, and says what's being left
+// behind.
+func shutdown() {
+	close(stopping)
+	state_mutex.Lock()
+	for _, exec := range floating_execs {
+		// the runner finishes what it was running, recording why it stopped
+		if !exec.start_time.IsZero() && !abortExecution(exec.exec_id, "pharbot", true, "shutdown") {
+			fmt.Printf("[WARN] Execution %v of job %v (run by @%v) is still running; it will need to be stopped by hand\n", exec.exec_id, exec.job_id, exec.run_user)
+		}
+	}
+	unlockState()
+	done := make(chan struct{})
+	go func() {
+		background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(shutdown_timeout):
+		fmt.Println("[WARN] Gave up waiting for running commands and background work to finish")
+	}
+	// retryable failures stay queued, so give them a few goes
+	for i := 0; i < 3 && pendingSheetWrites() > 0; i++ {
+		FlushSheets()
+	}
+	if n := pendingSheetWrites(); n > 0 {
+		fmt.Printf("[ERROR] %v spreadsheet writes couldn't be made before exiting:\n", n)
+		dumpPendingSheetWrites()
+		return
+	}
+	fmt.Println("[INFO] Spreadsheet writes flushed")
+}
@@ -1,210 +1,131 @@
 package main
 
 import (
-        "encoding/json"
         "fmt"
-        "io/ioutil"
         "log"
-        "net/http"
-        "os"
 	"strings"
-        "strconv"
         "time"
 
-        "golang.org/x/net/context"
-        "golang.org/x/oauth2"
-        "golang.org/x/oauth2/google"
         "google.golang.org/api/sheets/v4"
 )
 
-// Retrieve a token, saves the token, then returns the generated client.
-func getClient(config *oauth2.Config) *http.Client {
-        tokFile := "token.json"
-        tok, err := tokenFromFile(tokFile)
+// openSheets connects to the spreadsheet and maps its columns. It fails now
+// rather than hang or fail on the first write.
+func openSheets() (*sheets.Service, error) {
+        client, err := newSheetsHTTPClient()
         if err != nil {
-                tok = getTokenFromWeb(config)
-                saveToken(tokFile, tok)
-        }
-        return config.Client(context.Background(), tok)
-}
-
-// Request a token from the web, then returns the retrieved token.
-func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
-        authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-        fmt.Printf("Go to the following link in your browser then type the "+
-                "authorization code: \n%v\n", authURL)
-
-        var authCode string
-        if _, err := fmt.Scan(&authCode); err != nil {
-                log.Fatalf("Unable to read authorization code: %v", err)
+                return nil, fmt.Errorf("unable to authenticate with Google Sheets: %v", err)
         }
 
-        tok, err := config.Exchange(oauth2.NoContext, authCode)
-        if err != nil {
-                log.Fatalf("Unable to retrieve token from web: %v", err)
-        }
-        return tok
-}
-
-// Retrieves a token from a local file.
-func tokenFromFile(file string) (*oauth2.Token, error) {
-        f, err := os.Open(file)
-        defer f.Close()
+        srv, err := sheets.New(client)
         if err != nil {
-                return nil, err
+                return nil, fmt.Errorf("unable to retrieve Sheets client: %v", err)
         }
-        tok := &oauth2.Token{}
-        err = json.NewDecoder(f).Decode(tok)
-        return tok, err
-}
 
-// Saves a token to a file path.
-func saveToken(path string, token *oauth2.Token) {
-        fmt.Printf("Saving credential file to: %s\n", path)
-        f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-        defer f.Close()
-        if err != nil {
-                log.Fatalf("Unable to cache oauth token: %v", err)
+        // reads and writes go by the column names in the header rows
+        if err := checkSheetSchemas(srv, map[*sheetTab]bool{job_edit_tab: true}); err != nil {
+                return nil, fmt.Errorf("the spreadsheet doesn't look right: %v", err)
         }
-        json.NewEncoder(f).Encode(token)
+        return srv, nil
 }
 
 func LoadSheets() {
-        b, err := ioutil.ReadFile("client_secret.json")
-        if err != nil {
-                log.Fatalf("Unable to read client secret file: %v", err)
-        }
-
-        // If modifying these scopes, delete your previously saved client_secret.json.
-        config, err := google.ConfigFromJSON(b, "https://www.googleapis.com/auth/spreadsheets")
+        srv, err := openSheets()
         if err != nil {
-                log.Fatalf("Unable to parse client secret file to config: %v", err)
+                log.Fatalf("%v", err)
         }
-        client := getClient(config)
+        sheets_service = srv
 
-        srv, err := sheets.New(client)
-        if err != nil {
-                log.Fatalf("Unable to retrieve Sheets client: %v", err)
-        }
-
-        // Prints the names and majors of students in a sample spreadsheet:
-        // https://docs.google.com/spreadsheets/d/1BxiMVs0XRA5nFMdKvBdBZjgmUUqptlbs74OgvE2upms/edit
-        spreadsheetId := "1B84DImukPyqhSMDJmpE_lFZakMrAktdPfxp-emrR6Gc"
-        readRange := "Run Job List!A3:G"
-        resp, err := srv.Spreadsheets.Values.Get(spreadsheetId, readRange).Do()
+        resp, err := srv.Spreadsheets.Values.Get(spreadsheet_id, job_list_tab.dataRange()).Do()
         if err != nil {
                 log.Fatalf("Unable to retrieve data from sheet: %v", err)
         }
+        job_values := resp.Values
 
         if len(resp.Values) == 0 {
                 fmt.Println("No data found.")
         } else {
                 for _, row := range resp.Values {
-                        job_id := -1
-                        phab_task := ""
-                        summary := ""
-                        owner := ""
-                        backup := ""
-                        lead_approver := ""
-                        diff_uri := ""
-                        if len(row) == 0 {
-                            continue
-                        }
-                        job_id, _ = strconv.Atoi(row[0].(string))
-                        if len(row) > 1 {
-                            phab_task = row[1].(string)
-                        }
-                        if len(row) > 2 {
-                            summary = row[2].(string)
+                        if job, ok := parseJobRow(row); ok {
+                                prod_jobs = append(prod_jobs, job)
                         }
-                        if len(row) > 3 {
-                            owner = row[3].(string)
-                        }
-                        if len(row) > 4 {
-                            backup = row[4].(string)
-                        }
-                        if len(row) > 5 {
-                            lead_approver = row[5].(string)
-                        }
-                        if len(row) > 6 {
-                            diff_uri = row[6].(string)
-                        }
-                        job := ProdJob{job_id: job_id, phab_task: phab_task, summary: summary, owner: owner, backup_owner: backup, lead_approver: lead_approver, diff_uri: diff_uri}
-                        prod_jobs = append(prod_jobs, job)
                 }
         }
 
-        readRange = "Execution Audit Log!A3:L"
-        resp, err = srv.Spreadsheets.Values.Get(spreadsheetId, readRange).Do()
+        resp, err = srv.Spreadsheets.Values.Get(spreadsheet_id, audit_log_tab.dataRange()).Do()
         if err != nil {
             log.Fatalf("Unable to retrieve data from sheet: %v", err)
         } else {
             for id, row := range resp.Values {
                 exec_id := id
-                start_time := time.Now()
-                end_time := time.Now()
-                job_id := -1
-                run_user := ""
-                one_off := false
-                writes := false
-                primary_read := false
-                host := ""
-                command := ""
-
-                if len(row) == 0 {
+                exec, ok := parseExecutionRow(row, exec_id)
+                if !ok {
                     continue
                 }
-                // TODO: figure out how to handle start
-                // start_time = row[0].(string)
-                if len(row) > 1 {
-                    // same with start
-                    // end_time = row[1].(string)
-                }
-                if len(row) > 2 {
-                    job_id, _ = strconv.Atoi(row[2].(string))
+                if cell := audit_log_tab.str(row, "artifacts"); cell != "" {
+                    execution_artifacts[exec_id] = parseArtifactCell(cell)
                 }
-                if len(row) > 3 {
-                    run_user = row[3].(string)
-                }
-                if len(row) > 4 {
-                    one_off = strings.ToLower(row[4].(string)) != "no"
-                }
-                if len(row) > 5 {
-                    writes = strings.ToLower(row[5].(string)) != "no"
-                }
-                if len(row) > 6 {
-                    primary_read = strings.ToLower(row[6].(string)) != "no"
-                }
-                if len(row) > 7 {
-                    host = row[7].(string)
-                }
-                if len(row) > 8 {
-                    command = row[8].(string)
-                }
-
-                exec := JobExecution{exec_id: exec_id, start_time: start_time, end_time: end_time, job_id: job_id, run_user: run_user, one_off: one_off, writes: writes, primary_read: primary_read, host: host, command: command}
 
                 execution_log = append(execution_log, exec)
             }
         }
+        // remember what the sheet looked like so syncs can tell who changed what
+        recordSheetState(job_values, resp.Values)
+
+        // Older spreadsheets don't have this tab, so don't die over it
+        resp, err = srv.Spreadsheets.Values.Get(spreadsheet_id, job_edit_tab.dataRange()).Do()
+        if err != nil {
+            fmt.Printf("Unable to retrieve job edit history: %v\n", err)
+        } else {
+            t := job_edit_tab
+            for _, row := range resp.Values {
+                job_id, ok := t.integer(row, "job_id")
+                if !ok {
+                    continue
+                }
+                job_edits = append(job_edits, JobEdit{edit_time: t.timestamp(row, "edit_time"), job_id: job_id, user: t.str(row, "user"), field: t.str(row, "field"), old_value: t.str(row, "old_value"), new_value: t.str(row, "new_value")})
+            }
+        }
 }
 
-func WriteExecution(exec JobExecution) {
-    b, err := ioutil.ReadFile("client_secret.json")
-    if err != nil {
-        log.Fatalf("Unable to read client secret file: %v", err)
+func parseJobRow(row []interface{}) (ProdJob, bool) {
+    if len(row) == 0 {
+        return ProdJob{}, false
     }
+    t := job_list_tab
+    job_id, ok := t.integer(row, "job_id")
+    if !ok {
+        job_id = -1
+    }
+    return ProdJob{job_id: job_id, phab_task: t.str(row, "phab_task"), summary: t.str(row, "summary"), owner: t.str(row, "owner"), backup_owner: t.str(row, "backup_owner"),
+        lead_approver: t.str(row, "lead_approver"), diff_uri: t.str(row, "diff_uri"), archived: t.boolean(row, "archived", false), template: t.str(row, "template")}, true
+}
 
-    config, _ := google.ConfigFromJSON(b, "https://www.googleapis.com/auth/spreadsheets")
-
-    c := getClient(config)
-
-    sheetsService, _ := sheets.New(c)
-
-    spreadsheetId := "1B84DImukPyqhSMDJmpE_lFZakMrAktdPfxp-emrR6Gc"
-
-    rangeData := "Execution Audit Log!A3:L"
+func parseExecutionRow(row []interface{}, exec_id int) (JobExecution, bool) {
+    if len(row) == 0 {
+        return JobExecution{}, false
+    }
+    t := audit_log_tab
+    job_id, ok := t.integer(row, "job_id")
+    if !ok {
+        job_id = -1
+    }
+    // blank cells are a no, as they always were; anything else that isn't clearly a no is a yes
+    flag := func(field string) bool {
+        return t.boolean(row, field, strings.TrimSpace(t.str(row, field)) != "")
+    }
+    exec := JobExecution{exec_id: exec_id, start_time: t.timestamp(row, "start_time"), end_time: t.timestamp(row, "end_time"), job_id: job_id, run_user: t.str(row, "run_user"),
+        one_off: flag("one_off"), writes: flag("writes"), primary_read: flag("primary_read"), host: t.str(row, "host"),
+        command: storedCommand(t.str(row, "command")), stopped_by: t.str(row, "stopped_by"), stop_reason: t.str(row, "stop_reason"), params: t.str(row, "params")}
+    if exit_code, ok := t.integer(row, "exit_code"); ok {
+        exec.runner_state = "exited"
+        exec.exit_code = exit_code
+        exec.duration, _ = time.ParseDuration(t.str(row, "duration"))
+    }
+    return exec, true
+}
 
+func WriteExecution(exec JobExecution) {
     is_one_off := ""
     if exec.one_off {
         is_one_off = "Yes"
@@ -224,125 +145,145 @@ func WriteExecution(exec JobExecution) {
         is_read = "No"
     }
 
-    var values [][]interface{}
-    var one_row []interface{}
-    values = append(values, one_row)
-    values[0] = append(values[0], exec.start_time)
-    values[0] = append(values[0], exec.end_time)
-    values[0] = append(values[0], exec.job_id)
-    values[0] = append(values[0], exec.run_user)
-    values[0] = append(values[0], is_one_off)
-    values[0] = append(values[0], is_write)
-    values[0] = append(values[0], is_read)
-    values[0] = append(values[0], exec.host)
-    values[0] = append(values[0], exec.command)
-
-    rb := &sheets.ValueRange{
-        Range: rangeData,
-        Values: values,
-    }
-
-    valueInputOption := "USER_ENTERED"
-    insertDataOption := "INSERT_ROWS"
-    ctx := context.Background()
-    resp, err := sheetsService.Spreadsheets.Values.Append(spreadsheetId, rangeData, rb).ValueInputOption(valueInputOption).InsertDataOption(insertDataOption).Context(ctx).Do()
-    if err != nil {
-        fmt.Printf("%v\n", err)
-    }
-    fmt.Printf("%v\n", resp)
+    // stopped_by, exit_code etc. are filled in as the execution finishes
+    row := audit_log_tab.makeRow(map[string]interface{}{
+        "start_time": exec.start_time,
+        "end_time": exec.end_time,
+        "job_id": exec.job_id,
+        "run_user": exec.run_user,
+        "one_off": is_one_off,
+        "writes": is_write,
+        "primary_read": is_read,
+        "host": exec.host,
+        "command": redactCommand(exec.command),
+        "params": redactCommand(exec.params),
+    })
+    queueSheetAppend(audit_log_tab.dataRange(), "USER_ENTERED", row)
 }
 
 func WriteProdJob(job ProdJob) {
-    b, err := ioutil.ReadFile("client_secret.json")
-    if err != nil {
-        log.Fatalf("Unable to read client secret file: %v", err)
-    }
-
-    config, _ := google.ConfigFromJSON(b, "https://www.googleapis.com/auth/spreadsheets")
-
-    c := getClient(config)
-
-    sheetsService, _ := sheets.New(c)
+    queueSheetAppend(job_list_tab.dataRange(), "USER_ENTERED", job_list_tab.makeRow(prodJobRow(job)))
+}
 
-    spreadsheetId := "1B84DImukPyqhSMDJmpE_lFZakMrAktdPfxp-emrR6Gc"
+func MarkExecCompleted(exec JobExecution) {
+    queueSheetUpdate("USER_ENTERED", func(r *sheetReader) ([]*sheets.ValueRange, error) {
+        row, err := findExecutionRow(r, exec)
+        if err != nil {
+            return nil, err
+        }
+        if row < 0 {
+            fmt.Printf("Couldn't find a row for execution %v in the Execution Audit Log\n", exec.exec_id)
+            return nil, nil
+        }
+        values := map[string]interface{}{"end_time": exec.end_time}
+        if exec.stopped_by != "" {
+            // forced stops also get who and why
+            values["stopped_by"] = exec.stopped_by
+            values["stop_reason"] = exec.stop_reason
+        }
+        if exec.runner_state != "" {
+            // and runner executions get their exit code and duration
+            values["exit_code"] = exec.exit_code
+            values["duration"] = exec.duration.Round(time.Second).String()
+        }
+        return audit_log_tab.cellUpdates(row, values), nil
+    })
+}
 
-    rangeData := "Run Job List!A3:G"
+func prodJobRow(job ProdJob) map[string]interface{} {
+    archived := "No"
+    if job.archived {
+        archived = "Yes"
+    }
+    return map[string]interface{}{"job_id": job.job_id, "phab_task": job.phab_task, "summary": job.summary, "owner": job.owner, "backup_owner": job.backup_owner,
+        "lead_approver": job.lead_approver, "diff_uri": job.diff_uri, "archived": archived, "template": job.template}
+}
 
-    var values [][]interface{}
-    var one_row []interface{}
-    values = append(values, one_row)
-    values[0] = append(values[0], job.job_id)
-    values[0] = append(values[0], job.phab_task)
-    values[0] = append(values[0], job.summary)
-    values[0] = append(values[0], job.owner)
-    values[0] = append(values[0], job.backup_owner)
-    values[0] = append(values[0], job.lead_approver)
-    values[0] = append(values[0], job.diff_uri)
+// UpdateProdJob rewrites the job's existing row in the Run Job List in place.
+func UpdateProdJob(job ProdJob) {
+    queueSheetUpdate("USER_ENTERED", func(r *sheetReader) ([]*sheets.ValueRange, error) {
+        values, err := r.get(job_list_tab.columnRange("job_id"))
+        if err != nil {
+            return nil, err
+        }
+        row := -1
+        for i, v := range values {
+            if len(v) == 0 {
+                continue
+            }
+            if val, ok := cellInt(v[0]); ok && val == job.job_id {
+                row = job_list_tab.dataRow(i)
+                break
+            }
+        }
+        if row < 0 {
+            fmt.Printf("Couldn't find a row for job %v in the Run Job List\n", job.job_id)
+            return nil, nil
+        }
+        return job_list_tab.cellUpdates(row, prodJobRow(job)), nil
+    })
+}
 
-    rb := &sheets.ValueRange{
-        Range: rangeData,
-        Values: values,
-    }
+func WriteJobEdit(edit JobEdit) {
+    row := job_edit_tab.makeRow(map[string]interface{}{"edit_time": edit.edit_time.Format("2006-01-02 15:04:05"), "job_id": edit.job_id, "user": edit.user,
+        "field": edit.field, "old_value": edit.old_value, "new_value": edit.new_value})
+    // RAW so the timestamp comes back exactly as we wrote it
+    queueSheetAppend(job_edit_tab.dataRange(), "RAW", row)
+}
 
-    valueInputOption := "USER_ENTERED"
-    insertDataOption := "INSERT_ROWS"
-    ctx := context.Background()
-    resp, err := sheetsService.Spreadsheets.Values.Append(spreadsheetId, rangeData, rb).ValueInputOption(valueInputOption).InsertDataOption(insertDataOption).Context(ctx).Do()
+// findExecutionRow returns the sheet row of the newest audit log entry for
+// exec's job, run user and host that started in the same second, or -1.
+func findExecutionRow(r *sheetReader, exec JobExecution) (int, error) {
+    t := audit_log_tab
+    values, err := r.get(t.dataRange())
     if err != nil {
-        fmt.Printf("%v\n", err)
+        return -1, err
+    }
+    for i := len(values) - 1; i >= 0; i-- {
+        row := values[i]
+        if job_id, _ := t.integer(row, "job_id"); job_id == exec.job_id && t.str(row, "run_user") == exec.run_user && t.str(row, "host") == exec.host &&
+            t.timestamp(row, "start_time").Unix() == exec.start_time.Unix() {
+            return t.dataRow(i), nil
+        }
     }
-    fmt.Printf("%v\n", resp)
+    return -1, nil
 }
 
-func MarkExecCompleted(exec JobExecution) {
-    b, err := ioutil.ReadFile("client_secret.json")
-    if err != nil {
-        log.Fatalf("Unable to read client secret file: %v", err)
+func serializeArtifactCell(artifacts []Artifact) string {
+    lines := []string{}
+    for _, a := range artifacts {
+        lines = append(lines, fmt.Sprintf("%v (@%v): %v", a.name, a.user, a.url))
     }
+    return strings.Join(lines, "\n")
+}
 
-    config, _ := google.ConfigFromJSON(b, "https://www.googleapis.com/auth/spreadsheets")
-
-    c := getClient(config)
-
-    sheetsService, _ := sheets.New(c)
-
-    spreadsheetId := "1B84DImukPyqhSMDJmpE_lFZakMrAktdPfxp-emrR6Gc"
-
-    rangeData := "Execution Audit Log!A3:L"
-
-    resp, _ := sheetsService.Spreadsheets.Values.Get(spreadsheetId, rangeData).Do()
-
-    row := 0
-
-    for i := range resp.Values {
-        if len(resp.Values[len(resp.Values)-1-i]) <= 2 {
+func parseArtifactCell(cell string) []Artifact {
+    artifacts := []Artifact{}
+    for _, line := range strings.Split(cell, "\n") {
+        i := strings.LastIndex(line, ": ")
+        if i < 0 {
             continue
         }
-        if val, _ := strconv.Atoi(resp.Values[len(resp.Values)-1-i][2].(string)); val == exec.job_id {
-           row = len(resp.Values) - i
-           break
-       }
-   }
-
-   row++
-   row++	// "try it" ~ afoley
-   rowData := "Execution Audit Log!B" + strconv.Itoa(row) + ":B" + strconv.Itoa(row)
-
-   var values [][]interface{}
-   var one_row []interface{}
-   values = append(values, one_row)
-   values[0] = append(values[0], exec.end_time)
-
-   rb := &sheets.ValueRange{
-       Range: rowData,
-       Values: values,
-   }
+        name, user := line[:i], ""
+        if j := strings.LastIndex(name, " (@"); j >= 0 && strings.HasSuffix(name, ")") {
+            name, user = name[:j], name[j+3:len(name)-1]
+        }
+        artifacts = append(artifacts, Artifact{name: name, url: line[i+2:], user: user})
+    }
+    return artifacts
+}
 
-   valueInputOption := "USER_ENTERED"
-   ctx := context.Background()
-   resp2, err := sheetsService.Spreadsheets.Values.Update(spreadsheetId, rowData, rb).ValueInputOption(valueInputOption).Context(ctx).Do()
-   if err != nil {
-      fmt.Printf("%v\n", err)
-   }
-   fmt.Printf("%v\n", resp2)
+// UpdateExecutionArtifacts rewrites the artifact links on exec's audit log row.
+func UpdateExecutionArtifacts(exec JobExecution, artifacts []Artifact) {
+    queueSheetUpdate("RAW", func(r *sheetReader) ([]*sheets.ValueRange, error) {
+        row, err := findExecutionRow(r, exec)
+        if err != nil {
+            return nil, err
+        }
+        if row < 0 {
+            fmt.Printf("Couldn't find a row for execution %v in the Execution Audit Log\n", exec.exec_id)
+            return nil, nil
+        }
+        return audit_log_tab.cellUpdates(row, map[string]interface{}{"artifacts": serializeArtifactCell(artifacts)}), nil
+    })
 }
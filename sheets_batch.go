@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/sheets/v4"
+)
+
+// All spreadsheet writes go through here. Instead of every write making its
+// own requests, they're queued and flushed every couple of seconds: queued
+// appends to the same tab go out as one Append, then queued updates go out as
+// one BatchUpdate. Appends always go first, so an update can find the row an
+// append in the same flush added. Requests are spaced out to stay under the
+// Sheets quota, and ones that hit the quota or a server error are retried on
+// the next flush rather than lost, up to sheets_max_attempts times; after
+// that they're dropped and logged so they can be redone by hand.
+
+const (
+	spreadsheet_id		= "1B84DImukPyqhSMDJmpE_lFZakMrAktdPfxp-emrR6Gc"
+	sheets_flush_interval	= 2 * time.Second
+	// the per-user quota is 60 requests a minute
+	sheets_request_interval	= time.Second
+	// about an hour of flushes
+	sheets_max_attempts	= 1800
+)
+
+type sheetAppend struct {
+	rng		string
+	input		string
+	row		[]interface{}
+	attempts	int
+}
+
+type sheetUpdate struct {
+	input		string
+	// resolve runs at flush time, after pending appends are written, and
+	// returns what to write; it returns nothing if there's nothing to do.
+	// If it can't read the sheet, the update is retried.
+	resolve		func(r *sheetReader) ([]*sheets.ValueRange, error)
+	attempts	int
+}
+
+// sheetReader caches reads for the duration of a flush so that several
+// updates looking for their rows don't each fetch the same range.
+type sheetReader struct {
+	cache	map[string][][]interface{}
+}
+
+var (
+	sheets_service		*sheets.Service
+	sheets_mutex		sync.Mutex
+	pending_appends		[]sheetAppend
+	pending_updates		[]sheetUpdate
+	sheets_flush_mutex	sync.Mutex
+	sheets_last_request	time.Time
+)
+
+func queueSheetAppend(rng, input string, row []interface{}) {
+	sheets_mutex.Lock()
+	pending_appends = append(pending_appends, sheetAppend{rng: rng, input: input, row: row})
+	sheets_mutex.Unlock()
+}
+
+func queueSheetUpdate(input string, resolve func(r *sheetReader) ([]*sheets.ValueRange, error)) {
+	sheets_mutex.Lock()
+	pending_updates = append(pending_updates, sheetUpdate{input: input, resolve: resolve})
+	sheets_mutex.Unlock()
+}
+
+func pendingSheetWrites() int {
+	sheets_mutex.Lock()
+	defer sheets_mutex.Unlock()
+	return len(pending_appends) + len(pending_updates)
+}
+
+// dumpPendingSheetWrites logs queued writes so they can be redone by hand.
+// Updates only know where they go once they're flushed, so they're just counted.
+func dumpPendingSheetWrites() {
+	sheets_mutex.Lock()
+	defer sheets_mutex.Unlock()
+	for _, a := range pending_appends {
+		fmt.Printf("  append to %v: %v\n", a.rng, a.row)
+	}
+	if len(pending_updates) > 0 {
+		fmt.Printf("  %v cell updates (end times, stop reasons, job edits or artifacts)\n", len(pending_updates))
+	}
+}
+
+// sheetsThrottle blocks until it's OK to make another Sheets request.
+func sheetsThrottle() {
+	sheets_mutex.Lock()
+	wait := time.Until(sheets_last_request.Add(sheets_request_interval))
+	if wait < 0 {
+		wait = 0
+	}
+	sheets_last_request = time.Now().Add(wait)
+	sheets_mutex.Unlock()
+	time.Sleep(wait)
+}
+
+// retryableSheetsError is true for errors worth trying again later: rate
+// limiting, server errors and anything that isn't an API error at all
+// (i.e. network trouble).
+func retryableSheetsError(err error) bool {
+	e := &googleapi.Error{}
+	if errors.As(err, &e) {
+		return e.Code == 429 || e.Code >= 500
+	}
+	return true
+}
+
+func (r *sheetReader) get(rng string) ([][]interface{}, error) {
+	if values, ok := r.cache[rng]; ok {
+		return values, nil
+	}
+	sheetsThrottle()
+	resp, err := sheets_service.Spreadsheets.Values.Get(spreadsheet_id, rng).Do()
+	if err != nil {
+		return nil, fmt.Errorf("reading %v: %w", rng, err)
+	}
+	r.cache[rng] = resp.Values
+	return resp.Values, nil
+}
+
+// retryAppends returns the appends to try again, dropping any that have
+// been tried too often.
+func retryAppends(batch []sheetAppend, err error) []sheetAppend {
+	retry := []sheetAppend{}
+	for _, a := range batch {
+		a.attempts++
+		if a.attempts >= sheets_max_attempts {
+			fmt.Printf("[ERROR] Dropping a row that couldn't be appended to %v after %v attempts: %v\n%v\n", a.rng, a.attempts, err, a.row)
+			sheet_write_failures_total.WithLabelValues("dropped").Inc()
+			continue
+		}
+		sheet_write_failures_total.WithLabelValues("retried").Inc()
+		retry = append(retry, a)
+	}
+	return retry
+}
+
+// retryUpdate returns the update to try again, or nothing if it's been
+// tried too often.
+func retryUpdate(u sheetUpdate, err error) []sheetUpdate {
+	u.attempts++
+	if u.attempts >= sheets_max_attempts {
+		fmt.Printf("[ERROR] Dropping a cell update after %v attempts: %v\n", u.attempts, err)
+		sheet_write_failures_total.WithLabelValues("dropped").Inc()
+		return nil
+	}
+	sheet_write_failures_total.WithLabelValues("retried").Inc()
+	return []sheetUpdate{u}
+}
+
+func RunSheetsFlusher() {
+	for sleepUnlessStopping(sheets_flush_interval) {
+		FlushSheets()
+	}
+}
+
+// FlushSheets writes everything queued so far, returning once it's done.
+// Anything that failed in a retryable way stays queued.
+func FlushSheets() {
+	sheets_flush_mutex.Lock()
+	defer sheets_flush_mutex.Unlock()
+	if sheets_service == nil {
+		return
+	}
+
+	sheets_mutex.Lock()
+	appends, updates := pending_appends, pending_updates
+	pending_appends, pending_updates = nil, nil
+	sheets_mutex.Unlock()
+	if len(appends) == 0 && len(updates) == 0 {
+		return
+	}
+
+	ctx := context.Background()
+	failed_appends := []sheetAppend{}
+	// group appends by range and input option, keeping them in order
+	for len(appends) > 0 {
+		first := appends[0]
+		batch, rest := []sheetAppend{}, []sheetAppend{}
+		for _, a := range appends {
+			if a.rng == first.rng && a.input == first.input {
+				batch = append(batch, a)
+			} else {
+				rest = append(rest, a)
+			}
+		}
+		appends = rest
+		rows := [][]interface{}{}
+		for _, a := range batch {
+			rows = append(rows, a.row)
+		}
+		sheetsThrottle()
+		rb := &sheets.ValueRange{Range: first.rng, Values: rows}
+		_, err := sheets_service.Spreadsheets.Values.Append(spreadsheet_id, first.rng, rb).ValueInputOption(first.input).InsertDataOption("INSERT_ROWS").Context(ctx).Do()
+		if err == nil {
+			continue
+		}
+		if retryableSheetsError(err) {
+			fmt.Printf("[WARN] Appending %v rows to %v failed, will retry: %v\n", len(rows), first.rng, err)
+			failed_appends = append(failed_appends, retryAppends(batch, err)...)
+		} else {
+			fmt.Printf("[ERROR] Dropping %v rows that couldn't be appended to %v: %v\n%v\n", len(rows), first.rng, err, rows)
+			sheet_write_failures_total.WithLabelValues("dropped").Add(float64(len(batch)))
+		}
+	}
+
+	failed_updates := []sheetUpdate{}
+	if len(failed_appends) > 0 {
+		// their rows might not be there yet, so hold the updates back too
+		failed_updates = updates
+		updates = nil
+	}
+	reader := &sheetReader{cache: make(map[string][][]interface{})}
+	for _, input := range []string{"USER_ENTERED", "RAW"} {
+		data := []*sheets.ValueRange{}
+		batch := []sheetUpdate{}
+		for _, u := range updates {
+			if u.input != input {
+				continue
+			}
+			resolved, err := u.resolve(reader)
+			if err == nil {
+				data = append(data, resolved...)
+				batch = append(batch, u)
+			} else if retryableSheetsError(err) {
+				fmt.Printf("[WARN] Unable to find where an update goes, will retry: %v\n", err)
+				failed_updates = append(failed_updates, retryUpdate(u, err)...)
+			} else {
+				fmt.Printf("[ERROR] Dropping an update: %v\n", err)
+				sheet_write_failures_total.WithLabelValues("dropped").Inc()
+			}
+		}
+		if len(data) == 0 {
+			continue
+		}
+		sheetsThrottle()
+		req := &sheets.BatchUpdateValuesRequest{Data: data, ValueInputOption: input}
+		_, err := sheets_service.Spreadsheets.Values.BatchUpdate(spreadsheet_id, req).Context(ctx).Do()
+		if err == nil {
+			continue
+		}
+		ranges := []string{}
+		for _, d := range data {
+			ranges = append(ranges, d.Range)
+		}
+		if retryableSheetsError(err) {
+			fmt.Printf("[WARN] Updating %v failed, will retry: %v\n", strings.Join(ranges, ", "), err)
+			for _, u := range batch {
+				failed_updates = append(failed_updates, retryUpdate(u, err)...)
+			}
+		} else {
+			fmt.Printf("[ERROR] Dropping updates to %v: %v\n", strings.Join(ranges, ", "), err)
+			sheet_write_failures_total.WithLabelValues("dropped").Add(float64(len(batch)))
+		}
+	}
+
+	if len(failed_appends) > 0 || len(failed_updates) > 0 {
+		sheets_mutex.Lock()
+		pending_appends = append(failed_appends, pending_appends...)
+		pending_updates = append(failed_updates, pending_updates...)
+		sheets_mutex.Unlock()
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestRetryableSheetsError(t *testing.T) {
+	tests := []struct {
+		err	error
+		want	bool
+	}{
+		{&googleapi.Error{Code: 429}, true},
+		{&googleapi.Error{Code: 503}, true},
+		{&googleapi.Error{Code: 400}, false},
+		{&googleapi.Error{Code: 403}, false},
+		// as sheetReader.get returns them
+		{fmt.Errorf("reading Run Job List!A3:A: %w", &googleapi.Error{Code: 500}), true},
+		{fmt.Errorf("reading Run Job List!A3:A: %w", &googleapi.Error{Code: 400}), false},
+		{errors.New("connection reset by peer"), true},
+	}
+	for _, test := range tests {
+		if got := retryableSheetsError(test.err); got != test.want {
+			t.Errorf("retryableSheetsError(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestSheetWritesGiveUp(t *testing.T) {
+	err := errors.New("quota exceeded")
+	appends := []sheetAppend{{rng: "Execution Audit Log!A3:O", attempts: 0}, {rng: "Execution Audit Log!A3:O", attempts: sheets_max_attempts - 1}}
+	retry := retryAppends(appends, err)
+	if len(retry) != 1 || retry[0].attempts != 1 {
+		t.Errorf("retryAppends kept %+v, want only the first append, on its second attempt", retry)
+	}
+
+	u := sheetUpdate{input: "RAW"}
+	for i := 1; i < sheets_max_attempts; i++ {
+		retried := retryUpdate(u, err)
+		if len(retried) != 1 {
+			t.Fatalf("gave up on an update after %v attempts, want %v", i, sheets_max_attempts)
+		}
+		u = retried[0]
+	}
+	if retried := retryUpdate(u, err); len(retried) != 0 {
+		t.Errorf("retried an update after %v attempts", sheets_max_attempts)
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+// Column layout of the spreadsheet tabs. Columns are found by their header
+// names rather than their position, so people can reorder or insert columns
+// in the sheet without breaking pharbot. LoadSheets checks the headers on
+// startup: a missing required column is fatal, anything else is a warning.
+// Every sync maps them again, in case columns moved while pharbot was running.
+// If a tab has no header row at all, the historical layout (the order below)
+// is assumed.
+
+type sheetColumn struct {
+	field		string
+	// header names accepted for this column; compared ignoring case, spaces and punctuation
+	names		[]string
+	required	bool
+}
+
+type sheetTab struct {
+	name		string
+	header_row	int
+	columns		[]sheetColumn
+	// field -> 0 based column index, for the columns that exist
+	index		map[string]int
+}
+
+var (
+	job_list_tab	= &sheetTab{name: "Run Job List", header_row: 2, columns: []sheetColumn{
+		{"job_id", []string{"Job ID", "ID"}, true},
+		{"phab_task", []string{"Phab Task", "Task"}, false},
+		{"summary", []string{"Summary"}, false},
+		{"owner", []string{"Owner"}, false},
+		{"backup_owner", []string{"Backup Owner", "Backup"}, false},
+		{"lead_approver", []string{"Lead Approver", "Approver"}, false},
+		{"diff_uri", []string{"Diff URI", "Diff"}, false},
+		{"archived", []string{"Archived"}, false},
+		{"template", []string{"Command Template", "Template"}, false},
+	}}
+	audit_log_tab	= &sheetTab{name: "Execution Audit Log", header_row: 2, columns: []sheetColumn{
+		{"start_time", []string{"Start Time", "Start", "Started"}, false},
+		{"end_time", []string{"End Time", "End", "Ended"}, true},
+		{"job_id", []string{"Job ID"}, true},
+		{"run_user", []string{"Run User", "User"}, true},
+		{"one_off", []string{"One Off", "Oneoff"}, false},
+		{"writes", []string{"Writes"}, false},
+		{"primary_read", []string{"Primary Read", "Primary Reads"}, false},
+		{"host", []string{"Host"}, true},
+		{"command", []string{"Command"}, false},
+		{"stopped_by", []string{"Stopped By"}, false},
+		{"stop_reason", []string{"Stop Reason"}, false},
+		{"exit_code", []string{"Exit Code"}, false},
+		{"duration", []string{"Duration"}, false},
+		{"artifacts", []string{"Artifacts"}, false},
+		{"params", []string{"Params", "Parameters"}, false},
+	}}
+	job_edit_tab	= &sheetTab{name: "Job Edit History", header_row: 1, columns: []sheetColumn{
+		{"edit_time", []string{"Time", "Edit Time"}, true},
+		{"job_id", []string{"Job ID"}, true},
+		{"user", []string{"User"}, true},
+		{"field", []string{"Field"}, true},
+		{"old_value", []string{"Old Value"}, false},
+		{"new_value", []string{"New Value"}, false},
+	}}
+)
+
+func normalizeHeader(s string) string {
+	out := []rune{}
+	for _, r := range strings.ToLower(s) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			out = append(out, r)
+		}
+	}
+	return string(out)
+}
+
+func columnLetter(i int) string {
+	letters := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		letters = string(rune('A'+(i-1)%26)) + letters
+	}
+	return letters
+}
+
+func (t *sheetTab) defaultIndex() map[string]int {
+	index := make(map[string]int)
+	for i, c := range t.columns {
+		index[c.field] = i
+	}
+	return index
+}
+
+func (t *sheetTab) defaultLayout() {
+	t.index = t.defaultIndex()
+}
+
+// mapColumns works out where the tab's columns are from its header row. It
+// returns an error if a required column is missing, and a list of warnings
+// otherwise.
+func (t *sheetTab) mapColumns(header []interface{}) (map[string]int, []string, error) {
+	warnings := []string{}
+	if len(header) == 0 {
+		return t.defaultIndex(), []string{fmt.Sprintf("%v has no header row (row %v); assuming the default column order", t.name, t.header_row)}, nil
+	}
+	positions := make(map[string]int)
+	for i, cell := range header {
+		if name := normalizeHeader(cellString(cell)); name != "" {
+			if _, dup := positions[name]; !dup {
+				positions[name] = i
+			}
+		}
+	}
+	index := make(map[string]int)
+	missing := []string{}
+	for i, c := range t.columns {
+		found := -1
+		for _, name := range c.names {
+			if pos, ok := positions[normalizeHeader(name)]; ok {
+				found = pos
+				break
+			}
+		}
+		if found < 0 {
+			if c.required {
+				missing = append(missing, c.names[0])
+			} else {
+				warnings = append(warnings, fmt.Sprintf("%v has no '%v' column; it won't be read or written", t.name, c.names[0]))
+			}
+			continue
+		}
+		if found != i {
+			warnings = append(warnings, fmt.Sprintf("%v: '%v' is in column %v rather than %v", t.name, c.names[0], columnLetter(found), columnLetter(i)))
+		}
+		index[c.field] = found
+	}
+	if len(missing) > 0 {
+		return nil, warnings, fmt.Errorf("%v is missing required columns: %v", t.name, strings.Join(missing, ", "))
+	}
+	return index, warnings, nil
+}
+
+// readSheetSchemas reads every tab's header row and works out its columns,
+// without changing the current mapping. Tabs listed in optional may not
+// exist at all; they're left out.
+func readSheetSchemas(srv *sheets.Service, optional map[*sheetTab]bool) (map[*sheetTab]map[string]int, []string, error) {
+	indexes := make(map[*sheetTab]map[string]int)
+	all_warnings := []string{}
+	for _, t := range []*sheetTab{job_list_tab, audit_log_tab, job_edit_tab} {
+		sheetsThrottle()
+		resp, err := srv.Spreadsheets.Values.Get(spreadsheet_id, fmt.Sprintf("%v!%v:%v", t.name, t.header_row, t.header_row)).Do()
+		if err != nil {
+			if optional[t] {
+				continue
+			}
+			return nil, all_warnings, fmt.Errorf("reading %v headers: %v", t.name, err)
+		}
+		header := []interface{}{}
+		if len(resp.Values) > 0 {
+			header = resp.Values[0]
+		}
+		index, warnings, err := t.mapColumns(header)
+		all_warnings = append(all_warnings, warnings...)
+		if err != nil {
+			return nil, all_warnings, err
+		}
+		indexes[t] = index
+	}
+	return indexes, all_warnings, nil
+}
+
+// applySheetSchemas switches the tabs over to new column mappings, returning
+// whether any of them moved. Optional tabs that couldn't be read keep what
+// they had, or get the default layout if they never had one. The sheet
+// flusher reads the mappings, so it's held off while they change.
+func applySheetSchemas(indexes map[*sheetTab]map[string]int) bool {
+	sheets_flush_mutex.Lock()
+	defer sheets_flush_mutex.Unlock()
+	changed := false
+	for _, t := range []*sheetTab{job_list_tab, audit_log_tab, job_edit_tab} {
+		index, ok := indexes[t]
+		if !ok {
+			if t.index == nil {
+				t.defaultLayout()
+			}
+			continue
+		}
+		if !reflect.DeepEqual(index, t.index) {
+			t.index = index
+			changed = true
+		}
+	}
+	return changed
+}
+
+// checkSheetSchemas reads every tab's header row and maps its columns.
+// Tabs listed in optional may not exist at all.
+func checkSheetSchemas(srv *sheets.Service, optional map[*sheetTab]bool) error {
+	indexes, warnings, err := readSheetSchemas(srv, optional)
+	for _, w := range warnings {
+		fmt.Printf("[WARN] %v\n", w)
+	}
+	if err != nil {
+		return err
+	}
+	applySheetSchemas(indexes)
+	return nil
+}
+
+// withIndex is a copy of the tab with another column mapping, for working
+// out ranges before the mapping is switched over.
+func (t *sheetTab) withIndex(index map[string]int) *sheetTab {
+	return &sheetTab{name: t.name, header_row: t.header_row, columns: t.columns, index: index}
+}
+
+func (t *sheetTab) width() int {
+	width := 0
+	for _, i := range t.index {
+		if i+1 > width {
+			width = i + 1
+		}
+	}
+	return width
+}
+
+// dataRange is every data row (everything below the header) of the mapped columns.
+func (t *sheetTab) dataRange() string {
+	return fmt.Sprintf("%v!A%v:%v", t.name, t.header_row+1, columnLetter(t.width()-1))
+}
+
+// columnRange is every data row of one column, e.g. "Run Job List!A3:A".
+func (t *sheetTab) columnRange(field string) string {
+	letter := columnLetter(t.index[field])
+	return fmt.Sprintf("%v!%v%v:%v", t.name, letter, t.header_row+1, letter)
+}
+
+// dataRow converts a 0 based index into the values of dataRange or
+// columnRange into a sheet row number.
+func (t *sheetTab) dataRow(i int) int {
+	return t.header_row + 1 + i
+}
+
+func (t *sheetTab) get(row []interface{}, field string) interface{} {
+	i, ok := t.index[field]
+	if !ok || i >= len(row) {
+		return nil
+	}
+	return row[i]
+}
+
+func (t *sheetTab) str(row []interface{}, field string) string {
+	return cellString(t.get(row, field))
+}
+
+func (t *sheetTab) integer(row []interface{}, field string) (int, bool) {
+	return cellInt(t.get(row, field))
+}
+
+func (t *sheetTab) boolean(row []interface{}, field string, def bool) bool {
+	return cellBool(t.get(row, field), def)
+}
+
+func (t *sheetTab) timestamp(row []interface{}, field string) time.Time {
+	return cellTime(t.get(row, field))
+}
+
+// makeRow lays values out in the tab's column order for appending. Fields
+// the tab doesn't have are dropped.
+func (t *sheetTab) makeRow(values map[string]interface{}) []interface{} {
+	row := make([]interface{}, t.width())
+	for i := range row {
+		row[i] = ""
+	}
+	for field, value := range values {
+		if i, ok := t.index[field]; ok {
+			row[i] = value
+		}
+	}
+	return row
+}
+
+// cellUpdates writes values into the given sheet row, one range per cell so
+// that columns pharbot doesn't know about are left alone.
+func (t *sheetTab) cellUpdates(row int, values map[string]interface{}) []*sheets.ValueRange {
+	data := []*sheets.ValueRange{}
+	for _, c := range t.columns {
+		value, ok := values[c.field]
+		i, exists := t.index[c.field]
+		if !ok || !exists {
+			continue
+		}
+		cell := fmt.Sprintf("%v!%v%v", t.name, columnLetter(i), row)
+		data = append(data, &sheets.ValueRange{Range: cell, Values: [][]interface{}{{value}}})
+	}
+	return data
+}
+
+// Cells come back as strings when formatted, but can be numbers or booleans
+// depending on how they were entered and read, so convert leniently.
+
+func cellString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+func cellInt(v interface{}) (int, bool) {
+	if f, ok := v.(float64); ok {
+		return int(f), f == math.Trunc(f)
+	}
+	s := strings.TrimSpace(strings.ReplaceAll(cellString(v), ",", ""))
+	if i, err := strconv.Atoi(s); err == nil {
+		return i, true
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil && f == math.Trunc(f) {
+		return int(f), true
+	}
+	return 0, false
+}
+
+// cellBool returns def for cells that are neither clearly yes nor clearly no
+func cellBool(v interface{}, def bool) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	}
+	switch strings.ToLower(strings.TrimSpace(cellString(v))) {
+	case "yes", "y", "true", "1", "x":
+		return true
+	case "no", "n", "false", "0":
+		return false
+	}
+	return def
+}
+
+var cell_time_layouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999 -0700 MST",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"1/2/2006 15:04:05",
+	"1/2/2006 15:04",
+	"1/2/2006",
+	"2006-01-02",
+}
+
+// cellTime returns the zero time for empty or unparseable cells, and for
+// Go's own zero time, which is what unfinished executions are written with.
+func cellTime(v interface{}) time.Time {
+	if f, ok := v.(float64); ok {
+		// a spreadsheet serial date: days since 1899-12-30
+		return time.Date(1899, 12, 30, 0, 0, 0, 0, time.Local).Add(time.Duration(f * float64(24*time.Hour)))
+	}
+	s := strings.TrimSpace(cellString(v))
+	// time.Time's String() adds a monotonic clock reading
+	if i := strings.Index(s, " m=+"); i >= 0 {
+		s = s[:i]
+	}
+	for _, layout := range cell_time_layouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			if t.Year() <= 1 {
+				return time.Time{}
+			}
+			return t
+		}
+	}
+	return time.Time{}
+}
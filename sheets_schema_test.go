@@ -0,0 +1,170 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMapColumns(t *testing.T) {
+	tab := &sheetTab{name: "Test", header_row: 1, columns: []sheetColumn{
+		{"id", []string{"Job ID", "ID"}, true},
+		{"owner", []string{"Owner"}, false},
+		{"backup", []string{"Backup Owner", "Backup"}, false},
+	}}
+	tests := []struct {
+		header		[]interface{}
+		index		map[string]int
+		warnings	int
+		ok		bool
+	}{
+		{[]interface{}{"Job ID", "Owner", "Backup Owner"}, map[string]int{"id": 0, "owner": 1, "backup": 2}, 0, true},
+		// case, spacing and punctuation don't matter, and alternative names work
+		{[]interface{}{"job_id", " OWNER ", "backup"}, map[string]int{"id": 0, "owner": 1, "backup": 2}, 0, true},
+		{[]interface{}{"Notes", "Backup", "ID", "Owner"}, map[string]int{"id": 2, "owner": 3, "backup": 1}, 3, true},
+		// the first of duplicate headers wins
+		{[]interface{}{"ID", "Owner", "Owner"}, map[string]int{"id": 0, "owner": 1}, 1, true},
+		{[]interface{}{}, map[string]int{"id": 0, "owner": 1, "backup": 2}, 1, true},
+		{[]interface{}{"Owner", "Backup"}, nil, 0, false},
+		{[]interface{}{float64(1), "Owner"}, nil, 0, false},
+	}
+	for _, test := range tests {
+		index, warnings, err := tab.mapColumns(test.header)
+		if (err == nil) != test.ok {
+			t.Errorf("mapColumns(%q) error = %v, want ok %v", test.header, err, test.ok)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if len(warnings) != test.warnings {
+			t.Errorf("mapColumns(%q) warnings = %q, want %v of them", test.header, warnings, test.warnings)
+		}
+		if len(index) != len(test.index) {
+			t.Errorf("mapColumns(%q) = %v, want %v", test.header, index, test.index)
+			continue
+		}
+		for field, i := range test.index {
+			if index[field] != i {
+				t.Errorf("mapColumns(%q) = %v, want %v", test.header, index, test.index)
+				break
+			}
+		}
+	}
+}
+
+func TestSheetRanges(t *testing.T) {
+	tab := &sheetTab{name: "Run Job List", header_row: 2, index: map[string]int{"job_id": 0, "owner": 27}}
+	if got := tab.dataRange(); got != "Run Job List!A3:AB" {
+		t.Errorf("dataRange() = %v", got)
+	}
+	if got := tab.columnRange("owner"); got != "Run Job List!AB3:AB" {
+		t.Errorf("columnRange(owner) = %v", got)
+	}
+	updates := tab.cellUpdates(7, map[string]interface{}{"owner": "jdoe", "missing": "x"})
+	if len(updates) != 0 {
+		// cellUpdates goes by the tab's columns, and this tab has none
+		t.Errorf("cellUpdates wrote %v ranges for a tab without columns", len(updates))
+	}
+	tab.columns = []sheetColumn{{"job_id", nil, true}, {"owner", nil, false}}
+	updates = tab.cellUpdates(7, map[string]interface{}{"owner": "jdoe", "missing": "x"})
+	if len(updates) != 1 || updates[0].Range != "Run Job List!AB7" {
+		t.Errorf("cellUpdates = %+v, want only AB7", updates)
+	}
+	if row := tab.makeRow(map[string]interface{}{"job_id": 5, "owner": "jdoe"}); len(row) != 28 || row[0] != 5 || row[27] != "jdoe" || row[1] != "" {
+		t.Errorf("makeRow = %q", row)
+	}
+}
+
+func TestCellInt(t *testing.T) {
+	tests := []struct {
+		v	interface{}
+		want	int
+		ok	bool
+	}{
+		{float64(12), 12, true},
+		{float64(12.5), 12, false},
+		{"12", 12, true},
+		{" 1,234 ", 1234, true},
+		{"12.0", 12, true},
+		{"12.5", 0, false},
+		{"twelve", 0, false},
+		{"", 0, false},
+		{nil, 0, false},
+	}
+	for _, test := range tests {
+		if got, ok := cellInt(test.v); got != test.want || ok != test.ok {
+			t.Errorf("cellInt(%#v) = %v, %v; want %v, %v", test.v, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestCellBool(t *testing.T) {
+	tests := []struct {
+		v	interface{}
+		def	bool
+		want	bool
+	}{
+		{"Yes", false, true},
+		{" y ", false, true},
+		{"TRUE", false, true},
+		{"x", false, true},
+		{"No", true, false},
+		{"0", true, false},
+		{true, false, true},
+		{false, true, false},
+		{float64(1), false, true},
+		{float64(0), true, false},
+		{"", true, true},
+		{"", false, false},
+		{"maybe", true, true},
+		{nil, true, true},
+	}
+	for _, test := range tests {
+		if got := cellBool(test.v, test.def); got != test.want {
+			t.Errorf("cellBool(%#v, %v) = %v, want %v", test.v, test.def, got, test.want)
+		}
+	}
+}
+
+func TestCellTime(t *testing.T) {
+	at := func(year int, month time.Month, day, hour, min, sec, nsec int) time.Time {
+		return time.Date(year, month, day, hour, min, sec, nsec, time.Local)
+	}
+	tests := []struct {
+		v	interface{}
+		want	time.Time
+	}{
+		{"2024-03-04T09:30:15.5Z", time.Date(2024, 3, 4, 9, 30, 15, 500000000, time.UTC)},
+		{"2024-03-04 09:30:15", at(2024, 3, 4, 9, 30, 15, 0)},
+		{"2024-03-04 09:30", at(2024, 3, 4, 9, 30, 0, 0)},
+		{"3/4/2024 09:30:15", at(2024, 3, 4, 9, 30, 15, 0)},
+		{"3/4/2024", at(2024, 3, 4, 0, 0, 0, 0)},
+		{"2024-03-04", at(2024, 3, 4, 0, 0, 0, 0)},
+		// how time.Time prints, monotonic clock and all
+		{"2024-03-04 09:30:15.25 +0000 UTC m=+12.000000001", time.Date(2024, 3, 4, 9, 30, 15, 250000000, time.UTC)},
+		// unfinished executions are written with the zero time
+		{"0001-01-01 00:00:00 +0000 UTC", time.Time{}},
+		// a serial date: noon on 2024-03-04
+		{float64(45355.5), at(2024, 3, 4, 12, 0, 0, 0)},
+		{"", time.Time{}},
+		{"soon", time.Time{}},
+		{nil, time.Time{}},
+	}
+	for _, test := range tests {
+		if got := cellTime(test.v); !got.Equal(test.want) {
+			t.Errorf("cellTime(%#v) = %v, want %v", test.v, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeHeader(t *testing.T) {
+	for _, name := range []string{"Job ID", "job_id", " JOB-ID ", "Job\nID"} {
+		if got := normalizeHeader(name); got != "jobid" {
+			t.Errorf("normalizeHeader(%q) = %q", name, got)
+		}
+	}
+	if got := strings.Join([]string{columnLetter(0), columnLetter(25), columnLetter(26), columnLetter(701), columnLetter(702)}, " "); got != "A Z AA ZZ AAA" {
+		t.Errorf("column letters = %v", got)
+	}
+}
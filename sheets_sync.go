@@ -0,0 +1,354 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Background sync with the spreadsheet. People add and fix jobs and
+// executions in the sheet by hand, so both tabs are re-read every couple of
+// minutes and merged into memory. For every job and execution we remember
+// what the sheet said last time we looked, and compare:
+//
+//   - the sheet changed but pharbot's copy didn't: someone edited the sheet, take their change
+//   - pharbot's copy changed but the sheet didn't: one of our writes is still queued, keep ours
+//   - both changed, differently: a conflict. Pharbot keeps its version and says so in #prod
+//
+// Tabs whose contents haven't changed since the last sync are skipped. The
+// sheet is read without holding state_mutex, which only goes around the
+// merge, so commands aren't held up by the Sheets API.
+
+const sheets_sync_interval = 2 * time.Minute
+
+type SyncConflict struct {
+	time	time.Time
+	what	string
+	sheet	string
+	pharbot	string
+}
+
+type syncResult struct {
+	jobs_added	int
+	jobs_updated	int
+	execs_added	int
+	execs_updated	int
+	conflicts	[]SyncConflict
+}
+
+// sheetSnapshot is what a sync read from the spreadsheet, to be merged.
+type sheetSnapshot struct {
+	indexes		map[*sheetTab]map[string]int
+	warnings	[]string
+	values		map[*sheetTab][][]interface{}
+}
+
+// guarded by state_mutex, like what they're merged into
+var (
+	// what the sheet last said about each job / execution (by exec id)
+	job_base	map[int]ProdJob		= make(map[int]ProdJob)
+	exec_base	map[int]string		= make(map[int]string)
+	sheet_hashes	map[string][32]byte	= make(map[string][32]byte)
+	last_sync	time.Time
+	synced_job_fields	[]string	= []string{"summary", "phab_task", "diff_uri", "owner", "backup_owner", "lead_approver", "template", "archived"}
+)
+
+// execSheetView is the part of an execution the audit log holds, as a
+// string, so executions from the sheet and from memory can be compared.
+func execSheetView(exec JobExecution) string {
+	unix := func(t time.Time) int64 {
+		if t.IsZero() {
+			return 0
+		}
+		return t.Unix()
+	}
+	exit := ""
+	if exec.runner_state != "" {
+		exit = fmt.Sprintf("%v in %v", exec.exit_code, exec.duration.Round(time.Second))
+	}
+	return fmt.Sprintf("start %v, end %v, job %v, user %v, oneoff %v, writes %v, primary read %v, host %v, command %v, stopped by %v (%v), exit %v, params %v",
+		unix(exec.start_time), unix(exec.end_time), exec.job_id, exec.run_user, exec.one_off, exec.writes, exec.primary_read, exec.host,
+		redactCommand(exec.command), exec.stopped_by, exec.stop_reason, exit, redactCommand(exec.params))
+}
+
+// executions are matched up between the sheet and memory by these
+func execKey(exec JobExecution) string {
+	start := int64(0)
+	if !exec.start_time.IsZero() {
+		start = exec.start_time.Unix() / 60
+	}
+	return fmt.Sprintf("%v|%v|%v|%v", exec.job_id, exec.run_user, exec.host, start)
+}
+
+// execRowKey is execKey to the second, for pairing an execution with exactly
+// its own row
+func execRowKey(exec JobExecution) string {
+	start := int64(0)
+	if !exec.start_time.IsZero() {
+		start = exec.start_time.Unix()
+	}
+	return fmt.Sprintf("%v|%v|%v|%v", exec.job_id, exec.run_user, exec.host, start)
+}
+
+func hashValues(values [][]interface{}) [32]byte {
+	b, _ := json.Marshal(values)
+	return sha256.Sum256(b)
+}
+
+// recordSheetState sets the bases from the sheet as loaded at startup.
+func recordSheetState(job_values, exec_values [][]interface{}) {
+	for _, row := range job_values {
+		if job, ok := parseJobRow(row); ok {
+			job_base[job.job_id] = job
+		}
+	}
+	for id, row := range exec_values {
+		if exec, ok := parseExecutionRow(row, id); ok {
+			exec_base[id] = execSheetView(exec)
+		}
+	}
+	sheet_hashes[job_list_tab.name] = hashValues(job_values)
+	sheet_hashes[audit_log_tab.name] = hashValues(exec_values)
+	last_sync = time.Now()
+}
+
+func RunSheetsSync() {
+	for {
+		time.Sleep(sheets_sync_interval)
+		snapshot, err := readSheets()
+		if err != nil {
+			fmt.Printf("[ERROR] Unable to sync with the spreadsheet: %v\n", err)
+			continue
+		}
+		state_mutex.Lock()
+		result := mergeSheets(snapshot, false)
+		state_mutex.Unlock()
+		for _, c := range result.conflicts {
+			reportSyncConflict(c)
+		}
+		if summary := result.summary(); summary != "" {
+			fmt.Printf("[INFO] Spreadsheet sync: %v\n", summary)
+		}
+	}
+}
+
+// syncSheets merges changes made in the spreadsheet into memory. With force,
+// tabs are merged even if they look unchanged. The caller holds state_mutex.
+func syncSheets(force bool) (syncResult, error) {
+	snapshot, err := readSheets()
+	if err != nil {
+		return syncResult{}, err
+	}
+	result := mergeSheets(snapshot, force)
+	for _, c := range result.conflicts {
+		reportSyncConflict(c)
+	}
+	return result, nil
+}
+
+// readSheets maps the tabs' columns afresh, since people move them around,
+// and reads the jobs and executions.
+func readSheets() (sheetSnapshot, error) {
+	snapshot := sheetSnapshot{values: make(map[*sheetTab][][]interface{})}
+	if sheets_service == nil {
+		return snapshot, fmt.Errorf("the spreadsheet isn't loaded")
+	}
+	// get our own queued writes in first so they don't look like conflicts
+	FlushSheets()
+
+	indexes, warnings, err := readSheetSchemas(sheets_service, map[*sheetTab]bool{job_edit_tab: true})
+	if err != nil {
+		return snapshot, fmt.Errorf("the spreadsheet doesn't look right: %v", err)
+	}
+	snapshot.indexes, snapshot.warnings = indexes, warnings
+	for _, t := range []*sheetTab{job_list_tab, audit_log_tab} {
+		sheetsThrottle()
+		resp, err := sheets_service.Spreadsheets.Values.Get(spreadsheet_id, t.withIndex(indexes[t]).dataRange()).Do()
+		if err != nil {
+			return snapshot, fmt.Errorf("reading %v: %v", t.name, err)
+		}
+		snapshot.values[t] = resp.Values
+	}
+	return snapshot, nil
+}
+
+// mergeSheets merges what readSheets read. The caller holds state_mutex.
+func mergeSheets(snapshot sheetSnapshot, force bool) syncResult {
+	result := syncResult{}
+	if applySheetSchemas(snapshot.indexes) {
+		fmt.Printf("[INFO] The spreadsheet's columns have changed; re-mapped them\n")
+		for _, w := range snapshot.warnings {
+			fmt.Printf("[WARN] %v\n", w)
+		}
+	}
+	for _, t := range []*sheetTab{job_list_tab, audit_log_tab} {
+		values := snapshot.values[t]
+		hash := hashValues(values)
+		if !force && hash == sheet_hashes[t.name] {
+			continue
+		}
+		if t == job_list_tab {
+			mergeJobs(values, &result)
+		} else {
+			mergeExecutions(values, &result)
+		}
+		sheet_hashes[t.name] = hash
+	}
+	last_sync = time.Now()
+	return result
+}
+
+func mergeJobs(values [][]interface{}, result *syncResult) {
+	for _, row := range values {
+		job, ok := parseJobRow(row)
+		if !ok || job.job_id < 0 {
+			continue
+		}
+		mem := getProdJob(job.job_id)
+		base, has_base := job_base[job.job_id]
+		job_base[job.job_id] = job
+		switch {
+		case mem == ProdJob{}:
+			prod_jobs = append(prod_jobs, job)
+			result.jobs_added++
+			fmt.Printf("[INFO] Job %v was added in the spreadsheet\n", job.job_id)
+			journalAppend("(spreadsheet)", "job.created", fmt.Sprintf("job %v", job.job_id), serializeJobChanges(ProdJob{}, job), "")
+			emitEvent("job.created", job)
+		case mem == job, !has_base:
+		case mem == base:
+			applySheetJobEdit(mem, job)
+			result.jobs_updated++
+		case job == base:
+			// our update hasn't made it to the sheet yet
+		default:
+			result.conflicts = append(result.conflicts, SyncConflict{time: time.Now(), what: fmt.Sprintf("job %v", job.job_id),
+				sheet: serializeJobChanges(mem, job), pharbot: serializeJobChanges(job, mem)})
+		}
+	}
+}
+
+// applySheetJobEdit takes a job edited in the sheet, recording the edits in
+// the job's history like any other.
+func applySheetJobEdit(old, job ProdJob) {
+	now := time.Now()
+	for _, field := range synced_job_fields {
+		if getJobField(old, field) == getJobField(job, field) {
+			continue
+		}
+		edit := JobEdit{edit_time: now, job_id: job.job_id, user: "(spreadsheet)", field: field, old_value: getJobField(old, field), new_value: getJobField(job, field)}
+		job_edits = append(job_edits, edit)
+		WriteJobEdit(edit)
+		journalJobEdit(edit)
+	}
+	setProdJob(job)
+	fmt.Printf("[INFO] Job %v was edited in the spreadsheet: %v\n", job.job_id, serializeJobChanges(old, job))
+	emitEvent("job.updated", job)
+}
+
+// serializeJobChanges lists the fields of to that differ from from
+func serializeJobChanges(from, to ProdJob) string {
+	changes := []string{}
+	for _, field := range synced_job_fields {
+		if v := getJobField(to, field); v != getJobField(from, field) {
+			changes = append(changes, fmt.Sprintf("%v=%v", field, v))
+		}
+	}
+	return strings.Join(changes, " ")
+}
+
+func mergeExecutions(values [][]interface{}, result *syncResult) {
+	// queue up the in-memory executions under their keys, oldest first, so
+	// duplicate keys pair up with sheet rows in order
+	by_key := make(map[string][]int)
+	for i, exec := range execution_log {
+		key := execKey(exec)
+		by_key[key] = append(by_key[key], i)
+	}
+	for _, row := range values {
+		exec, ok := parseExecutionRow(row, -1)
+		if !ok {
+			continue
+		}
+		key := execKey(exec)
+		if len(by_key[key]) == 0 {
+			exec.exec_id = generateExecId()
+			if cell := audit_log_tab.str(row, "artifacts"); cell != "" {
+				execution_artifacts[exec.exec_id] = parseArtifactCell(cell)
+			}
+			execution_log = append(execution_log, exec)
+			exec_base[exec.exec_id] = execSheetView(exec)
+			result.execs_added++
+			fmt.Printf("[INFO] Execution %v of job %v was added in the spreadsheet\n", exec.exec_id, exec.job_id)
+			journalExecution("(spreadsheet)", "execution.added_in_sheet", exec)
+			continue
+		}
+		mem := execution_log[by_key[key][0]]
+		by_key[key] = by_key[key][1:]
+
+		sheet_view, mem_view := execSheetView(exec), execSheetView(mem)
+		base, has_base := exec_base[mem.exec_id]
+		exec_base[mem.exec_id] = sheet_view
+		switch {
+		case sheet_view == mem_view, !has_base:
+		case mem_view == base:
+			edited := applySheetExecutionEdit(mem, exec)
+			setExecution(edited)
+			journalExecution("(spreadsheet)", "execution.edited_in_sheet", edited)
+			result.execs_updated++
+			fmt.Printf("[INFO] Execution %v was edited in the spreadsheet: %v\n", mem.exec_id, sheet_view)
+		case sheet_view == base:
+			// our update hasn't made it to the sheet yet
+		default:
+			result.conflicts = append(result.conflicts, SyncConflict{time: time.Now(), what: fmt.Sprintf("execution %v of job %v", mem.exec_id, mem.job_id),
+				sheet: sheet_view, pharbot: mem_view})
+		}
+	}
+}
+
+// applySheetExecutionEdit copies what the audit log holds onto mem, leaving
+// the things only pharbot knows about alone.
+func applySheetExecutionEdit(mem, sheet JobExecution) JobExecution {
+	if redactCommand(mem.command) != redactCommand(sheet.command) {
+		mem.command = sheet.command
+	}
+	mem.start_time, mem.end_time = sheet.start_time, sheet.end_time
+	mem.one_off, mem.writes, mem.primary_read = sheet.one_off, sheet.writes, sheet.primary_read
+	mem.stopped_by, mem.stop_reason = sheet.stopped_by, sheet.stop_reason
+	mem.runner_state, mem.exit_code, mem.duration = sheet.runner_state, sheet.exit_code, sheet.duration
+	mem.params = sheet.params
+	return mem
+}
+
+func reportSyncConflict(c SyncConflict) {
+	fmt.Printf("[WARN] Spreadsheet conflict on %v: sheet has %v; pharbot has %v\n", c.what, c.sheet, c.pharbot)
+	msg := fmt.Sprintf(":warning: The spreadsheet and pharbot both changed %v.\n*Spreadsheet:* %v\n*pharbot:* %v\npharbot is keeping its version; please redo the spreadsheet edit if it's still needed.", c.what, c.sheet, c.pharbot)
+	sendProdMessage(msg)
+}
+
+func (r syncResult) summary() string {
+	parts := []string{}
+	for _, p := range []struct {
+		n	int
+		what	string
+	}{{r.jobs_added, "jobs added"}, {r.jobs_updated, "jobs updated"}, {r.execs_added, "executions added"}, {r.execs_updated, "executions updated"}, {len(r.conflicts), "conflicts"}} {
+		if p.n > 0 {
+			parts = append(parts, fmt.Sprintf("%v %v", p.n, p.what))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func handleResync(user string) string {
+	fmt.Printf("[AUDIT] @%v forced a spreadsheet resync\n", user)
+	result, err := syncSheets(true)
+	if err != nil {
+		return fmt.Sprintf("Couldn't sync with the spreadsheet: %v", err)
+	}
+	summary := result.summary()
+	if summary == "" {
+		summary = "no changes"
+	}
+	return fmt.Sprintf("Synced with the spreadsheet: %v", summary)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// inTempDir runs the test in an empty directory, since merges write to the
+// audit journal.
+func inTempDir(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(dir) })
+}
+
+// resetSyncState empties everything a sync merges into, putting it back afterwards.
+func resetSyncState(t *testing.T) {
+	jobs, log, edits, artifacts := prod_jobs, execution_log, job_edits, execution_artifacts
+	jb, eb, hashes := job_base, exec_base, sheet_hashes
+	prod_jobs, execution_log, job_edits, execution_artifacts = nil, nil, nil, make(map[int][]Artifact)
+	job_base, exec_base, sheet_hashes = make(map[int]ProdJob), make(map[int]string), make(map[string][32]byte)
+	job_list_tab.defaultLayout()
+	audit_log_tab.defaultLayout()
+	job_edit_tab.defaultLayout()
+	t.Cleanup(func() {
+		prod_jobs, execution_log, job_edits, execution_artifacts = jobs, log, edits, artifacts
+		job_base, exec_base, sheet_hashes = jb, eb, hashes
+		sheets_mutex.Lock()
+		pending_appends, pending_updates = nil, nil
+		sheets_mutex.Unlock()
+	})
+}
+
+func execRow(exec JobExecution) []interface{} {
+	format := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format("2006-01-02 15:04:05")
+	}
+	return audit_log_tab.makeRow(map[string]interface{}{"start_time": format(exec.start_time), "end_time": format(exec.end_time), "job_id": exec.job_id,
+		"run_user": exec.run_user, "one_off": formatBool(exec.one_off), "writes": formatBool(exec.writes), "primary_read": formatBool(exec.primary_read),
+		"host": exec.host, "command": exec.command})
+}
+
+func TestExecKeys(t *testing.T) {
+	at := func(min, sec int) JobExecution {
+		return JobExecution{job_id: 1, run_user: "jsmith", host: "db1", start_time: time.Date(2024, 3, 4, 9, min, sec, 0, time.UTC)}
+	}
+	tests := []struct {
+		a, b		JobExecution
+		key, row_key	bool
+	}{
+		{at(0, 10), at(0, 10), true, true},
+		{at(0, 10), at(0, 40), true, false},
+		{at(0, 10), at(1, 10), false, false},
+		{at(0, 10), JobExecution{job_id: 2, run_user: "jsmith", host: "db1", start_time: at(0, 10).start_time}, false, false},
+		{JobExecution{job_id: 1}, JobExecution{job_id: 1}, true, true},
+	}
+	for _, test := range tests {
+		if got := execKey(test.a) == execKey(test.b); got != test.key {
+			t.Errorf("execKey %v vs %v: same = %v, want %v", execKey(test.a), execKey(test.b), got, test.key)
+		}
+		if got := execRowKey(test.a) == execRowKey(test.b); got != test.row_key {
+			t.Errorf("execRowKey %v vs %v: same = %v, want %v", execRowKey(test.a), execRowKey(test.b), got, test.row_key)
+		}
+	}
+}
+
+func TestMergeExecutions(t *testing.T) {
+	inTempDir(t)
+	resetSyncState(t)
+	at := func(hour, min, sec int) time.Time {
+		return time.Date(2024, 3, 4, hour, min, sec, 0, time.Local)
+	}
+	// the first two share an execKey, so they pair up with the rows in order
+	execution_log = []JobExecution{
+		{exec_id: 0, job_id: 1, run_user: "jsmith", host: "db1", start_time: at(9, 0, 10), command: "c1"},
+		{exec_id: 1, job_id: 1, run_user: "jsmith", host: "db1", start_time: at(9, 0, 40), command: "c2"},
+		{exec_id: 2, job_id: 2, run_user: "jdoe", host: "db2", start_time: at(10, 0, 0), command: "c3"},
+		{exec_id: 3, job_id: 3, run_user: "jdoe", host: "db3", start_time: at(11, 0, 0), command: "c4"},
+	}
+	values := [][]interface{}{}
+	for _, exec := range execution_log {
+		values = append(values, execRow(exec))
+	}
+	recordSheetState(nil, values)
+
+	// the second is fixed in the sheet
+	edited := execution_log[1]
+	edited.command = "c2 --fixed"
+	values[1] = execRow(edited)
+	// the third is changed in both
+	sheet := execution_log[2]
+	sheet.command = "c3 --sheet"
+	values[2] = execRow(sheet)
+	execution_log[2].end_time = at(10, 30, 0)
+	// the fourth has finished, but that hasn't been written yet
+	execution_log[3].end_time = at(11, 30, 0)
+	// and someone added one
+	added := JobExecution{job_id: 5, run_user: "jsmith", host: "db5", start_time: at(12, 0, 0), command: "c5"}
+	values = append(values, execRow(added))
+
+	result := syncResult{}
+	mergeExecutions(values, &result)
+	if result.execs_added != 1 || result.execs_updated != 1 || len(result.conflicts) != 1 {
+		t.Fatalf("merge: %v", result.summary())
+	}
+	if result.conflicts[0].what != "execution 2 of job 2" {
+		t.Errorf("conflict on %v, want execution 2 of job 2", result.conflicts[0].what)
+	}
+	want := []string{"c1", "c2 --fixed", "c3", "c4", "c5"}
+	if len(execution_log) != len(want) {
+		t.Fatalf("%v executions after the merge, want %v", len(execution_log), len(want))
+	}
+	for i, exec := range execution_log {
+		if exec.command != want[i] {
+			t.Errorf("execution %v has command %q, want %q", i, exec.command, want[i])
+		}
+	}
+	if !execution_log[2].end_time.Equal(at(10, 30, 0)) || !execution_log[3].end_time.Equal(at(11, 30, 0)) {
+		t.Error("pharbot's own changes were overwritten by the sheet")
+	}
+
+	// merging the same values again changes nothing
+	result = syncResult{}
+	mergeExecutions(values, &result)
+	if summary := result.summary(); summary != "" && summary != "1 conflicts" {
+		t.Errorf("second merge: %v", summary)
+	}
+}
+
+func TestMergeJobs(t *testing.T) {
+	inTempDir(t)
+	resetSyncState(t)
+	prod_jobs = []ProdJob{{job_id: 1, summary: "one", owner: "jsmith"}, {job_id: 2, summary: "two", owner: "jdoe"}, {job_id: 3, summary: "three", owner: "jdoe"}}
+	row := func(job ProdJob) []interface{} {
+		return job_list_tab.makeRow(prodJobRow(job))
+	}
+	values := [][]interface{}{row(prod_jobs[0]), row(prod_jobs[1]), row(prod_jobs[2])}
+	recordSheetState(values, nil)
+
+	edited := prod_jobs[0]
+	edited.summary = "one, fixed"
+	values[0] = row(edited)
+	sheet := prod_jobs[1]
+	sheet.owner = "someone"
+	values[1] = row(sheet)
+	prod_jobs[1].owner = "someone-else"
+	prod_jobs[2].summary = "three, not written yet"
+	values = append(values, row(ProdJob{job_id: 4, summary: "four", owner: "jsmith"}))
+
+	result := syncResult{}
+	mergeJobs(values, &result)
+	if result.jobs_added != 1 || result.jobs_updated != 1 || len(result.conflicts) != 1 {
+		t.Fatalf("merge: %v", result.summary())
+	}
+	if job := getProdJob(1); job.summary != "one, fixed" {
+		t.Errorf("job 1 is %+v, want the sheet's summary", job)
+	}
+	if len(job_edits) != 1 || job_edits[0].field != "summary" || job_edits[0].user != "(spreadsheet)" {
+		t.Errorf("job edits %+v, want the summary edit from the sheet", job_edits)
+	}
+	if job := getProdJob(2); job.owner != "someone-else" {
+		t.Errorf("job 2 is %+v, want pharbot's owner kept", job)
+	}
+	if job := getProdJob(3); job.summary != "three, not written yet" {
+		t.Errorf("job 3 is %+v, want pharbot's pending summary kept", job)
+	}
+	if job := getProdJob(4); job.summary != "four" {
+		t.Errorf("job 4 wasn't added: %+v", job)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseExecutionRowFlags(t *testing.T) {
+	tests := []struct {
+		cell	interface{}
+		want	bool
+	}{
+		{"Yes", true},
+		{"No", false},
+		{"no", false},
+		// blank and missing cells in old rows were always a no
+		{"", false},
+		{" ", false},
+		{nil, false},
+		{"unsure", true},
+		{true, true},
+	}
+	for _, test := range tests {
+		values := testExecutionRows(map[string]interface{}{"job_id": 1, "run_user": "jsmith", "host": "db1", "one_off": test.cell, "writes": test.cell, "primary_read": test.cell})
+		if test.cell == nil {
+			values[0] = values[0][:audit_log_tab.index["one_off"]]
+		}
+		exec, _ := parseExecutionRow(values[0], 0)
+		if exec.one_off != test.want || exec.writes != test.want || exec.primary_read != test.want {
+			t.Errorf("flags in %#v: one off %v, writes %v, primary read %v; want %v", test.cell, exec.one_off, exec.writes, exec.primary_read, test.want)
+		}
+	}
+}
+
+func TestFindExecutionRow(t *testing.T) {
+	at := func(min int) time.Time {
+		return time.Date(2024, 3, 4, 9, min, 0, 0, time.Local)
+	}
+	row := func(start time.Time, host string) map[string]interface{} {
+		return map[string]interface{}{"start_time": start.Format("2006-01-02 15:04:05"), "job_id": 1, "run_user": "jsmith", "host": host}
+	}
+	// the same job run again by the same user on the same host
+	values := testExecutionRows(row(at(0), "db1"), row(at(5), "db1"), row(at(10), "db2"))
+	r := &sheetReader{cache: map[string][][]interface{}{audit_log_tab.dataRange(): values}}
+	tests := []struct {
+		exec	JobExecution
+		want	int
+	}{
+		{JobExecution{job_id: 1, run_user: "jsmith", host: "db1", start_time: at(0)}, audit_log_tab.dataRow(0)},
+		{JobExecution{job_id: 1, run_user: "jsmith", host: "db1", start_time: at(5).Add(300 * time.Millisecond)}, audit_log_tab.dataRow(1)},
+		{JobExecution{job_id: 1, run_user: "jsmith", host: "db2", start_time: at(10)}, audit_log_tab.dataRow(2)},
+		{JobExecution{job_id: 1, run_user: "jsmith", host: "db1", start_time: at(10)}, -1},
+		{JobExecution{job_id: 2, run_user: "jsmith", host: "db1", start_time: at(0)}, -1},
+	}
+	for _, test := range tests {
+		if got, err := findExecutionRow(r, test.exec); got != test.want || err != nil {
+			t.Errorf("findExecutionRow(%v) = %v, %v; want %v", execRowKey(test.exec), got, err, test.want)
+		}
+	}
+}
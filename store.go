@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Local storage for jobs and executions, in a bbolt database file
+// (pharbot.db, or PHARBOT_DB). Jobs are keyed by job ID, and executions by
+// their full start time, job, run user and host, so importing the same
+// spreadsheet rows again finds the records from last time rather than adding
+// duplicates, even if other cells were fixed in between.
+
+const default_store_file = "pharbot.db"
+
+var (
+	jobs_bucket		= []byte("jobs")
+	executions_bucket	= []byte("executions")
+)
+
+type Store struct {
+	db	*bolt.DB
+}
+
+type jobRecord struct {
+	JobID		int	`json:"job_id"`
+	PhabTask	string	`json:"phab_task"`
+	Summary		string	`json:"summary"`
+	Owner		string	`json:"owner"`
+	BackupOwner	string	`json:"backup_owner"`
+	LeadApprover	string	`json:"lead_approver"`
+	DiffURI		string	`json:"diff_uri"`
+	Archived	bool	`json:"archived"`
+	Template	string	`json:"template,omitempty"`
+}
+
+type artifactRecord struct {
+	Name	string		`json:"name"`
+	URL	string		`json:"url"`
+	User	string		`json:"user,omitempty"`
+	Added	time.Time	`json:"added,omitempty"`
+}
+
+type execRecord struct {
+	ExecID		int			`json:"exec_id"`
+	JobID		int			`json:"job_id"`
+	StartTime	time.Time		`json:"start_time"`
+	EndTime		time.Time		`json:"end_time"`
+	RunUser		string			`json:"run_user"`
+	OneOff		bool			`json:"one_off"`
+	Writes		bool			`json:"writes"`
+	PrimaryRead	bool			`json:"primary_read"`
+	Host		string			`json:"host"`
+	Command		string			`json:"command"`
+	Params		string			`json:"params,omitempty"`
+	StoppedBy	string			`json:"stopped_by,omitempty"`
+	StopReason	string			`json:"stop_reason,omitempty"`
+	PolicyOverride	string			`json:"policy_override,omitempty"`
+	RunnerState	string			`json:"runner_state,omitempty"`
+	ExitCode	int			`json:"exit_code,omitempty"`
+	Duration	time.Duration		`json:"duration,omitempty"`
+	Artifacts	[]artifactRecord	`json:"artifacts,omitempty"`
+}
+
+func storePath() string {
+	if path := os.Getenv("PHARBOT_DB"); path != "" {
+		return path
+	}
+	return default_store_file
+}
+
+func openStore(path string, readonly bool) (*Store, error) {
+	if _, err := os.Stat(path); readonly && err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: readonly})
+	if err != nil {
+		return nil, err
+	}
+	if !readonly {
+		err = db.Update(func(tx *bolt.Tx) error {
+			for _, b := range [][]byte{jobs_bucket, executions_bucket} {
+				if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func jobKey(job_id int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(job_id))
+	return key
+}
+
+// execStoreKey is the execution's start time to the nanosecond, then its job,
+// run user and host. Executions that share all of those are told apart by
+// their order in the sheet: the nth after the first gets "|n" on the end.
+func execStoreKey(exec JobExecution, repeat int) []byte {
+	key := fmt.Sprintf("%v|%v|%v|%v", exec.start_time.UTC().Format(time.RFC3339Nano), exec.job_id, exec.run_user, exec.host)
+	if repeat > 0 {
+		key += fmt.Sprintf("|%v", repeat)
+	}
+	return []byte(key)
+}
+
+func newJobRecord(job ProdJob) jobRecord {
+	return jobRecord{job.job_id, job.phab_task, job.summary, job.owner, job.backup_owner, job.lead_approver, job.diff_uri, job.archived, job.template}
+}
+
+func (r jobRecord) job() ProdJob {
+	return ProdJob{job_id: r.JobID, phab_task: r.PhabTask, summary: r.Summary, owner: r.Owner, backup_owner: r.BackupOwner, lead_approver: r.LeadApprover,
+		diff_uri: r.DiffURI, archived: r.Archived, template: r.Template}
+}
+
+func newExecRecord(exec JobExecution, artifacts []Artifact) execRecord {
+	r := execRecord{exec.exec_id, exec.job_id, exec.start_time, exec.end_time, exec.run_user, exec.one_off, exec.writes, exec.primary_read, exec.host,
+		exec.command, exec.params, exec.stopped_by, exec.stop_reason, exec.policy_override, exec.runner_state, exec.exit_code, exec.duration, nil}
+	for _, a := range artifacts {
+		r.Artifacts = append(r.Artifacts, artifactRecord{a.name, a.url, a.user, a.added_time})
+	}
+	return r
+}
+
+func (r execRecord) execution() (JobExecution, []Artifact) {
+	exec := JobExecution{exec_id: r.ExecID, job_id: r.JobID, start_time: r.StartTime, end_time: r.EndTime, run_user: r.RunUser, one_off: r.OneOff, writes: r.Writes,
+		primary_read: r.PrimaryRead, host: r.Host, command: r.Command, params: r.Params, stopped_by: r.StoppedBy, stop_reason: r.StopReason,
+		policy_override: r.PolicyOverride, runner_state: r.RunnerState, exit_code: r.ExitCode, duration: r.Duration}
+	artifacts := []Artifact{}
+	for _, a := range r.Artifacts {
+		artifacts = append(artifacts, Artifact{name: a.Name, url: a.URL, user: a.User, added_time: a.Added})
+	}
+	return exec, artifacts
+}
+
+// compareRecord returns "added", "updated" or "unchanged" depending on what
+// storing v under key would do.
+func compareRecord(b *bolt.Bucket, key []byte, v interface{}) (string, error) {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	switch old := b.Get(key); {
+	case old == nil:
+		return "added", nil
+	case string(old) == string(value):
+		return "unchanged", nil
+	}
+	return "updated", nil
+}
+
+// putRecord stores v under key, returning what compareRecord would have.
+func putRecord(b *bolt.Bucket, key []byte, v interface{}) (string, error) {
+	status, err := compareRecord(b, key, v)
+	if err != nil || status == "unchanged" {
+		return status, err
+	}
+	value, _ := json.Marshal(v)
+	return status, b.Put(key, value)
+}
+
+func (s *Store) Jobs() ([]ProdJob, error) {
+	jobs := []ProdJob{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(jobs_bucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			r := jobRecord{}
+			if err := json.Unmarshal(v, &r); err != nil {
+				return fmt.Errorf("job %x: %v", k, err)
+			}
+			jobs = append(jobs, r.job())
+			return nil
+		})
+	})
+	return jobs, err
+}
+
+// Executions returns every stored execution, ordered by exec ID.
+func (s *Store) Executions() ([]JobExecution, map[int][]Artifact, error) {
+	execs := []JobExecution{}
+	artifacts := make(map[int][]Artifact)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(executions_bucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			r := execRecord{}
+			if err := json.Unmarshal(v, &r); err != nil {
+				return fmt.Errorf("execution %q: %v", k, err)
+			}
+			exec, a := r.execution()
+			execs = append(execs, exec)
+			if len(a) > 0 {
+				artifacts[exec.exec_id] = a
+			}
+			return nil
+		})
+	})
+	sort.Slice(execs, func(i, j int) bool { return execs[i].exec_id < execs[j].exec_id })
+	return execs, artifacts, err
+}
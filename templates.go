@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Command templates. A job can define its command once with typed
+// parameters, e.g.
+//
+//	backfill_merchant --merchant {{merchant_id:int}} --dry-run={{dry_run:bool}}
+//
+// and then be started with `/prod start <job id> merchant_id=123 dry_run=no`.
+// Types are int, signed_int, bool and string (the default); string values
+// can't contain shell metacharacters. Only signed_int values may start with a
+// -, so nothing else can be passed off as a flag. The values used are
+// recorded on the execution.
+
+var (
+	template_param_re	= regexp.MustCompile(`\{\{([^{}]*)\}\}`)
+	template_name_re	= regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	template_unsafe_chars	= ";|&$`'\"<>(){}\\*?!~#\n"
+	// these are execution fields that can be given alongside a template's parameters
+	template_reserved	map[string]bool	= map[string]bool{"host": true, "oneoff": true, "writes": true, "primary_read": true}
+)
+
+type TemplateParam struct {
+	name	string
+	kind	string
+}
+
+func parseTemplateParam(inner string) (TemplateParam, error) {
+	parts := strings.SplitN(strings.TrimSpace(inner), ":", 2)
+	param := TemplateParam{name: strings.TrimSpace(parts[0]), kind: "string"}
+	if len(parts) == 2 {
+		param.kind = strings.ToLower(strings.TrimSpace(parts[1]))
+	}
+	if !template_name_re.MatchString(param.name) {
+		return param, fmt.Errorf("'%v' isn't a valid parameter name", param.name)
+	}
+	if template_reserved[param.name] {
+		return param, fmt.Errorf("'%v' is reserved", param.name)
+	}
+	if param.kind != "int" && param.kind != "signed_int" && param.kind != "bool" && param.kind != "string" {
+		return param, fmt.Errorf("'%v' has unknown type '%v'; use int, signed_int, bool or string", param.name, param.kind)
+	}
+	return param, nil
+}
+
+// parseTemplate returns the template's parameters in the order they first appear.
+func parseTemplate(template string) ([]TemplateParam, error) {
+	params := []TemplateParam{}
+	kinds := make(map[string]string)
+	for _, m := range template_param_re.FindAllStringSubmatch(template, -1) {
+		param, err := parseTemplateParam(m[1])
+		if err != nil {
+			return nil, err
+		}
+		if kind, ok := kinds[param.name]; ok {
+			if kind != param.kind {
+				return nil, fmt.Errorf("'%v' is used as both %v and %v", param.name, kind, param.kind)
+			}
+			continue
+		}
+		kinds[param.name] = param.kind
+		params = append(params, param)
+	}
+	return params, nil
+}
+
+func checkTemplateValue(param TemplateParam, value string) (string, error) {
+	if param.kind != "signed_int" && strings.HasPrefix(value, "-") {
+		return "", fmt.Errorf("%v can't start with -, got '%v'", param.name, value)
+	}
+	switch param.kind {
+	case "int", "signed_int":
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return "", fmt.Errorf("%v must be an integer, got '%v'", param.name, value)
+		}
+	case "bool":
+		b, ok := parseBool(value)
+		if !ok {
+			return "", fmt.Errorf("%v must be a boolean (yes/no, true/false, 1/0), got '%v'", param.name, value)
+		}
+		return strconv.FormatBool(b), nil
+	default:
+		if value == "" || strings.ContainsAny(value, template_unsafe_chars) {
+			return "", fmt.Errorf("%v can't be empty or contain shell characters like ; | & $ or quotes, got '%v'", param.name, value)
+		}
+	}
+	return value, nil
+}
+
+// renderTemplate fills in the template's parameters from values, checking
+// that every parameter is given, has the right type, and nothing extra was.
+func renderTemplate(template string, values map[string]string) (string, map[string]string, error) {
+	params, err := parseTemplate(template)
+	if err != nil {
+		return "", nil, err
+	}
+	rendered := make(map[string]string)
+	for _, param := range params {
+		value, ok := values[param.name]
+		if !ok {
+			return "", nil, fmt.Errorf("missing %v (%v)", param.name, param.kind)
+		}
+		if rendered[param.name], err = checkTemplateValue(param, value); err != nil {
+			return "", nil, err
+		}
+	}
+	for name := range values {
+		if _, ok := rendered[name]; !ok {
+			return "", nil, fmt.Errorf("the template has no parameter named %v", name)
+		}
+	}
+	command := template_param_re.ReplaceAllStringFunc(template, func(m string) string {
+		param, _ := parseTemplateParam(m[2 : len(m)-2])
+		return rendered[param.name]
+	})
+	return command, rendered, nil
+}
+
+func parseBool(s string) (bool, bool) {
+	switch strings.ToLower(s) {
+	case "yes", "true", "1":
+		return true, true
+	case "no", "false", "0":
+		return false, true
+	}
+	return false, false
+}
+
+// Parameters are kept on executions (and in the sheet) as "a=1 b=2"
+func formatParams(params map[string]string) string {
+	names := []string{}
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := []string{}
+	for _, name := range names {
+		pairs = append(pairs, name+"="+params[name])
+	}
+	return strings.Join(pairs, " ")
+}
+
+func parseParams(s string) map[string]string {
+	params := make(map[string]string)
+	for _, pair := range strings.Fields(s) {
+		if i := strings.Index(pair, "="); i > 0 {
+			params[pair[:i]] = pair[i+1:]
+		}
+	}
+	return params
+}
+
+// parseKeyValues splits "a=1 b=2" style words, returning false if any word
+// isn't of that form.
+func parseKeyValues(words []string) (map[string]string, bool) {
+	values := make(map[string]string)
+	for _, word := range words {
+		i := strings.Index(word, "=")
+		if i <= 0 {
+			return nil, false
+		}
+		values[word[:i]] = word[i+1:]
+	}
+	return values, true
+}
+
+// generateExecutionFromTemplate renders the job's template with the given
+// key=value words. host, oneoff, writes and primary_read can be given too;
+// otherwise they're copied from the job's most recent execution.
+func generateExecutionFromTemplate(job ProdJob, user string, values map[string]string) (JobExecution, error) {
+	exec := JobExecution{exec_id: generateExecId(), job_id: job.job_id, run_user: user}
+	if prev := generateExecutionFromPreviousExecution(job.job_id, user); prev.exec_id >= 0 {
+		exec.host, exec.one_off, exec.writes, exec.primary_read = prev.host, prev.one_off, prev.writes, prev.primary_read
+	}
+	params := make(map[string]string)
+	for name, value := range values {
+		if !template_reserved[name] {
+			params[name] = value
+			continue
+		}
+		if name == "host" {
+			exec.host = value
+			continue
+		}
+		b, ok := parseBool(value)
+		if !ok {
+			return exec, fmt.Errorf("%v must be a boolean (yes/no, true/false, 1/0), got '%v'", name, value)
+		}
+		switch name {
+		case "oneoff":
+			exec.one_off = b
+		case "writes":
+			exec.writes = b
+		case "primary_read":
+			exec.primary_read = b
+		}
+	}
+	if exec.host == "" {
+		return exec, fmt.Errorf("job %v hasn't been run before, so I don't know the host; add host=<host>", job.job_id)
+	}
+	command, rendered, err := renderTemplate(job.template, params)
+	if err != nil {
+		return exec, err
+	}
+	exec.command = storedCommand(command)
+	exec.params = formatParams(rendered)
+	return exec, nil
+}
+
+func serializeTemplateParams(template string) string {
+	params, err := parseTemplate(template)
+	if err != nil {
+		return err.Error()
+	}
+	pairs := []string{}
+	for _, param := range params {
+		pairs = append(pairs, fmt.Sprintf("%v=<%v>", param.name, param.kind))
+	}
+	return strings.Join(pairs, " ")
+}
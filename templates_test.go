@@ -0,0 +1,80 @@
+package main
+
+import "testing"
+
+func TestParseTemplate(t *testing.T) {
+	tests := []struct {
+		template	string
+		params		[]TemplateParam
+		ok		bool
+	}{
+		{"backfill", []TemplateParam{}, true},
+		{"backfill --merchant {{merchant_id:int}} --dry-run={{dry_run:bool}}", []TemplateParam{{"merchant_id", "int"}, {"dry_run", "bool"}}, true},
+		{"echo {{ name }} {{name:string}}", []TemplateParam{{"name", "string"}}, true},
+		{"echo {{n:INT}}", []TemplateParam{{"n", "int"}}, true},
+		{"echo {{n:signed_int}}", []TemplateParam{{"n", "signed_int"}}, true},
+		{"echo {{n:int}} {{n:bool}}", nil, false},
+		{"echo {{n:float}}", nil, false},
+		{"echo {{1n}}", nil, false},
+		{"echo {{}}", nil, false},
+		{"ssh {{host}}", nil, false},
+	}
+	for _, test := range tests {
+		params, err := parseTemplate(test.template)
+		if (err == nil) != test.ok {
+			t.Errorf("parseTemplate(%q) error = %v, want ok %v", test.template, err, test.ok)
+			continue
+		}
+		if len(params) != len(test.params) {
+			t.Errorf("parseTemplate(%q) = %v, want %v", test.template, params, test.params)
+			continue
+		}
+		for i := range params {
+			if params[i] != test.params[i] {
+				t.Errorf("parseTemplate(%q) = %v, want %v", test.template, params, test.params)
+				break
+			}
+		}
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	template := "backfill --merchant {{merchant_id:int}} --dry-run={{dry_run:bool}} --note {{note}}"
+	tests := []struct {
+		values	map[string]string
+		command	string
+		ok	bool
+	}{
+		{map[string]string{"merchant_id": "123", "dry_run": "no", "note": "ticket-42"}, "backfill --merchant 123 --dry-run=false --note ticket-42", true},
+		{map[string]string{"merchant_id": "7", "dry_run": "YES", "note": "x"}, "backfill --merchant 7 --dry-run=true --note x", true},
+		// nothing but a signed_int can start with -, or it could be taken as a flag
+		{map[string]string{"merchant_id": "-7", "dry_run": "no", "note": "x"}, "", false},
+		{map[string]string{"merchant_id": "1", "dry_run": "no", "note": "--drop"}, "", false},
+		{map[string]string{"merchant_id": "1", "dry_run": "no", "note": "-rf"}, "", false},
+		{map[string]string{"merchant_id": "1", "dry_run": "no", "note": "a-b"}, "backfill --merchant 1 --dry-run=false --note a-b", true},
+		{map[string]string{"merchant_id": "12a", "dry_run": "no", "note": "x"}, "", false},
+		{map[string]string{"merchant_id": "1.5", "dry_run": "no", "note": "x"}, "", false},
+		{map[string]string{"merchant_id": "1", "dry_run": "maybe", "note": "x"}, "", false},
+		{map[string]string{"merchant_id": "1", "dry_run": "no", "note": "x; rm -rf /"}, "", false},
+		{map[string]string{"merchant_id": "1", "dry_run": "no", "note": "$(whoami)"}, "", false},
+		{map[string]string{"merchant_id": "1", "dry_run": "no", "note": ""}, "", false},
+		{map[string]string{"merchant_id": "1", "dry_run": "no"}, "", false},
+		{map[string]string{"merchant_id": "1", "dry_run": "no", "note": "x", "extra": "y"}, "", false},
+	}
+	for _, test := range tests {
+		command, _, err := renderTemplate(template, test.values)
+		if (err == nil) != test.ok || command != test.command {
+			t.Errorf("renderTemplate(%v) = %q, %v; want %q, ok %v", test.values, command, err, test.command, test.ok)
+		}
+	}
+}
+
+func TestRenderTemplateSignedInt(t *testing.T) {
+	command, _, err := renderTemplate("shift --days {{days:signed_int}}", map[string]string{"days": "-7"})
+	if err != nil || command != "shift --days -7" {
+		t.Errorf("renderTemplate = %q, %v; want a negative signed_int allowed", command, err)
+	}
+	if _, _, err := renderTemplate("shift --days {{days:signed_int}}", map[string]string{"days": "--all"}); err == nil {
+		t.Error("renderTemplate allowed a flag as a signed_int")
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Outbound webhooks. Endpoints live in webhooks.json next to client_secret.json:
+//
+//	{"endpoints": [{"url": "https://example.com/hook", "secret": "shh", "events": ["execution.started"]}]}
+//
+// An endpoint with no events gets everything. Each POST body is signed with
+// HMAC-SHA256 over "<timestamp>.<body>" using the endpoint's secret.
+
+const (
+	webhook_config_file	= "webhooks.json"
+	webhook_max_attempts	= 5
+	webhook_log_size	= 200
+)
+
+type WebhookEndpoint struct {
+	URL	string		`json:"url"`
+	Secret	string		`json:"secret"`
+	Events	[]string	`json:"events"`
+}
+
+type WebhookEvent struct {
+	ID		string		`json:"id"`
+	Event		string		`json:"event"`
+	CreatedAt	time.Time	`json:"created_at"`
+	Data		interface{}	`json:"data"`
+}
+
+type WebhookDelivery struct {
+	delivery_id	string
+	event		string
+	url		string
+	attempts	int
+	status		int
+	err		string
+	sent_at		time.Time
+}
+
+type CherryPickRequest struct {
+	User		string		`json:"user"`
+	PhabDiff	string		`json:"phab_diff"`
+	SHA		string		`json:"sha"`
+	Tiers		[]string	`json:"tiers"`
+	NeedsTest	string		`json:"needs_test"`
+	Approver	string		`json:"approver"`
+}
+
+var (
+	webhook_endpoints	[]WebhookEndpoint	= []WebhookEndpoint{}
+	webhook_client		*http.Client		= &http.Client{Timeout: 10 * time.Second}
+	webhook_deliveries	[]WebhookDelivery	= []WebhookDelivery{}
+	webhook_mutex		sync.Mutex
+	webhook_sequence	int
+)
+
+func LoadWebhooks() {
+	b, err := ioutil.ReadFile(webhook_config_file)
+	if err != nil {
+		fmt.Printf("[INFO] No %v found, webhooks disabled\n", webhook_config_file)
+		return
+	}
+	config := struct {
+		Endpoints []WebhookEndpoint `json:"endpoints"`
+	}{}
+	if err := json.Unmarshal(b, &config); err != nil {
+		fmt.Printf("[ERROR] Unable to parse %v: %v\n", webhook_config_file, err)
+		return
+	}
+	webhook_endpoints = config.Endpoints
+	fmt.Printf("[INFO] Loaded %v webhook endpoints\n", len(webhook_endpoints))
+}
+
+func (e WebhookEndpoint) wants(event string) bool {
+	if len(e.Events) == 0 {
+		return true
+	}
+	for _, v := range e.Events {
+		if v == event || v == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// emitEvent fans the event out to every interested endpoint. Delivery happens
+// in the background so slash command responses aren't held up by slow hooks.
+func emitEvent(event string, data interface{}) {
+	if len(webhook_endpoints) == 0 {
+		return
+	}
+	webhook_mutex.Lock()
+	webhook_sequence++
+	id := fmt.Sprintf("%v-%v", time.Now().Unix(), webhook_sequence)
+	webhook_mutex.Unlock()
+
+	body, err := json.Marshal(WebhookEvent{ID: id, Event: event, CreatedAt: time.Now(), Data: data})
+	if err != nil {
+		fmt.Printf("[ERROR] Unable to marshal %v webhook: %v\n", event, err)
+		return
+	}
+	for _, endpoint := range webhook_endpoints {
+		if endpoint.wants(event) {
+			go deliverWebhook(endpoint, id, event, body)
+		}
+	}
+}
+
+func deliverWebhook(endpoint WebhookEndpoint, id, event string, body []byte) {
+	delivery := WebhookDelivery{delivery_id: id, event: event, url: endpoint.URL}
+	backoff := time.Second
+	for delivery.attempts < webhook_max_attempts {
+		if delivery.attempts > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		delivery.attempts++
+		delivery.sent_at = time.Now()
+
+		timestamp := strconv.FormatInt(delivery.sent_at.Unix(), 10)
+		req, err := http.NewRequest("POST", endpoint.URL, bytes.NewBuffer(body))
+		if err != nil {
+			// no point retrying a URL we can't even build a request for
+			delivery.err = err.Error()
+			break
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Pharbot-Event", event)
+		req.Header.Set("X-Pharbot-Delivery", id)
+		req.Header.Set("X-Pharbot-Timestamp", timestamp)
+		req.Header.Set("X-Pharbot-Signature", signWebhook(endpoint.Secret, timestamp, body))
+
+		resp, err := webhook_client.Do(req)
+		if err != nil {
+			delivery.status = 0
+			delivery.err = err.Error()
+			continue
+		}
+		resp.Body.Close()
+		delivery.status = resp.StatusCode
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			delivery.err = ""
+			break
+		}
+		delivery.err = resp.Status
+		// 4xx other than rate limiting means the receiver rejected us, retrying won't help
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			break
+		}
+	}
+	if delivery.err != "" {
+		fmt.Printf("[ERROR] Webhook %v (%v) to %v failed after %v attempts: %v\n", id, event, endpoint.URL, delivery.attempts, delivery.err)
+	}
+	recordDelivery(delivery)
+}
+
+func recordDelivery(delivery WebhookDelivery) {
+	webhook_mutex.Lock()
+	defer webhook_mutex.Unlock()
+	webhook_deliveries = append(webhook_deliveries, delivery)
+	if len(webhook_deliveries) > webhook_log_size {
+		webhook_deliveries = webhook_deliveries[len(webhook_deliveries)-webhook_log_size:]
+	}
+}
+
+// recentDeliveries returns up to n deliveries, newest first.
+func recentDeliveries(n int) []WebhookDelivery {
+	webhook_mutex.Lock()
+	defer webhook_mutex.Unlock()
+	deliveries := []WebhookDelivery{}
+	for i := len(webhook_deliveries) - 1; i >= 0 && len(deliveries) < n; i-- {
+		deliveries = append(deliveries, webhook_deliveries[i])
+	}
+	return deliveries
+}
+
+func serializeWebhookDelivery(d WebhookDelivery) string {
+	status := "ok"
+	if d.err != "" {
+		status = "failed: " + d.err
+	}
+	return fmt.Sprintf("`%v` *%v* → %v (%v, %v attempt(s), %v)", d.delivery_id, d.event, d.url, status, d.attempts, d.sent_at.Format(time.RFC822))
+}
+
+func executionEventData(exec JobExecution) interface{} {
+	return struct {
+		Execution	JobExecution	`json:"execution"`
+		Job		ProdJob		`json:"job"`
+	}{exec, getProdJob(exec.job_id)}
+}
+
+func listWebhookDeliveries(n int) string {
+	if len(webhook_endpoints) == 0 {
+		return fmt.Sprintf("No webhook endpoints are configured. Add some to `%v` and restart pharbot.", webhook_config_file)
+	}
+	deliveries := recentDeliveries(n)
+	if len(deliveries) == 0 {
+		return "No webhook deliveries yet"
+	}
+	msg := ""
+	for _, d := range deliveries {
+		msg += serializeWebhookDelivery(d) + "\n"
+	}
+	return msg
+}